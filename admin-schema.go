@@ -0,0 +1,236 @@
+package main
+
+// adminApiSchema is the JSON schema of the admin API, served on /schema. Each path lists the schemas of its request
+// and response under "paths", and errors are reported as ErrorResponse with one of the codes in "errorCodes".
+const adminApiSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "title": "Elastifile Docker Volume Plugin admin API",
+  "errorCodes": {
+    "invalid_request": 400,
+    "unauthorized": 401,
+    "not_found": 404,
+    "conflict": 409,
+    "internal": 500,
+    "backend_error": 502
+  },
+  "paths": {
+    "GET /volumes/{name}": {"response": "#/definitions/InspectResponse"},
+    "PUT /volumes/{name}/protection": {"request": "#/definitions/ProtectionRequest", "response": "#/definitions/ErrorResponse"},
+    "PUT /volumes/{name}/mount-options": {"request": "#/definitions/MountOptionsRequest", "response": "#/definitions/MountOptionsResponse"},
+    "POST /volumes/{name}/unmount": {"request": "#/definitions/UnmountRequest", "response": "#/definitions/ErrorResponse"},
+    "POST /volumes/{name}/snapshot": {"request": "#/definitions/SnapshotRequest", "response": "#/definitions/SnapshotResponse"},
+    "PUT /volumes/{name}/size": {"request": "#/definitions/ResizeRequest", "response": "#/definitions/ResizeResponse"},
+    "POST /volumes/{name}/clone": {"request": "#/definitions/CloneRequest", "response": "#/definitions/ErrorResponse"},
+    "POST /volumes/{name}/restore": {"request": "#/definitions/RestoreSnapshotRequest", "response": "#/definitions/ErrorResponse"},
+    "POST /volumes/{name}/import": {"request": "#/definitions/ImportRequest", "response": "#/definitions/ErrorResponse"},
+    "GET /trash": {"response": "#/definitions/TrashListResponse"},
+    "POST /trash/{dcName}/restore": {"request": "#/definitions/RestoreRequest", "response": "#/definitions/ErrorResponse"},
+    "GET /orphans": {"response": "#/definitions/OrphansResponse"},
+    "GET /audit": {"query": ["volume", "operation", "since", "limit"], "response": "#/definitions/AuditResponse"},
+    "POST /reconcile": {"request": "#/definitions/DryRunRequest", "response": "#/definitions/ReconcileResponse"},
+    "POST /gc": {"request": "#/definitions/DryRunRequest", "response": "#/definitions/GcResponse"},
+    "GET /state": {"response": "#/definitions/StateResponse"},
+    "GET /schema": {"response": "this document"}
+  },
+  "definitions": {
+    "ErrorResponse": {
+      "type": "object",
+      "properties": {
+        "Err": {"type": "string"},
+        "Code": {"enum": ["invalid_request", "unauthorized", "not_found", "conflict", "internal", "backend_error"]}
+      }
+    },
+    "ProtectionRequest": {
+      "type": "object",
+      "properties": {"Protected": {"type": "boolean"}},
+      "required": ["Protected"]
+    },
+    "MountOptionsRequest": {
+      "type": "object",
+      "properties": {"MountOpts": {"type": "array", "items": {"type": "string"}}},
+      "required": ["MountOpts"]
+    },
+    "MountOptionsResponse": {
+      "type": "object",
+      "properties": {"MountOpts": {"type": "array", "items": {"type": "string"}}}
+    },
+    "UnmountRequest": {
+      "type": "object",
+      "properties": {"Strategy": {"type": "array", "items": {"enum": ["retry", "force", "detach"]}}}
+    },
+    "SnapshotRequest": {
+      "type": "object",
+      "properties": {"Snapshot": {"type": "string", "pattern": "^[^/]+$"}}
+    },
+    "SnapshotResponse": {
+      "type": "object",
+      "properties": {"Snapshot": {"type": "string"}}
+    },
+    "ResizeRequest": {
+      "type": "object",
+      "properties": {"Size": {"type": "string", "pattern": "^[0-9]+(TiB|GiB|MiB|KiB|B)?$"}},
+      "required": ["Size"]
+    },
+    "ResizeResponse": {
+      "type": "object",
+      "properties": {"Size": {"type": "integer", "description": "Bytes"}}
+    },
+    "CloneRequest": {
+      "type": "object",
+      "properties": {
+        "Source": {"type": "string"},
+        "Snapshot": {"type": "string", "pattern": "^[^/]+$"}
+      },
+      "required": ["Source", "Snapshot"]
+    },
+    "RestoreSnapshotRequest": {
+      "type": "object",
+      "properties": {"Snapshot": {"type": "string", "pattern": "^[^/]+$"}},
+      "required": ["Snapshot"]
+    },
+    "ImportRequest": {
+      "type": "object",
+      "properties": {
+        "DataContainer": {"type": "string"},
+        "MountOpts": {"type": "array", "items": {"type": "string"}}
+      },
+      "required": ["DataContainer"]
+    },
+    "RestoreRequest": {
+      "type": "object",
+      "properties": {"Name": {"type": "string", "description": "Defaults to the name of the removed volume"}}
+    },
+    "DryRunRequest": {
+      "type": "object",
+      "properties": {"DryRun": {"type": "boolean"}}
+    },
+    "TrashEntry": {
+      "type": "object",
+      "properties": {
+        "DcName": {"type": "string"},
+        "DcId": {"type": "integer"},
+        "Volume": {"type": "string"},
+        "TrashedAt": {"type": "string", "format": "date-time"}
+      }
+    },
+    "TrashListResponse": {
+      "type": "object",
+      "properties": {"Entries": {"type": "array", "items": {"$ref": "#/definitions/TrashEntry"}}}
+    },
+    "OrphansResponse": {
+      "type": "object",
+      "properties": {
+        "Orphans": {
+          "type": "object",
+          "additionalProperties": {
+            "type": "object",
+            "properties": {
+              "Since": {"type": "string", "format": "date-time"},
+              "Error": {"type": "string"},
+              "Holders": {"type": "array", "items": {"type": "object"}}
+            }
+          }
+        }
+      }
+    },
+    "AuditObject": {
+      "type": "object",
+      "properties": {"Id": {"type": "integer"}, "Name": {"type": "string"}}
+    },
+    "AuditEntry": {
+      "type": "object",
+      "properties": {
+        "Time": {"type": "string", "format": "date-time"},
+        "Operation": {"type": "string"},
+        "Volume": {"type": "string"},
+        "RequestId": {"type": "string"},
+        "CallerId": {"type": "string"},
+        "Options": {"type": "object", "additionalProperties": {"type": "string"}},
+        "DataContainer": {"$ref": "#/definitions/AuditObject"},
+        "Export": {"$ref": "#/definitions/AuditObject"},
+        "Parent": {"type": "string"},
+        "Subdir": {"type": "string"},
+        "Snapshot": {"type": "string"},
+        "Result": {"enum": ["success", "error"]},
+        "Error": {"type": "string"}
+      }
+    },
+    "AuditResponse": {
+      "type": "object",
+      "properties": {"Entries": {"type": "array", "items": {"$ref": "#/definitions/AuditEntry"}}}
+    },
+    "Volume": {
+      "type": "object",
+      "description": "A volume as persisted in the plugin state",
+      "properties": {
+        "Mountpoint": {"type": "string"},
+        "MountOpts": {"type": ["array", "null"], "items": {"type": "string"}},
+        "Export": {"type": ["object", "null"]},
+        "DataContainer": {"type": ["object", "null"]},
+        "Owner": {"type": "string"},
+        "Adopted": {"type": "boolean"},
+        "ForceDelete": {"type": "boolean"},
+        "Protected": {"type": "boolean"},
+        "CreatedAt": {"type": "string", "format": "date-time"},
+        "RemoveIfExists": {"type": "boolean"},
+        "Orphaned": {"type": "object"},
+        "Parent": {"type": "string"},
+        "Subdir": {"type": "string"},
+        "Snapshot": {"type": "string"}
+      }
+    },
+    "InspectResponse": {
+      "type": "object",
+      "properties": {
+        "Name": {"type": "string"},
+        "Volume": {"$ref": "#/definitions/Volume"},
+        "Status": {"type": "object", "description": "As reported by docker volume inspect"}
+      }
+    },
+    "ReconcileFinding": {
+      "type": "object",
+      "properties": {
+        "Volume": {"type": "string"},
+        "DataContainer": {"type": "string"},
+        "Issue": {"enum": ["dc_missing", "dc_replaced", "dc_trashed", "dc_renamed", "dc_changed", "protection_changed"]},
+        "Details": {"type": "string"},
+        "Fixed": {"type": "boolean"}
+      }
+    },
+    "ReconcileResponse": {
+      "type": "object",
+      "properties": {
+        "DryRun": {"type": "boolean"},
+        "Findings": {"type": "array", "items": {"$ref": "#/definitions/ReconcileFinding"}}
+      }
+    },
+    "GcOrphan": {
+      "type": "object",
+      "properties": {
+        "Name": {"type": "string"},
+        "Id": {"type": "integer", "description": "Data Container ID"},
+        "Details": {"type": "string"},
+        "FirstSeen": {"type": "string", "format": "date-time"},
+        "Collected": {"type": "boolean", "description": "False in dry-run mode and within GC_GRACE_PERIOD"}
+      }
+    },
+    "GcResponse": {
+      "type": "object",
+      "properties": {
+        "DryRun": {"type": "boolean"},
+        "Trash": {"type": "array", "items": {"$ref": "#/definitions/TrashEntry"}},
+        "OrphanedMounts": {"type": "array", "items": {"type": "string"}},
+        "OrphanedDcs": {"type": "array", "items": {"$ref": "#/definitions/GcOrphan"}},
+        "OrphanedDirs": {"type": "array", "items": {"$ref": "#/definitions/GcOrphan"}},
+        "Errors": {"type": "array", "items": {"type": "string"}}
+      }
+    },
+    "StateResponse": {
+      "type": "object",
+      "properties": {
+        "Volumes": {"type": "object", "additionalProperties": {"$ref": "#/definitions/Volume"}}
+      }
+    }
+  }
+}
+`
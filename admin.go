@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The admin API exposes operations that have no equivalent in the Docker volume API.
+// It listens on a unix socket in the state directory, which is reachable from the host, and optionally on
+// ADMIN_ADDRESS over TLS. If ADMIN_TOKEN is set, requests must carry it as a bearer token on both listeners.
+// Requests and responses are JSON, described by the schema served on /schema (see admin-schema.go).
+const (
+	adminSocketName    = "elastifile-admin.sock"
+	adminVolumesPath   = "/volumes/"
+	adminTrashPath     = "/trash"
+	adminOrphansPath   = "/orphans"
+	adminAuditPath     = "/audit"
+	adminReconcilePath = "/reconcile"
+	adminGcPath        = "/gc"
+	adminStatePath     = "/state"
+	adminSchemaPath    = "/schema"
+)
+
+// Error codes of the admin API, reported along with the error message
+const (
+	errorCodeInvalidRequest = "invalid_request"
+	errorCodeUnauthorized   = "unauthorized"
+	errorCodeNotFound       = "not_found"
+	errorCodeConflict       = "conflict"
+	errorCodeBackend        = "backend_error" // EMS failed
+	errorCodeInternal       = "internal"
+)
+
+var errorCodeStatus = map[string]int{
+	errorCodeInvalidRequest: http.StatusBadRequest,
+	errorCodeUnauthorized:   http.StatusUnauthorized,
+	errorCodeNotFound:       http.StatusNotFound,
+	errorCodeConflict:       http.StatusConflict,
+	errorCodeBackend:        http.StatusBadGateway,
+	errorCodeInternal:       http.StatusInternalServerError,
+}
+
+// codedError is an error with an admin API error code. Errors without a code are internal errors.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func newCodedError(code string, format string, args ...interface{}) error {
+	return &codedError{code: code, err: errors.Errorf(format, args...)}
+}
+
+func withErrorCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+func errorCode(err error) string {
+	if coded, ok := err.(*codedError); ok {
+		return coded.code
+	}
+	return errorCodeInternal
+}
+
+type adminServer struct {
+	driver *elastifileDriver
+	token  string // Required bearer token, if set
+	mux    *http.ServeMux
+}
+
+type protectionRequest struct {
+	Protected bool
+}
+
+type restoreRequest struct {
+	Name string // Name of the restored volume, defaults to the name of the removed volume
+}
+
+type mountOptionsRequest struct {
+	MountOpts []string // Replace the options specified when the volume was created, merged with DEFAULT_MOUNT_OPTIONS
+}
+
+type unmountRequest struct {
+	Strategy []string // Unmount strategy steps, defaults to UNMOUNT_STRATEGY
+}
+
+type snapshotRequest struct {
+	Snapshot string // Defaults to edvp-<UTC time>
+}
+
+type resizeRequest struct {
+	Size string // E.g. 20GiB
+}
+
+type cloneRequest struct {
+	Source   string // Volume backed by its own Data Container
+	Snapshot string
+}
+
+type restoreSnapshotRequest struct {
+	Snapshot string // Snapshot of the volume's Data Container
+}
+
+type importRequest struct {
+	DataContainer string
+	MountOpts     []string // As specified on create, merged with DEFAULT_MOUNT_OPTIONS
+}
+
+type dryRunRequest struct {
+	DryRun bool // Report only
+}
+
+type adminResponse struct {
+	Err  string `json:",omitempty"`
+	Code string `json:",omitempty"` // Error code
+}
+
+type trashListResponse struct {
+	adminResponse
+	Entries []trashEntry
+}
+
+type mountOptionsResponse struct {
+	adminResponse
+	MountOpts []string // Effective on the next mount
+}
+
+type orphansResponse struct {
+	adminResponse
+	Orphans map[string]orphanedMount // By volume name
+}
+
+type auditResponse struct {
+	adminResponse
+	Entries []auditEntry // Oldest first
+}
+
+type inspectResponse struct {
+	adminResponse
+	Name   string
+	Volume json.RawMessage        // As persisted in the state
+	Status map[string]interface{} // As reported by docker volume inspect
+}
+
+type snapshotResponse struct {
+	adminResponse
+	Snapshot string
+}
+
+type resizeResponse struct {
+	adminResponse
+	Size int // Bytes
+}
+
+type reconcileResponse struct {
+	adminResponse
+	DryRun   bool
+	Findings []reconcileFinding
+}
+
+type gcResponse struct {
+	adminResponse
+	*gcReport
+}
+
+type stateResponse struct {
+	adminResponse
+	Volumes json.RawMessage // By name, as persisted in the state
+}
+
+func newAdminServer(driver *elastifileDriver, token string) *adminServer {
+	server := &adminServer{
+		driver: driver,
+		token:  token,
+		mux:    http.NewServeMux(),
+	}
+	server.handle(adminVolumesPath, server.handleVolume)
+	server.handle(adminTrashPath, server.handleTrash)
+	server.handle(adminTrashPath+"/", server.handleTrash)
+	server.handle(adminOrphansPath, server.handleOrphans)
+	server.handle(adminAuditPath, server.handleAudit)
+	server.handle(adminReconcilePath, server.handleReconcile)
+	server.handle(adminGcPath, server.handleGc)
+	server.handle(adminStatePath, server.handleState)
+	server.handle(adminSchemaPath, server.handleSchema)
+	return server
+}
+
+// handle registers the handler, which is called with the request's log context once the request is authorized
+func (a *adminServer) handle(path string, handler func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+	a.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ctx := newLogContext("admin", "")
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"http_method": r.Method,
+			"path":        r.URL.Path,
+		}).Debug("Admin API request")
+
+		if !a.authorized(r) {
+			writeAdminResponse(ctx, w, newCodedError(errorCodeUnauthorized, "missing or invalid token"))
+			return
+		}
+		handler(ctx, w, r)
+	})
+}
+
+func (a *adminServer) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	expected := "Bearer " + a.token
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+func (a *adminServer) ServeUnix(socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return errors.WrapPrefix(err, "Failed to remove stale admin socket", 0)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to listen on admin socket", 0)
+	}
+
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return errors.WrapPrefix(err, "Failed to set admin socket permissions", 0)
+	}
+
+	logrus.Infof("Admin API listening on %v", socketPath)
+	return http.Serve(listener, a.mux)
+}
+
+// ServeTLS serves the admin API on the TCP address. Client certificates signed by the CA in clientCaFile are
+// required if it's set.
+func (a *adminServer) ServeTLS(address string, certFile string, keyFile string, clientCaFile string) error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCaFile != "" {
+		caPem, err := ioutil.ReadFile(clientCaFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to read admin API client CA", 0)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return errors.Errorf("No certificates found in %v", clientCaFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           a.mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	logrus.Infof("Admin API listening on %v (TLS)", address)
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// handleVolume serves /volumes/<name> and /volumes/<name>/<operation>
+func (a *adminServer) handleVolume(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminVolumesPath), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		writeAdminResponse(ctx, w, newCodedError(errorCodeNotFound, "unknown path %v", r.URL.Path))
+		return
+	}
+	name, operation := parts[0], ""
+	if len(parts) == 2 {
+		operation = parts[1]
+	}
+	ctx = withLogFields(ctx, logrus.Fields{logFieldVolume: name})
+
+	switch {
+	case operation == "" && r.Method == http.MethodGet:
+		volume, status, err := a.driver.inspectVolume(ctx, name)
+		if err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, inspectResponse{Name: name, Volume: volume, Status: status})
+	case operation == "protection" && r.Method == http.MethodPut:
+		var req protectionRequest
+		if err := decodeAdminRequest(r, &req, false); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminResponse(ctx, w, a.driver.setProtected(ctx, name, req.Protected))
+	case operation == "mount-options" && r.Method == http.MethodPut:
+		var req mountOptionsRequest
+		if err := decodeAdminRequest(r, &req, false); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		mountOpts, err := a.driver.setMountOptions(ctx, name, req.MountOpts)
+		if err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, mountOptionsResponse{MountOpts: mountOpts})
+	case operation == "unmount" && r.Method == http.MethodPost: // Clean up an orphaned mount
+		var req unmountRequest
+		if err := decodeAdminRequest(r, &req, true); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		strategy, err := parseUnmountStrategy(strings.Join(req.Strategy, ","))
+		if err != nil {
+			writeAdminResponse(ctx, w, withErrorCode(errorCodeInvalidRequest, err))
+			return
+		}
+		if len(req.Strategy) == 0 {
+			strategy = nil
+		}
+		writeAdminResponse(ctx, w, a.driver.cleanupOrphanedMount(ctx, name, strategy))
+	case operation == "snapshot" && r.Method == http.MethodPost:
+		var req snapshotRequest
+		if err := decodeAdminRequest(r, &req, true); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		snapshot, err := a.driver.createSnapshot(ctx, name, req.Snapshot)
+		if err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, snapshotResponse{Snapshot: snapshot})
+	case operation == "size" && r.Method == http.MethodPut:
+		var req resizeRequest
+		if err := decodeAdminRequest(r, &req, false); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		size, err := a.driver.resizeVolume(ctx, name, req.Size)
+		if err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, resizeResponse{Size: size})
+	case operation == "clone" && r.Method == http.MethodPost:
+		var req cloneRequest
+		if err := decodeAdminRequest(r, &req, false); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminResponse(ctx, w, a.driver.cloneVolume(ctx, name, req.Source, req.Snapshot))
+	case operation == "restore" && r.Method == http.MethodPost:
+		var req restoreSnapshotRequest
+		if err := decodeAdminRequest(r, &req, false); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminResponse(ctx, w, a.driver.restoreSnapshot(ctx, name, req.Snapshot))
+	case operation == "import" && r.Method == http.MethodPost:
+		var req importRequest
+		if err := decodeAdminRequest(r, &req, false); err != nil {
+			writeAdminResponse(ctx, w, err)
+			return
+		}
+		writeAdminResponse(ctx, w, a.driver.importVolume(ctx, name, req.DataContainer, req.MountOpts))
+	default:
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+	}
+}
+
+// handleTrash serves /trash and /trash/<dcName>/restore
+func (a *adminServer) handleTrash(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == adminTrashPath && r.Method == http.MethodGet {
+		entries, err := a.driver.listTrash(ctx)
+		if err != nil {
+			writeAdminResponse(ctx, w, withErrorCode(errorCodeBackend, err))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, trashListResponse{Entries: entries})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminTrashPath+"/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "restore" || r.Method != http.MethodPost {
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+		return
+	}
+
+	var req restoreRequest
+	if err := decodeAdminRequest(r, &req, true); err != nil {
+		writeAdminResponse(ctx, w, err)
+		return
+	}
+	writeAdminResponse(ctx, w, a.driver.restoreFromTrash(ctx, parts[0], req.Name))
+}
+
+// handleOrphans serves /orphans
+func (a *adminServer) handleOrphans(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, orphansResponse{Orphans: a.driver.orphanedMounts()})
+}
+
+// handleAudit serves /audit?volume=<name>&operation=<operation>&since=<RFC 3339 time>&limit=<latest entries>
+func (a *adminServer) handleAudit(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+		return
+	}
+	if a.driver.audit == nil {
+		writeAdminResponse(ctx, w, newCodedError(errorCodeNotFound, "audit log is disabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditFilter{
+		Volume:    query.Get("volume"),
+		Operation: query.Get("operation"),
+	}
+	if since := query.Get("since"); since != "" {
+		var err error
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			writeAdminResponse(ctx, w, newCodedError(errorCodeInvalidRequest, "invalid since: %v", since))
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			writeAdminResponse(ctx, w, newCodedError(errorCodeInvalidRequest, "invalid limit: %v", limit))
+			return
+		}
+	}
+
+	entries, err := a.driver.audit.query(filter)
+	if err != nil {
+		writeAdminResponse(ctx, w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, auditResponse{Entries: entries})
+}
+
+// handleReconcile serves /reconcile
+func (a *adminServer) handleReconcile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req dryRunRequest
+	if r.Method != http.MethodPost {
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+		return
+	}
+	if err := decodeAdminRequest(r, &req, true); err != nil {
+		writeAdminResponse(ctx, w, err)
+		return
+	}
+	findings, err := a.driver.reconcile(ctx, req.DryRun)
+	if err != nil {
+		writeAdminResponse(ctx, w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, reconcileResponse{DryRun: req.DryRun, Findings: findings})
+}
+
+// handleGc serves /gc
+func (a *adminServer) handleGc(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req dryRunRequest
+	if r.Method != http.MethodPost {
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+		return
+	}
+	if err := decodeAdminRequest(r, &req, true); err != nil {
+		writeAdminResponse(ctx, w, err)
+		return
+	}
+	report, err := a.driver.gc(ctx, req.DryRun)
+	if err != nil {
+		writeAdminResponse(ctx, w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, gcResponse{gcReport: report})
+}
+
+// handleState serves /state, the full state of the plugin
+func (a *adminServer) handleState(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+		return
+	}
+	volumes, err := a.driver.dumpState()
+	if err != nil {
+		writeAdminResponse(ctx, w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, stateResponse{Volumes: volumes})
+}
+
+// handleSchema serves /schema, the JSON schema of the admin API
+func (a *adminServer) handleSchema(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminResponse(ctx, w, unsupportedOperation(r))
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	io.WriteString(w, adminApiSchema)
+}
+
+// decodeAdminRequest decodes the JSON body of the request. An empty body is accepted if the request is optional.
+func decodeAdminRequest(r *http.Request, req interface{}, optional bool) error {
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err == io.EOF && optional {
+		return nil
+	}
+	if err != nil {
+		return newCodedError(errorCodeInvalidRequest, "malformed request: %v", err)
+	}
+	return nil
+}
+
+func unsupportedOperation(r *http.Request) error {
+	return newCodedError(errorCodeNotFound, "unsupported operation %v %v", r.Method, r.URL.Path)
+}
+
+// writeAdminResponse writes an empty response, or the error along with its code
+func writeAdminResponse(ctx context.Context, w http.ResponseWriter, err error) {
+	res := adminResponse{}
+	status := http.StatusOK
+	if err != nil {
+		res.Err = err.Error()
+		res.Code = errorCode(err)
+		status = errorCodeStatus[res.Code]
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"status": status,
+			"code":   res.Code,
+		}).Error(res.Err)
+	}
+	writeAdminJSON(w, status, res)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The audit log records the volume lifecycle operations - by Docker, the admin API and the trash purger - as JSON
+// lines in the state directory. It is append-only: once audit.log reaches AUDIT_LOG_MAX_SIZE it is renamed to
+// audit.log.1, audit.log.1 to audit.log.2 and so on, keeping AUDIT_LOG_MAX_FILES rotated files.
+// Failing to write the audit log is logged, and doesn't fail the operation.
+
+const (
+	auditLogName         = "audit.log"
+	auditResultSuccess   = "success"
+	auditResultError     = "error"
+	defaultAuditMaxSize  = 10 * 1024 * 1024
+	defaultAuditMaxFiles = 5
+)
+
+// Audited operations
+const (
+	auditCreate          = "create"
+	auditRemove          = "remove"
+	auditMount           = "mount"
+	auditUnmount         = "unmount"
+	auditSetProtection   = "set-protection"
+	auditSetMountOptions = "set-mount-options"
+	auditCleanupOrphan   = "cleanup-orphan"
+	auditRestore         = "restore"
+	auditPurge           = "purge"
+	auditSnapshot        = "snapshot"
+	auditClone           = "clone"
+	auditRestoreSnapshot = "restore-snapshot"
+	auditResize          = "resize"
+	auditImport          = "import"
+	auditReconcile       = "reconcile"
+	auditGc              = "gc"
+)
+
+// auditObject identifies an EMS object
+type auditObject struct {
+	Id   int
+	Name string
+}
+
+type auditEntry struct {
+	Time          time.Time
+	Operation     string
+	Volume        string
+	RequestId     string
+	CallerId      string            `json:",omitempty"` // Docker's ID of the mount, unique per container mount
+	Options       map[string]string `json:",omitempty"`
+	DataContainer *auditObject      `json:",omitempty"`
+	Export        *auditObject      `json:",omitempty"`
+	Parent        string            `json:",omitempty"`
+	Subdir        string            `json:",omitempty"`
+	Snapshot      string            `json:",omitempty"`
+	Result        string
+	Error         string `json:",omitempty"`
+}
+
+// auditFilter selects audit entries. Zero values match all entries.
+type auditFilter struct {
+	Volume    string
+	Operation string
+	Since     time.Time
+	Limit     int // Latest entries only
+}
+
+func (f *auditFilter) matches(entry *auditEntry) bool {
+	return (f.Volume == "" || entry.Volume == f.Volume) &&
+		(f.Operation == "" || entry.Operation == f.Operation) &&
+		!entry.Time.Before(f.Since)
+}
+
+type auditLog struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File // Opened on first write
+	size     int64
+}
+
+func newAuditLog(path string, maxSize int64, maxFiles int) *auditLog {
+	return &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+// append writes the entry and syncs it to disk
+func (l *auditLog) append(entry *auditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to marshal audit entry", 0)
+	}
+	data = append(data, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file == nil {
+		if err = l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		if err = l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to write audit log", 0)
+	}
+	if err = l.file.Sync(); err != nil {
+		return errors.WrapPrefix(err, "Failed to sync audit log", 0)
+	}
+	return nil
+}
+
+func (l *auditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to open audit log", 0)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.WrapPrefix(err, "Failed to stat audit log", 0)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, overwriting the oldest one, and starts a new file.
+// Must be called with the lock held.
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	for i := l.maxFiles - 1; i >= 0; i-- {
+		err := os.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WrapPrefix(err, "Failed to rotate audit log", 0)
+		}
+	}
+	return l.open()
+}
+
+// rotatedPath returns the path of the i-th rotated file, the current file being the 0th
+func (l *auditLog) rotatedPath(i int) string {
+	if i == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%v.%v", l.path, i)
+}
+
+// query returns the matching entries, oldest first
+func (l *auditLog) query(filter auditFilter) ([]auditEntry, error) {
+	l.Lock() // Don't read while rotating
+	defer l.Unlock()
+
+	entries := []auditEntry{}
+	for i := l.maxFiles; i >= 0; i-- {
+		file, err := os.Open(l.rotatedPath(i))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to open audit log", 0)
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue // Torn write, e.g. on power loss
+			}
+			if filter.matches(&entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read audit log", 0)
+		}
+	}
+
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+// newAuditEntry starts the audit entry of the operation with the volume's current EMS objects, if the volume exists
+func (d *elastifileDriver) newAuditEntry(ctx context.Context, operation string, name string) *auditEntry {
+	entry := &auditEntry{
+		Operation: operation,
+		Volume:    name,
+		RequestId: requestIdFrom(ctx),
+	}
+	d.setAuditObjects(entry)
+	return entry
+}
+
+// setAuditObjects sets the EMS objects of the entry's volume, if it exists
+func (d *elastifileDriver) setAuditObjects(entry *auditEntry) {
+	d.RLock()
+	defer d.RUnlock()
+	v, ok := d.volumes[entry.Volume]
+	if !ok {
+		return
+	}
+	if v.DataContainer != nil {
+		entry.DataContainer = &auditObject{Id: v.DataContainer.Id, Name: v.DataContainer.Name}
+	}
+	if v.Export != nil {
+		entry.Export = &auditObject{Id: v.Export.Id, Name: v.Export.Name}
+	}
+	entry.Parent = v.Parent
+	entry.Subdir = v.Subdir
+	entry.Snapshot = v.Snapshot
+}
+
+// recordAudit completes the entry with the outcome of the operation and appends it to the audit log,
+// e.g. defer d.recordAudit(ctx, entry, &err). EMS objects not known yet, e.g. on create, are taken from the volume.
+func (d *elastifileDriver) recordAudit(ctx context.Context, entry *auditEntry, err *error) {
+	if d.audit == nil {
+		return
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.Result = auditResultSuccess
+	if err != nil && *err != nil {
+		entry.Result = auditResultError
+		entry.Error = (*err).Error()
+	}
+	if entry.DataContainer == nil {
+		d.setAuditObjects(entry)
+	}
+
+	if appendErr := d.audit.append(entry); appendErr != nil {
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"operation": entry.Operation,
+			"result":    entry.Result,
+		}).WithError(appendErr).Error("Failed to record audit entry")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-errors/errors"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// Elastifile management server - the only storage backend of the plugin. The tests add their fakes.
+const storageBackendEms = "ems"
+
+// storageBackends create the storage backends by their STORAGE_BACKEND value
+var storageBackends = map[string]func() (storageBackend, error){
+	storageBackendEms: func() (storageBackend, error) { return &Ems, nil },
+}
+
+// storageBackend manages the Data Containers and Exports backing the volumes
+type storageBackend interface {
+	CreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts,
+		policyName string) (*emanage.Export, *emanage.DataContainer, error)
+	MaybeCreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts,
+		policyName string) (*emanage.Export, *emanage.DataContainer, error)
+	DeleteDcExport(ctx context.Context, v *elastifileVolume) error
+	MaybeDeleteDcExport(ctx context.Context, v *elastifileVolume) error
+	TrashDcExport(ctx context.Context, name string, v *elastifileVolume) error
+	CreateExport(ctx context.Context, name string, opts *emanage.ExportCreateOpts) (emanage.Export, error)
+	DeleteExport(ctx context.Context, export *emanage.Export) error
+	DeleteDc(ctx context.Context, dc *emanage.DataContainer) error
+	CreateSnapshot(ctx context.Context, dc *emanage.DataContainer, name string) error
+	CloneSnapshot(ctx context.Context, dc *emanage.DataContainer, snapshot string, dcOpts *emanage.DcCreateOpts,
+		exportOpts *emanage.ExportCreateOpts) (*emanage.Export, *emanage.DataContainer, error)
+
+	adoptLegacyDcName(ctx context.Context, dcName string, legacyName string) (string, error)
+	allDcs(ctx context.Context) ([]emanage.DataContainer, error)
+	allExports(ctx context.Context) ([]emanage.Export, error)
+	dcExists(ctx context.Context, dcName string) (bool, *emanage.DataContainer, error)
+	dcExportPath(ctx context.Context, export *emanage.Export) (string, error)
+	policyByName(ctx context.Context, name string) (emanage.Policy, error)
+	policyById(ctx context.Context, id int) (emanage.Policy, error)
+	updateDc(ctx context.Context, dcId int, modify func(dc *emanage.DataContainer)) (*emanage.DataContainer, error)
+	updateDcMetadata(ctx context.Context, dcId int, key string, value string) (*emanage.DataContainer, error)
+}
+
+var _ storageBackend = &EmsWrapper{}
+
+func newStorageBackend(kind string) (storageBackend, error) {
+	if kind == "" {
+		kind = storageBackendEms
+	}
+	create, ok := storageBackends[kind]
+	if !ok {
+		return nil, errors.Errorf("Unsupported storage backend: %v", kind)
+	}
+	return create()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Plugin metadata is kept in the Data Container's description as "edvp.<key>=<value>" tokens separated by ';'.
+// Tokens that don't belong to the plugin are preserved as is.
+const (
+	dcMetaPrefix    = "edvp."
+	dcMetaSeparator = ";"
+
+	dcMetaOwner     = "owner"
+	dcMetaProtected = "protected"
+	dcMetaTrashedAt = "trashed-at" // Unix time of the volume's removal in retention mode
+	dcMetaVolume    = "volume"     // Name of the removed volume, used for restore
+	dcMetaTrashedBy = "trashed-by" // Owner ID of the plugin instance that removed the volume, whose trash it's in
+	dcMetaCreator   = "creator"    // Plugin instance that created the Data Container, see initOwnerId
+
+	// User mapping of the removed volume's export and its mount options, reapplied on restore
+	dcMetaUserMapping    = "user-mapping-type"
+	dcMetaUserMappingUid = "user-mapping-uid"
+	dcMetaUserMappingGid = "user-mapping-gid"
+	dcMetaMountOpts      = "mount-opts" // Comma separated
+)
+
+type dcMetadata struct {
+	values map[string]string
+	other  []string
+}
+
+func newDcMetadata() *dcMetadata {
+	return &dcMetadata{values: map[string]string{}}
+}
+
+func parseDcMetadata(description string) *dcMetadata {
+	meta := newDcMetadata()
+	for _, token := range strings.Split(description, dcMetaSeparator) {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		if !strings.HasPrefix(token, dcMetaPrefix) {
+			meta.other = append(meta.other, token)
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(token, dcMetaPrefix), "=", 2)
+		if len(kv) != 2 {
+			meta.other = append(meta.other, token)
+			continue
+		}
+		meta.values[kv[0]] = kv[1]
+	}
+	return meta
+}
+
+func (m *dcMetadata) Get(key string) string {
+	return m.values[key]
+}
+
+func (m *dcMetadata) Set(key string, value string) {
+	if value == "" {
+		delete(m.values, key)
+		return
+	}
+	m.values[key] = value
+}
+
+func (m *dcMetadata) Owner() string {
+	return m.Get(dcMetaOwner)
+}
+
+func (m *dcMetadata) Protected() bool {
+	return m.Get(dcMetaProtected) == "true"
+}
+
+func (m *dcMetadata) String() string {
+	var keys []string
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tokens := append([]string{}, m.other...)
+	for _, key := range keys {
+		tokens = append(tokens, dcMetaPrefix+key+"="+m.values[key])
+	}
+	return strings.Join(tokens, dcMetaSeparator)
+}
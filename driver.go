@@ -1,15 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/go-errors/errors"
@@ -26,10 +25,49 @@ type driverDetails struct {
 	StorageAddr    string
 	Root           string
 	CrudIdempotent bool
+	DcNameTemplate string
+	DcNamePrefix   string
+	SwarmID        string
+	OwnerId        string
+	InstanceId     string // Set by initOwnerId
+
+	AllowForeignDelete  bool
+	RetentionPeriod     time.Duration
+	Mounter             string
+	MountTimeout        time.Duration
+	MountRetries        int
+	UnmountStrategy     []string
+	HealthCheckInterval time.Duration
+	AutoRemount         bool
+	ProbeBeforeMount    bool
+	DefaultMountOpts    []string
+	AllowedMountOpts    []string
+	DeniedMountOpts     []string
+	MetricsAddress      string
+	AuditLog            bool
+	AuditLogMaxSize     int64
+	AuditLogMaxFiles    int
+	AdminToken          string
+	AdminAddress        string
+	AdminTlsCert        string
+	AdminTlsKey         string
+	AdminTlsClientCa    string
+	GcInterval          time.Duration
+	GcGracePeriod       time.Duration
+	StorageBackend      string
 }
 
 var driverInfo = driverDetails{
-	Root: "/mnt",
+	Root:             "/mnt",
+	MountTimeout:     20 * time.Second,
+	MountRetries:     2,
+	UnmountStrategy:  []string{unmountStepRetry},
+	DefaultMountOpts: []string{"nolock"},
+	ProbeBeforeMount: true,
+	AuditLog:         true,
+	AuditLogMaxSize:  defaultAuditMaxSize,
+	AuditLogMaxFiles: defaultAuditMaxFiles,
+	GcGracePeriod:    defaultGcGracePeriod,
 }
 
 type elastifileDriver struct {
@@ -41,76 +79,155 @@ type elastifileDriver struct {
 	storageAddr        string
 	root               string
 	crudIdempotent     bool
+	ownerId            string
+	instanceId         string
+	allowForeignDelete bool
+	retentionPeriod    time.Duration
+	backend            storageBackend
+	mounter            mounter
+	unmountStrategy    []string
+	mountOptions       *mountOptionPolicy
 	statePath          string
-	volumes            map[string]*elastifileVolume
+	volumes            map[string]*elastifileVolume // Guarded by the RWMutex
+	volumeLocks        *keyedMutex                  // Per-volume locks, see locks.go
+	trashLock          sync.Mutex
+	sharedRoot         string        // Shared mounts of sub-directory volumes, see subdir.go
+	sharedMounts       *sharedMounts // Not persisted, like the volumes' connections
+	audit              *auditLog     // Nil if the audit log is disabled
+	gcGracePeriod      time.Duration
+	gcSightings        *gcSightings
 }
 
 func newElastifileDriver(drvDetails driverDetails) (*elastifileDriver, error) {
+	backend, err := newStorageBackend(drvDetails.StorageBackend)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to initialize storage backend", 0)
+	}
+
+	m, err := newMounter(drvDetails.Mounter)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to initialize mounter", 0)
+	}
+	if drvDetails.ProbeBeforeMount {
+		m = &probingMounter{mounter: m}
+	}
+	m = newRetryMounter(m, drvDetails.MountTimeout, drvDetails.MountRetries)
+
+	return newElastifileDriverWith(drvDetails, &instrumentedBackend{backend}, &instrumentedMounter{m})
+}
+
+// newElastifileDriverWith creates the driver with the specified storage backend and mounter
+func newElastifileDriverWith(drvDetails driverDetails, backend storageBackend, m mounter) (*elastifileDriver, error) {
 	logrus.WithField("method", "new driver").Debug(drvDetails.Root)
 
+	mountOptions, err := newMountOptionPolicy(drvDetails.DefaultMountOpts, drvDetails.AllowedMountOpts,
+		drvDetails.DeniedMountOpts)
+	if err != nil {
+		return nil, err
+	}
+
 	driver := &elastifileDriver{
 		managementAddr:     drvDetails.RestAddr,
 		managementUser:     drvDetails.RestUser,
 		managementPassword: drvDetails.RestPass,
 		storageAddr:        drvDetails.StorageAddr,
 		crudIdempotent:     drvDetails.CrudIdempotent,
+		ownerId:            drvDetails.OwnerId,
+		instanceId:         drvDetails.InstanceId,
+		allowForeignDelete: drvDetails.AllowForeignDelete,
+		retentionPeriod:    drvDetails.RetentionPeriod,
+		backend:            backend,
+		mounter:            m,
+		unmountStrategy:    drvDetails.UnmountStrategy,
+		mountOptions:       mountOptions,
 		root:               filepath.Join(drvDetails.Root, "volumes"),
-		statePath:          filepath.Join(drvDetails.Root, "state", "elastifile-state.json"),
+		statePath:          filepath.Join(drvDetails.Root, "state", stateFileName),
 		volumes:            map[string]*elastifileVolume{},
+		volumeLocks:        newKeyedMutex(),
+		sharedRoot:         filepath.Join(drvDetails.Root, "shared"),
+		sharedMounts:       newSharedMounts(),
+		gcGracePeriod:      drvDetails.GcGracePeriod,
+		gcSightings:        newGcSightings(),
+	}
+	if drvDetails.AuditLog {
+		driver.audit = newAuditLog(filepath.Join(drvDetails.Root, "state", auditLogName), drvDetails.AuditLogMaxSize,
+			drvDetails.AuditLogMaxFiles)
 	}
 
-	data, err := ioutil.ReadFile(driver.statePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			logrus.WithField("statePath", driver.statePath).Debug("State not found")
-		} else {
-			err = errors.WrapPrefix(err, "Failed to load state", 0)
-			return nil, err
-		}
-	} else {
-		logrus.WithField("data", string(data)).Debug("Loaded state")
-		err := json.Unmarshal(data, &driver.volumes)
-		if err != nil {
-			return nil, errors.WrapPrefix(err, "Failed to unmarshal state", 0)
-		}
-		logrus.Debug("Umarshaled state")
+	if err = driver.loadState(); err != nil {
+		return nil, err
 	}
 
 	logrus.Debugf("%v driver created", pluginName)
 	return driver, nil
 }
 
-func (d *elastifileDriver) saveState() {
-	data, err := json.Marshal(d.volumes)
-	if err != nil {
-		logrus.WithField("statePath", d.statePath).Error(err)
-		return
+// lookupVolume returns the volume while holding the driver's read lock only
+func (d *elastifileDriver) lookupVolume(name string) (*elastifileVolume, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	v, ok := d.volumes[name]
+	return v, ok
+}
+
+// saveState persists the volumes. Must be called with the driver's write lock held.
+// On failure the volumes remain as they are in memory, and are persisted along with the next change. Requests that add
+// a volume remove it again before returning the error.
+func (d *elastifileDriver) saveState() error {
+	if err := writeStateFile(d.statePath, d.volumes); err != nil {
+		return errors.WrapPrefix(err, "Failed to save state", 0)
 	}
+	return nil
+}
 
-	if err := ioutil.WriteFile(d.statePath, data, 0644); err != nil {
-		logrus.WithField("savestate", d.statePath).Error(err)
+// dumpState returns the volumes as persisted in the state
+func (d *elastifileDriver) dumpState() (json.RawMessage, error) {
+	d.RLock()
+	defer d.RUnlock()
+	data, err := json.Marshal(d.volumes)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to marshal state", 0)
 	}
+	return data, nil
 }
 
 func (d *elastifileDriver) Create(r *volume.CreateRequest) (err error) {
-	logrus.WithField("method", "create").Debugf("%#v", r)
+	ctx := newLogContext("create", r.Name)
+	defer logRequestDone(ctx, time.Now(), &err)
+	loggerFrom(ctx).WithField("options", r.Options).Debug("Request received")
 
-	var defaultMountOpts = []string{"nolock"}
+	d.volumeLocks.Lock(r.Name)
+	defer d.volumeLocks.Unlock(r.Name)
 
-	d.Lock()
-	defer d.Unlock()
+	audit := d.newAuditEntry(ctx, auditCreate, r.Name)
+	audit.Options = r.Options
+	defer d.recordAudit(ctx, audit, &err)
 
-	v := &elastifileVolume{MountOpts: defaultMountOpts}
+	if _, ok := r.Options[optionsParent]; ok {
+		return d.createSubdirVolume(ctx, r)
+	}
+	if _, ok := r.Options[optionsSnapshotOf]; ok {
+		return d.createSnapshotVolume(ctx, r)
+	}
 
-	dcCreateOpts, exportCreateOpts := Ems.defaultDcExportCreateOpts(r.Name)
+	v := &elastifileVolume{}
+	var mountOpts []string
+
+	dcName, err := dcNameForVolume(r.Name)
+	if err != nil {
+		return errors.WrapPrefix(err, fmt.Sprintf("Failed to compose DC name for volume %v", r.Name), 0)
+	}
+
+	dcCreateOpts, exportCreateOpts := Ems.defaultDcExportCreateOpts(dcName)
+	createIdempotent := d.crudIdempotent
+	policyName := ""
 
 	for key, val := range r.Options {
 		switch key {
 		case optionsSize:
 			sizeVal, err := size.Parse(val)
 			if err != nil {
-				err = errors.WrapPrefix(err, "Failed to parse volume size", 0)
-				logErrorAndReturn(err.Error(), "key", optionsSize, "value", val)
+				return logErrorAndReturn(ctx, "Failed to parse volume size '%v': %v", val, err)
 			}
 			dcCreateOpts.HardQuota = int(sizeVal)
 		case optionsUserMappingType:
@@ -118,225 +235,420 @@ func (d *elastifileDriver) Create(r *volume.CreateRequest) (err error) {
 			case string(emanage.UserMappingAll), string(emanage.UserMappingRoot), string(emanage.UserMappingNone):
 				exportCreateOpts.UserMapping = emanage.UserMappingType(val)
 			default:
-				logErrorAndReturn("Unsupported user mapping type: %v", val)
+				return logErrorAndReturn(ctx, "Unsupported user mapping type: %v", val)
 			}
 		case optionsUserMappingUid:
 			uid, err := strconv.Atoi(val)
 			if err != nil || uid < 0 {
-				logErrorAndReturn("Unsupported UID value: %v", val)
+				return logErrorAndReturn(ctx, "Unsupported UID value: %v", val)
 			}
 			exportCreateOpts.Uid = &uid
 		case optionsUserMappingGid:
 			gid, err := strconv.Atoi(val)
 			if err != nil || gid < 0 {
-				logErrorAndReturn("Unsupported GID value: %v", val)
+				return logErrorAndReturn(ctx, "Unsupported GID value: %v", val)
 			}
 			exportCreateOpts.Gid = &gid
-		default: // These args will be passed to mount command verbatim
-			if val != "" {
-				v.MountOpts = append(v.MountOpts, key+"="+val)
-			} else {
-				v.MountOpts = append(v.MountOpts, key)
+		case optionsForce:
+			force, err := strconv.ParseBool(val)
+			if err != nil {
+				return logErrorAndReturn(ctx, "Unsupported %v value: %v", optionsForce, val)
+			}
+			v.ForceDelete = force
+		case optionsProtect:
+			protect, err := strconv.ParseBool(val)
+			if err != nil {
+				return logErrorAndReturn(ctx, "Unsupported %v value: %v", optionsProtect, val)
+			}
+			v.Protected = protect
+		case optionsPolicy:
+			policyName = val
+		case optionsIfNotExists:
+			createIdempotent, err = strconv.ParseBool(val)
+			if err != nil {
+				return logErrorAndReturn(ctx, "Unsupported %v value: %v", optionsIfNotExists, val)
 			}
+		case optionsRemoveIfExists:
+			removeIdempotent, err := strconv.ParseBool(val)
+			if err != nil {
+				return logErrorAndReturn(ctx, "Unsupported %v value: %v", optionsRemoveIfExists, val)
+			}
+			v.RemoveIfExists = &removeIdempotent
+		default: // Mount options, subject to the plugin's mount option policy
+			mountOpts = append(mountOpts, mountOption(key, val))
 		}
 	}
 
+	if v.MountOpts, err = d.mountOptions.apply(mountOpts); err != nil {
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+
+	if v.Protected {
+		meta := parseDcMetadata(dcCreateOpts.Description)
+		meta.Set(dcMetaProtected, "true")
+		dcCreateOpts.Description = meta.String()
+	}
+
 	if dcCreateOpts.HardQuota == 0 {
 		dcCreateOpts.HardQuota = int(defaultVolumeSize)
-		logrus.WithField("size", dcCreateOpts.HardQuota).Info("Using default volume size")
+		loggerFrom(ctx).WithField("size", dcCreateOpts.HardQuota).Info("Using default volume size")
 	}
 	dcCreateOpts.SoftQuota = dcCreateOpts.HardQuota // Setting hard quota w/o soft quota fails
 
-	logrus.WithField("name", r.Name).Debug("Creating Data Container and Export")
+	// Only a volume backed by its own Data Container can be created again, and its entry is kept along with its mounts
+	known, ok := d.lookupVolume(r.Name)
+	if ok && (!createIdempotent || known.Parent != "") {
+		return logErrorAndReturn(ctx, "volume %s already exists", r.Name)
+	}
+
+	createFunc := d.backend.CreateDcExport // Handle idempotence settings
+	if createIdempotent {
+		createFunc = d.backend.MaybeCreateDcExport
 
-	createFunc := Ems.CreateDcExport // Handle idempotence settings
-	if d.crudIdempotent {
-		createFunc = Ems.MaybeCreateDcExport
+		dcName, err = d.backend.adoptLegacyDcName(ctx, dcName, legacyDcNameForVolume(r.Name))
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to look up legacy Data Container", 0)
+		}
+		dcCreateOpts.Name = dcName
+
+		exists, existingDc, err := d.backend.dcExists(ctx, dcName)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to check if Data Container exists", 0)
+		}
+		if exists {
+			err = d.verifyExistingDc(ctx, r.Name, r.Options, dcCreateOpts, policyName, existingDc)
+			if err != nil {
+				return logErrorAndReturn(ctx, "%v", err)
+			}
+		}
+		if known != nil {
+			loggerFrom(ctx).Info("Volume already exists")
+			return nil
+		}
 	}
 
-	exp, dc, err := createFunc(dcCreateOpts, exportCreateOpts)
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dcName,
+		"idempotent":   createIdempotent,
+	}).Debug("Creating Data Container and Export")
+
+	exp, dc, err := createFunc(ctx, dcCreateOpts, exportCreateOpts, policyName)
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to create Data Container / Export", 0)
 		return err
 	}
 
+	if createIdempotent {
+		err = verifyExistingExport(r.Name, r.Options, exportCreateOpts, exp)
+		if err != nil {
+			return logErrorAndReturn(ctx, "%v", err)
+		}
+	}
+
 	v.Mountpoint = filepath.Join(d.root, r.Name)
-	v.DataContainer = dc
 	v.Export = exp
 
-	d.volumes[r.Name] = v
+	dcMeta := parseDcMetadata(dc.Description)
+	if v.Protected && !dcMeta.Protected() { // Data Container was created elsewhere
+		dc, err = d.backend.updateDcMetadata(ctx, dc.Id, dcMetaProtected, "true")
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to protect Data Container", 0)
+		}
+	}
+	v.Protected = v.Protected || dcMeta.Protected()
 
-	logrus.Debug("Saving state")
-	d.saveState()
+	v.DataContainer = dc
+	v.Owner = dcMeta.Owner()
+	v.Adopted = v.Owner != d.ownerId
+	if v.Adopted {
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			logFieldDcName: dc.Name,
+			"owner":        v.Owner,
+		}).Warn("Using Data Container that was not created by this plugin instance")
+	}
 
+	d.Lock()
+	defer d.Unlock()
+	v.CreatedAt = time.Now().UTC()
+	d.volumes[r.Name] = v
+
+	loggerFrom(ctx).Debug("Saving state")
+	if err := d.saveState(); err != nil {
+		delete(d.volumes, r.Name)
+		return logErrorAndReturn(ctx, "%v", err)
+	}
 	return nil
 }
 
-func (d *elastifileDriver) Remove(r *volume.RemoveRequest) error {
-	logrus.WithField("method", "remove").Debugf("%#v", r)
+func (d *elastifileDriver) Remove(r *volume.RemoveRequest) (err error) {
+	ctx := newLogContext("remove", r.Name)
+	defer logRequestDone(ctx, time.Now(), &err)
+	loggerFrom(ctx).Debug("Request received")
 
-	d.Lock()
-	defer d.Unlock()
+	d.volumeLocks.Lock(r.Name)
+	defer d.volumeLocks.Unlock(r.Name)
+	defer d.recordAudit(ctx, d.newAuditEntry(ctx, auditRemove, r.Name), &err)
 
-	v, ok := d.volumes[r.Name]
+	v, ok := d.lookupVolume(r.Name)
 	if !ok {
-		return logErrorAndReturn("volume %s not found", r.Name)
+		return logErrorAndReturn(ctx, "volume %s not found", r.Name)
 	}
 
 	if v.connections != 0 {
-		return logErrorAndReturn("volume %s is currently used by a container", r.Name)
+		return logErrorAndReturn(ctx, "volume %s is currently used by a container", r.Name)
+	}
+
+	if v.Orphaned != nil { // Removing the mount point's contents would remove the volume's data
+		if err := d.releaseOrphanedMount(ctx, r.Name, v, d.unmountStrategy); err != nil {
+			return logErrorAndReturn(ctx, "volume %s has an orphaned mount that couldn't be unmounted: %v", r.Name, err)
+		}
+	}
+
+	if v.Parent != "" {
+		if err := checkNotProtected(r.Name, v, nil); err != nil { // The Data Container's protection is the parent's
+			return logErrorAndReturn(ctx, "%v", err)
+		}
+		if v.Snapshot == "" { // Snapshot volumes have nothing to delete on ECFS
+			if err := d.removeSubdirVolume(ctx, r.Name, v); err != nil {
+				return logErrorAndReturn(ctx, "%v", err)
+			}
+		}
+		if err := os.RemoveAll(v.Mountpoint); err != nil {
+			return logErrorAndReturn(ctx, "%v", err)
+		}
+		d.Lock()
+		defer d.Unlock()
+		delete(d.volumes, r.Name)
+		if err := d.saveState(); err != nil {
+			return logErrorAndReturn(ctx, "%v", err)
+		}
+		return nil
 	}
+
+	if err := d.checkNoChildren(r.Name); err != nil {
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+
+	exists, dc, err := d.backend.dcExists(ctx, v.DataContainer.Name)
+	if err != nil {
+		return logErrorAndReturn(ctx, "Failed to get Data Container of volume %s: %v", r.Name, err)
+	}
+	if !exists {
+		dc = nil
+	}
+
+	if err := checkNotProtected(r.Name, v, dc); err != nil {
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+
+	if err := d.checkDeleteAllowed(r.Name, v, dc); err != nil {
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+
 	if err := os.RemoveAll(v.Mountpoint); err != nil {
-		return logErrorAndReturn(err.Error())
+		return logErrorAndReturn(ctx, "%v", err)
 	}
 
-	// Remove Data Container / export
-	deleteFunc := Ems.DeleteDcExport // Handle idempotence settings
-	if d.crudIdempotent {
-		deleteFunc = Ems.MaybeDeleteDcExport
+	if d.retentionPeriod > 0 {
+		// Move Data Container to trash
+		if dc != nil {
+			if err := d.backend.TrashDcExport(ctx, r.Name, v); err != nil {
+				return logErrorAndReturn(ctx, "Failed to move volume %s to trash: %v", r.Name, err)
+			}
+		} else if !d.removeIdempotent(v) {
+			return logErrorAndReturn(ctx, "Data Container %s of volume %s not found", v.DataContainer.Name, r.Name)
+		}
+	} else {
+		// Remove Data Container / export
+		deleteFunc := d.backend.DeleteDcExport // Handle idempotence settings
+		if d.removeIdempotent(v) {
+			deleteFunc = d.backend.MaybeDeleteDcExport
+		}
+		if err := deleteFunc(ctx, v); err != nil {
+			return logErrorAndReturn(ctx, "Failed to delete Data Container / Export of volume %s: %v", r.Name, err)
+		}
 	}
-	deleteFunc(v)
 
+	d.Lock()
+	defer d.Unlock()
 	delete(d.volumes, r.Name)
-	d.saveState()
+	if err := d.saveState(); err != nil {
+		return logErrorAndReturn(ctx, "%v", err)
+	}
 	return nil
 }
 
-func (d *elastifileDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
-	logrus.WithField("method", "path").Debugf("%#v", r)
+func (d *elastifileDriver) Path(r *volume.PathRequest) (res *volume.PathResponse, err error) {
+	ctx := newLogContext("path", r.Name)
+	defer logRequestDone(ctx, time.Now(), &err)
+	loggerFrom(ctx).Debug("Request received")
 
 	d.RLock()
 	defer d.RUnlock()
 
 	v, ok := d.volumes[r.Name]
 	if !ok {
-		return &volume.PathResponse{}, logErrorAndReturn("volume %s not found", r.Name)
+		return &volume.PathResponse{}, logErrorAndReturn(ctx, "volume %s not found", r.Name)
 	}
 
 	return &volume.PathResponse{Mountpoint: v.Mountpoint}, nil
 }
 
-func (d *elastifileDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
-	logrus.WithField("method", "mount").Debugf("%#v", r)
+func (d *elastifileDriver) Mount(r *volume.MountRequest) (res *volume.MountResponse, err error) {
+	ctx := withLogFields(newLogContext("mount", r.Name), logrus.Fields{"mount_id": r.ID})
+	defer logRequestDone(ctx, time.Now(), &err)
+	loggerFrom(ctx).Debug("Request received")
 
-	d.Lock()
-	defer d.Unlock()
+	d.volumeLocks.Lock(r.Name)
+	defer d.volumeLocks.Unlock(r.Name)
 
-	v, ok := d.volumes[r.Name]
+	audit := d.newAuditEntry(ctx, auditMount, r.Name)
+	audit.CallerId = r.ID
+	defer d.recordAudit(ctx, audit, &err)
+
+	v, ok := d.lookupVolume(r.Name)
 	if !ok {
-		return &volume.MountResponse{}, logErrorAndReturn("volume %s not found", r.Name)
+		return &volume.MountResponse{}, logErrorAndReturn(ctx, "volume %s not found", r.Name)
 	}
 
-	if v.connections == 0 {
+	if v.connections == 0 && !d.reuseOrphanedMount(ctx, r.Name, v) {
 		fi, err := os.Lstat(v.Mountpoint)
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(v.Mountpoint, 0755); err != nil {
-				return &volume.MountResponse{}, logErrorAndReturn(err.Error())
+				return &volume.MountResponse{}, logErrorAndReturn(ctx, "%v", err)
 			}
 		} else if err != nil {
-			return &volume.MountResponse{}, logErrorAndReturn(err.Error())
+			return &volume.MountResponse{}, logErrorAndReturn(ctx, "%v", err)
 		}
 
 		if fi != nil && !fi.IsDir() {
-			return &volume.MountResponse{}, logErrorAndReturn("%v already exist and it's not a directory", v.Mountpoint)
+			return &volume.MountResponse{}, logErrorAndReturn(ctx, "%v already exist and it's not a directory", v.Mountpoint)
 		}
 
-		if err := d.mountVolume(v); err != nil {
-			return &volume.MountResponse{}, logErrorAndReturn(err.Error())
+		if err := d.mountVolume(ctx, v); err != nil {
+			return &volume.MountResponse{}, logErrorAndReturn(ctx, "%v", err)
 		}
+		d.Lock()
+		v.health = nil
+		v.detached = false
+		d.Unlock()
 	}
 
 	v.connections++
+	d.Lock()
+	v.addMountId(r.ID)
+	d.Unlock()
 
 	return &volume.MountResponse{Mountpoint: v.Mountpoint}, nil
 }
 
-func (d *elastifileDriver) Unmount(r *volume.UnmountRequest) error {
-	logrus.WithField("method", "unmount").Debugf("%#v", r)
+func (d *elastifileDriver) Unmount(r *volume.UnmountRequest) (err error) {
+	ctx := withLogFields(newLogContext("unmount", r.Name), logrus.Fields{"mount_id": r.ID})
+	defer logRequestDone(ctx, time.Now(), &err)
+	loggerFrom(ctx).Debug("Request received")
 
-	d.Lock()
-	defer d.Unlock()
-	v, ok := d.volumes[r.Name]
+	d.volumeLocks.Lock(r.Name)
+	defer d.volumeLocks.Unlock(r.Name)
+
+	audit := d.newAuditEntry(ctx, auditUnmount, r.Name)
+	audit.CallerId = r.ID
+	defer d.recordAudit(ctx, audit, &err)
+
+	v, ok := d.lookupVolume(r.Name)
 	if !ok {
-		return logErrorAndReturn("volume %s not found", r.Name)
+		return logErrorAndReturn(ctx, "volume %s not found", r.Name)
 	}
 
 	v.connections--
+	d.Lock()
+	v.removeMountId(r.ID)
+	d.Unlock()
 
 	if v.connections <= 0 {
-		if err := d.unmountVolume(v.Mountpoint); err != nil {
-			return logErrorAndReturn(err.Error())
+		if v.detached {
+			loggerFrom(ctx).WithField("mountpoint", v.Mountpoint).Info("Mount already detached by the health monitor")
+		} else if err := d.unmountVolume(ctx, v.Mountpoint, d.unmountStrategy); err != nil {
+			v.connections = 0
+			d.trackOrphanedMount(ctx, r.Name, v, err)
+			return logErrorAndReturn(ctx, "%v - tracked as an orphaned mount for later cleanup", err)
+		}
+		if v.Parent != "" {
+			d.releaseSharedMount(ctx, v)
 		}
 		v.connections = 0
+		d.Lock()
+		v.mountIds = nil
+		v.health = nil
+		v.detached = false
+		d.Unlock()
 	}
 
 	return nil
 }
 
-func (d *elastifileDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
-	logrus.WithField("method", "get").Debugf("%#v", r)
-
-	d.Lock()
-	defer d.Unlock()
+func (d *elastifileDriver) Get(r *volume.GetRequest) (res *volume.GetResponse, err error) {
+	ctx := newLogContext("get", r.Name)
+	defer logRequestDone(ctx, time.Now(), &err)
+	loggerFrom(ctx).Debug("Request received")
 
-	v, ok := d.volumes[r.Name]
+	v, ok := d.lookupVolume(r.Name)
 	if !ok {
-		return &volume.GetResponse{}, logErrorAndReturn("volume %s not found", r.Name)
+		return &volume.GetResponse{}, logErrorAndReturn(ctx, "volume %s not found", r.Name)
 	}
 
-	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: v.Mountpoint}}, nil
+	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: v.Mountpoint,
+		Status: d.fullStatus(ctx, v)}}, nil
 }
 
-func (d *elastifileDriver) List() (*volume.ListResponse, error) {
-	logrus.WithField("method", "list").Debugf("")
+func (d *elastifileDriver) List() (res *volume.ListResponse, err error) {
+	ctx := newLogContext("list", "")
+	defer logRequestDone(ctx, time.Now(), &err)
+	loggerFrom(ctx).Debug("Request received")
 
-	d.Lock()
-	defer d.Unlock()
+	d.RLock()
+	defer d.RUnlock()
 
 	var vols []*volume.Volume
 	for name, v := range d.volumes {
-		vols = append(vols, &volume.Volume{Name: name, Mountpoint: v.Mountpoint})
+		vols = append(vols, &volume.Volume{Name: name, Mountpoint: v.Mountpoint, Status: d.localStatus(v)})
 	}
 	return &volume.ListResponse{Volumes: vols}, nil
 }
 
 func (d *elastifileDriver) Capabilities() *volume.CapabilitiesResponse {
-	logrus.WithField("method", "capabilities").Debugf("")
+	ctx := newLogContext("capabilities", "")
+	defer logRequestDone(ctx, time.Now(), nil)
+	loggerFrom(ctx).Debug("Request received")
 
 	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "global"}}
 }
 
-func (d *elastifileDriver) mountVolume(v *elastifileVolume) error {
-	exportPath, err := v.ExportPath()
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to get full export path", 0)
+func (d *elastifileDriver) mountVolume(ctx context.Context, v *elastifileVolume) error {
+	if v.Parent != "" {
+		if err := d.mountSubdirVolume(ctx, v); err != nil {
+			return logErrorAndReturn(ctx, "%v", err)
+		}
+		return nil
 	}
 
-	logrus.Infof("Mounting volume %s on %s", exportPath, v.Mountpoint)
-
-	var mountArgs []string
-	if len(v.MountOpts) > 0 {
-		mountArgs = append(mountArgs, "-o", strings.Join(v.MountOpts, ","))
+	source, err := d.exportSource(ctx, v)
+	if err != nil {
+		return err
 	}
-	mountArgs = append(mountArgs, fmt.Sprintf("%v:%v", d.storageAddr, exportPath), v.Mountpoint)
 
-	cmd := exec.Command("mount", mountArgs...)
-	logrus.Debugf("Executing: %s", cmd.Args)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return logErrorAndReturn("mount command failed: %v (%s)", err, output)
+	loggerFrom(ctx).Infof("Mounting volume %s on %s", source, v.Mountpoint)
+
+	if err = d.mounter.Mount(ctx, source, v.Mountpoint, v.MountOpts); err != nil {
+		return logErrorAndReturn(ctx, "Failed to mount %v on %v: %v", source, v.Mountpoint, err)
 	}
-	logrus.Debug("Mounted", output)
 	return nil
 }
 
-func (d *elastifileDriver) unmountVolume(target string) error {
-	logrus.Infof("Unmounting %s", target)
-	cmd := exec.Command("umount", target)
-	logrus.Debugf("Executing: %s", cmd.Args)
-	output, err := cmd.CombinedOutput()
+// exportSource returns the NFS source of the volume's export, i.e. <storage address>:<export path>
+func (d *elastifileDriver) exportSource(ctx context.Context, v *elastifileVolume) (string, error) {
+	exportPath, err := d.backend.dcExportPath(ctx, v.Export)
 	if err != nil {
-		return logErrorAndReturn("umount command failed: %v (%s)", err, output)
+		return "", errors.WrapPrefix(err, "Failed to get full export path", 0)
 	}
-	return err
+	return fmt.Sprintf("%v:%v", d.storageAddr, exportPath), nil
 }
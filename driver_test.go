@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/go-errors/errors"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// testDriver is a driver with fake storage backend and mounter, rooted in a temporary directory
+type testDriver struct {
+	*elastifileDriver
+	backend *fakeBackend
+	mounter *fakeMounter
+	root    string
+}
+
+func newTestDriver(t *testing.T, crudIdempotent bool) *testDriver {
+	root, err := ioutil.TempDir("", "edvp-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(root, "state"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return reloadTestDriver(t, &testDriver{root: root, backend: newFakeBackend()}, crudIdempotent)
+}
+
+// reloadTestDriver creates a driver with the state and the backend of the test driver, as if the plugin restarted
+func reloadTestDriver(t *testing.T, td *testDriver, crudIdempotent bool) *testDriver {
+	details := driverDetails{
+		Root:           td.root,
+		CrudIdempotent: crudIdempotent,
+	}
+	m := newFakeMounter()
+	d, err := newElastifileDriverWith(details, td.backend, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDriver{elastifileDriver: d, backend: td.backend, mounter: m, root: td.root}
+}
+
+func (td *testDriver) cleanup() {
+	os.RemoveAll(td.root)
+}
+
+func (td *testDriver) mounted(name string) bool {
+	td.mounter.Lock()
+	defer td.mounter.Unlock()
+	_, ok := td.mounter.mounts[filepath.Join(td.root, "volumes", name)]
+	return ok
+}
+
+func (td *testDriver) connections(name string) int {
+	v, ok := td.lookupVolume(name)
+	if !ok {
+		return -1
+	}
+	return v.connections
+}
+
+func expectError(t *testing.T, err error, substr string) {
+	switch {
+	case substr == "" && err != nil:
+		t.Errorf("unexpected error: %v", err)
+	case substr != "" && err == nil:
+		t.Errorf("expected error containing '%v', got success", substr)
+	case substr != "" && !strings.Contains(err.Error(), substr):
+		t.Errorf("expected error containing '%v', got: %v", substr, err)
+	}
+}
+
+func TestMountRefCounting(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+	if err := td.Create(&volume.CreateRequest{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		op          string
+		id          string
+		connections int
+		mounted     bool
+	}{
+		{"mount", "m1", 1, true},
+		{"mount", "m2", 2, true},
+		{"mount", "m2", 3, true}, // Same container mounting the volume twice
+		{"unmount", "m1", 2, true},
+		{"unmount", "m2", 1, true},
+		{"unmount", "m2", 0, false},
+		{"mount", "m3", 1, true},
+		{"unmount", "m3", 0, false},
+	}
+	for i, step := range steps {
+		var err error
+		if step.op == "mount" {
+			_, err = td.Mount(&volume.MountRequest{Name: "vol1", ID: step.id})
+		} else {
+			err = td.Unmount(&volume.UnmountRequest{Name: "vol1", ID: step.id})
+		}
+		if err != nil {
+			t.Fatalf("step %v: %v %v: %v", i, step.op, step.id, err)
+		}
+		if connections := td.connections("vol1"); connections != step.connections {
+			t.Errorf("step %v: %v %v: %v connections, expected %v", i, step.op, step.id, connections, step.connections)
+		}
+		if mounted := td.mounted("vol1"); mounted != step.mounted {
+			t.Errorf("step %v: %v %v: mounted %v, expected %v", i, step.op, step.id, mounted, step.mounted)
+		}
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	tests := []struct {
+		name           string
+		crudIdempotent bool
+		dcExists       bool // The volume's Data Container exists before create
+		dcDeleted      bool // The volume's Data Container is deleted before remove
+		options        map[string]string
+		createErr      string
+		removeErr      string
+	}{
+		{name: "strict", crudIdempotent: false},
+		{name: "strict create of existing DC", crudIdempotent: false, dcExists: true, createErr: "already exists"},
+		{name: "strict remove of deleted DC", crudIdempotent: false, dcDeleted: true, removeErr: "not found"},
+		{name: "idempotent", crudIdempotent: true},
+		{name: "idempotent create of existing DC", crudIdempotent: true, dcExists: true},
+		{name: "idempotent create of existing DC with conflicting size", crudIdempotent: true, dcExists: true,
+			options: map[string]string{optionsSize: "2GiB"}, createErr: "conflicts"},
+		{name: "idempotent remove of deleted DC", crudIdempotent: true, dcDeleted: true},
+		{name: "per-volume idempotent create", crudIdempotent: false, dcExists: true,
+			options: map[string]string{optionsIfNotExists: "true"}},
+		{name: "per-volume idempotent remove", crudIdempotent: false, dcDeleted: true,
+			options: map[string]string{optionsRemoveIfExists: "true"}},
+		{name: "per-volume strict remove", crudIdempotent: true, dcDeleted: true,
+			options: map[string]string{optionsRemoveIfExists: "false"}, removeErr: "not found"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			td := newTestDriver(t, test.crudIdempotent)
+			defer td.cleanup()
+
+			if test.dcExists {
+				dcOpts, exportOpts := Ems.defaultDcExportCreateOpts("vol1")
+				dcOpts.HardQuota = int(defaultVolumeSize)
+				if _, _, err := td.backend.CreateDcExport(context.Background(), dcOpts, exportOpts, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := td.Create(&volume.CreateRequest{Name: "vol1", Options: test.options})
+			expectError(t, err, test.createErr)
+			if err != nil {
+				if _, ok := td.lookupVolume("vol1"); ok {
+					t.Error("volume created despite the error")
+				}
+				return
+			}
+
+			if test.dcDeleted {
+				v, _ := td.lookupVolume("vol1")
+				if err = td.backend.DeleteDcExport(context.Background(), v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = td.Remove(&volume.RemoveRequest{Name: "vol1"})
+			expectError(t, err, test.removeErr)
+			if _, ok := td.lookupVolume("vol1"); ok != (err != nil) {
+				t.Errorf("volume exists: %v after remove returned %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestErrorPaths(t *testing.T) {
+	injected := errors.New("injected failure")
+	tests := []struct {
+		name           string
+		crudIdempotent bool
+		backendOp      string // Backend operation to fail
+		mounterOp      string // Mounter operation to fail
+		expectedErr    string
+		exists         bool // The volume exists after the failed operation
+	}{
+		{name: "create fails on EMS", backendOp: "CreateDcExport", expectedErr: "injected failure"},
+		{name: "idempotent create fails on EMS", crudIdempotent: true, backendOp: "dcExists",
+			expectedErr: "injected failure"},
+		{name: "mount fails", mounterOp: "Mount", expectedErr: "Failed to mount", exists: true},
+		{name: "unmount fails", mounterOp: "Unmount", expectedErr: "orphaned mount", exists: true},
+		{name: "remove fails on EMS", backendOp: "DeleteDcExport", expectedErr: "Failed to delete", exists: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			td := newTestDriver(t, test.crudIdempotent)
+			defer td.cleanup()
+
+			// Create, mount, unmount and remove the volume, stopping at the operation that fails
+			var err error
+			ops := []func() error{
+				func() error { return td.Create(&volume.CreateRequest{Name: "vol1"}) },
+				func() error {
+					_, err := td.Mount(&volume.MountRequest{Name: "vol1", ID: "m1"})
+					return err
+				},
+				func() error { return td.Unmount(&volume.UnmountRequest{Name: "vol1", ID: "m1"}) },
+				func() error { return td.Remove(&volume.RemoveRequest{Name: "vol1"}) },
+			}
+			if test.backendOp != "" {
+				td.backend.failOn[test.backendOp] = injected
+			}
+			if test.mounterOp != "" {
+				td.mounter.failOn[test.mounterOp] = injected
+			}
+			for _, op := range ops {
+				if err = op(); err != nil {
+					break
+				}
+			}
+			expectError(t, err, test.expectedErr)
+
+			if _, ok := td.lookupVolume("vol1"); ok != test.exists {
+				t.Errorf("volume exists: %v, expected %v", ok, test.exists)
+			}
+			if test.mounterOp == "Mount" && td.connections("vol1") != 0 {
+				t.Errorf("failed mount is counted: %v connections", td.connections("vol1"))
+			}
+			if test.mounterOp == "Unmount" {
+				if v, _ := td.lookupVolume("vol1"); v.Orphaned == nil {
+					t.Error("mount not tracked as orphaned")
+				}
+			}
+		})
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+
+	volumes := map[string]map[string]string{
+		"vol1": nil,
+		"vol2": {optionsSize: "2GiB", optionsProtect: "true"},
+		"vol3": {"vers": "4.1"},
+	}
+	for name, options := range volumes {
+		if err := td.Create(&volume.CreateRequest{Name: name, Options: options}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := td.Remove(&volume.RemoveRequest{Name: "vol3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		corrupt   bool // The state file is corrupted before the restart
+		protected bool
+		quota     int
+	}{
+		{name: "vol1", quota: int(defaultVolumeSize)},
+		{name: "vol2", protected: true, quota: 2 << 30},
+		{name: "vol1", corrupt: true, quota: int(defaultVolumeSize)},
+	}
+	for _, test := range tests {
+		if test.corrupt {
+			if err := ioutil.WriteFile(td.statePath, []byte("{"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		restarted := reloadTestDriver(t, td, false)
+		v, ok := restarted.lookupVolume(test.name)
+		if !ok {
+			t.Errorf("%v (corrupt state %v): not found after restart", test.name, test.corrupt)
+			continue
+		}
+		if v.Protected != test.protected || v.DataContainer.HardQuota != test.quota {
+			t.Errorf("%v (corrupt state %v): protected %v, quota %v, expected %v, %v", test.name, test.corrupt,
+				v.Protected, v.DataContainer.HardQuota, test.protected, test.quota)
+		}
+		if _, ok = restarted.lookupVolume("vol3"); ok && !test.corrupt { // The backup predates the remove
+			t.Errorf("removed volume found after restart")
+		}
+	}
+}
+
+func TestStateSaveFailure(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+	if err := td.Create(&volume.CreateRequest{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state can't be written once the state directory is replaced with a file
+	stateDir := filepath.Dir(td.statePath)
+	if err := os.RemoveAll(stateDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stateDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The requests fail, and the added volume is rolled back
+	expectError(t, td.Create(&volume.CreateRequest{Name: "vol2"}), "Failed to save state")
+	if _, ok := td.lookupVolume("vol2"); ok {
+		t.Error("volume found after failed create")
+	}
+	expectError(t, td.Remove(&volume.RemoveRequest{Name: "vol1"}), "Failed to save state")
+	if _, ok := td.lookupVolume("vol1"); ok {
+		t.Error("volume found after its Data Container was deleted")
+	}
+
+	// The removal is persisted along with the next change
+	if err := os.Remove(stateDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Create(&volume.CreateRequest{Name: "vol3"}); err != nil {
+		t.Fatal(err)
+	}
+	restarted := reloadTestDriver(t, td, false)
+	for name, exists := range map[string]bool{"vol1": false, "vol2": false, "vol3": true} {
+		if _, ok := restarted.lookupVolume(name); ok != exists {
+			t.Errorf("%v exists after restart: %v, expected %v", name, ok, exists)
+		}
+	}
+}
+
+func TestCreateExistingVolume(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+	if err := td.Create(&volume.CreateRequest{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Create(&volume.CreateRequest{Name: "sub1", Options: map[string]string{optionsParent: "vol1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := td.Mount(&volume.MountRequest{Name: "vol1", ID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sub-directory volume isn't replaced by a Data Container of its own, not even by an idempotent create
+	for _, options := range []map[string]string{nil, {optionsIfNotExists: "true"}} {
+		expectError(t, td.Create(&volume.CreateRequest{Name: "sub1", Options: options}), "already exists")
+	}
+	if v, _ := td.lookupVolume("sub1"); v.Parent != "vol1" {
+		t.Errorf("parent of sub-directory volume: '%v'", v.Parent)
+	}
+	td.backend.Lock()
+	if len(td.backend.dcs) != 1 {
+		t.Errorf("Data Containers: %v, expected only the one of vol1", len(td.backend.dcs))
+	}
+	td.backend.Unlock()
+
+	// An idempotent create keeps the mounts of the existing volume
+	expectError(t, td.Create(&volume.CreateRequest{Name: "vol1"}), "already exists")
+	if err := td.Create(&volume.CreateRequest{Name: "vol1", Options: map[string]string{optionsIfNotExists: "true"}}); err != nil {
+		t.Fatal(err)
+	}
+	if td.connections("vol1") != 1 {
+		t.Errorf("connections after create: %v", td.connections("vol1"))
+	}
+}
+
+func TestRestoreSnapshotKeepsUserMapping(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+	ctx := context.Background()
+	err := td.Create(&volume.CreateRequest{Name: "vol1", Options: map[string]string{
+		optionsUserMappingType: string(emanage.UserMappingRoot),
+		optionsUserMappingUid:  "1000",
+		optionsUserMappingGid:  "2000",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := td.lookupVolume("vol1")
+	if err = td.backend.CreateSnapshot(ctx, v.DataContainer, "snap1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = td.cloneVolume(ctx, "clone1", "vol1", "snap1"); err != nil {
+		t.Fatal(err)
+	}
+	err = td.Create(&volume.CreateRequest{Name: "snapvol1", Options: map[string]string{
+		optionsSnapshotOf: "vol1",
+		optionsSnapshot:   "snap1",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = td.restoreSnapshot(ctx, "vol1", "snap1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"vol1", "clone1", "snapvol1"} {
+		v, _ := td.lookupVolume(name)
+		td.backend.Lock()
+		export := td.backend.exports[v.Export.Id]
+		td.backend.Unlock()
+		if export.UserMapping != emanage.UserMappingRoot || export.Uid != 1000 || export.Gid != 2000 {
+			t.Errorf("user mapping of %v: %v %v:%v", name, export.UserMapping, export.Uid, export.Gid)
+		}
+	}
+}
+
+func TestTrashRestoreKeepsExportAndMountOptions(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+	td.retentionPeriod = time.Hour
+	ctx := context.Background()
+	err := td.Create(&volume.CreateRequest{Name: "vol1", Options: map[string]string{
+		optionsUserMappingType: string(emanage.UserMappingRoot),
+		optionsUserMappingUid:  "1000",
+		optionsUserMappingGid:  "2000",
+		"timeo":                "100",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := td.lookupVolume("vol1")
+	mountOpts := strings.Join(v.MountOpts, ",")
+	if err = td.Remove(&volume.RemoveRequest{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := td.listTrash(ctx)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("trash entries: %v, %v", entries, err)
+	}
+	if err = td.restoreFromTrash(ctx, entries[0].DcName, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ = td.lookupVolume("vol1")
+	if strings.Join(v.MountOpts, ",") != mountOpts {
+		t.Errorf("mount options after restore: %v, expected %v", v.MountOpts, mountOpts)
+	}
+	td.backend.Lock()
+	export := td.backend.exports[v.Export.Id]
+	meta := parseDcMetadata(td.backend.dcs[v.DataContainer.Id].Description)
+	td.backend.Unlock()
+	if export.UserMapping != emanage.UserMappingRoot || export.Uid != 1000 || export.Gid != 2000 {
+		t.Errorf("user mapping after restore: %v %v:%v", export.UserMapping, export.Uid, export.Gid)
+	}
+	if meta.Get(dcMetaMountOpts) != "" || meta.Get(dcMetaTrashedAt) != "" {
+		t.Errorf("trash metadata left after restore: %v", meta)
+	}
+}
+
+func TestTrashListsAdoptedVolumes(t *testing.T) {
+	td := newTestDriver(t, true)
+	defer td.cleanup()
+	td.retentionPeriod = time.Hour
+	td.allowForeignDelete = true
+	ctx := context.Background()
+	defer func(ownerId string) { driverInfo.OwnerId = ownerId }(driverInfo.OwnerId)
+	driverInfo.OwnerId = "this-host" // Tags the Data Containers the backend trashes
+	td.ownerId = driverInfo.OwnerId
+
+	dcOpts, exportOpts := Ems.defaultDcExportCreateOpts("vol1")
+	dcOpts.HardQuota = int(defaultVolumeSize)
+	meta := parseDcMetadata(dcOpts.Description)
+	meta.Set(dcMetaOwner, "other-host")
+	dcOpts.Description = meta.String()
+	if _, _, err := td.backend.CreateDcExport(ctx, dcOpts, exportOpts, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := td.Create(&volume.CreateRequest{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := td.lookupVolume("vol1"); !v.Adopted {
+		t.Fatal("volume not adopted")
+	}
+	if err := td.Remove(&volume.RemoveRequest{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := td.listTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Volume != "vol1" {
+		t.Errorf("trash entries: %v", entries)
+	}
+}
+
+func TestReconcileReplacedDc(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+	ctx := context.Background()
+	if err := td.Create(&volume.CreateRequest{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Data Container is deleted and another one is created with its name
+	v, _ := td.lookupVolume("vol1")
+	id := v.DataContainer.Id
+	if err := td.backend.DeleteDcExport(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+	dcOpts, exportOpts := Ems.defaultDcExportCreateOpts(v.DataContainer.Name)
+	if _, _, err := td.backend.CreateDcExport(ctx, dcOpts, exportOpts, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	findings, err := td.reconcile(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Issue != reconcileDcReplaced || findings[0].Fixed {
+		t.Errorf("unexpected findings: %+v", findings)
+	}
+	if v, _ = td.lookupVolume("vol1"); v.DataContainer.Id != id {
+		t.Errorf("volume rebound to Data Container %v", v.DataContainer.Id)
+	}
+}
+
+func TestStatusWithoutDc(t *testing.T) {
+	td := newTestDriver(t, false)
+	defer td.cleanup()
+	td.volumes["vol1"] = &elastifileVolume{Mountpoint: filepath.Join(td.root, "volumes", "vol1")}
+
+	res, err := td.Get(&volume.GetRequest{Name: "vol1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Volume.Status["StatusError"] == nil {
+		t.Errorf("no status error: %v", res.Volume.Status)
+	}
+}
@@ -0,0 +1,9 @@
+// Package e2e is the end-to-end test of the plugin.
+// It runs the plugin on a temporary unix socket, with a fake EMS and a fake mounter, and drives it with the same
+// JSON requests Docker makes, asserting the responses and the resulting state.
+//
+// The plugin binary is the test binary of the plugin, which includes the fake mounter and the in-memory backend.
+// The tests build it with the race detector, unless one is specified via -plugin.
+//
+// Usage: go test ./e2e [-args -backend fake -plugin-logs -keep]
+package e2e
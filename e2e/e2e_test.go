@@ -0,0 +1,521 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/elastifile-docker-volume-provisioner/fakeems"
+)
+
+const (
+	backendEms  = "ems"  // The plugin's EMS client against fakeems, which lets the harness verify EMS state
+	backendFake = "fake" // The plugin's in-memory backend
+
+	pluginStartTimeout = 10 * time.Second
+
+	adminToken    = "e2e-admin-token"
+	gcGracePeriod = time.Second
+	stateVersion  = 2
+)
+
+var (
+	pluginPath = flag.String("plugin", "", "Path to the plugin's test binary, built by the tests if not specified")
+	backend    = flag.String("backend", "", "Storage backend: ems (fake EMS server) or fake (in-memory), both if not specified")
+	keep       = flag.Bool("keep", false, "Keep the temporary directory")
+	pluginLogs = flag.Bool("plugin-logs", false, "Show plugin logs")
+)
+
+type harness struct {
+	t         *testing.T
+	backend   string
+	dir       string
+	socket    string
+	statePath string
+	client    *http.Client
+	ems       *fakeems.Server
+	nfs       *fakeNfsServer
+	emsAddr   string
+	plugin    *exec.Cmd
+	pluginLog *os.File
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	if *pluginPath == "" {
+		dir, err := ioutil.TempDir("", "edvp-e2e-plugin-")
+		if err != nil {
+			logrus.Error(err.Error())
+			return 1
+		}
+		defer os.RemoveAll(dir)
+
+		*pluginPath = filepath.Join(dir, "edvp")
+		if err = buildPlugin(*pluginPath); err != nil {
+			logrus.Error(err.Error())
+			return 1
+		}
+	}
+	return m.Run()
+}
+
+// buildPlugin builds the test binary of the plugin, which includes the fakes, with the race detector
+func buildPlugin(path string) error {
+	output, err := exec.Command("go", "test", "-c", "-race", "-o", path, "..").CombinedOutput()
+	if err != nil {
+		return errors.Errorf("Failed to build the plugin: %v: %s", err, output)
+	}
+	return nil
+}
+
+func TestE2E(t *testing.T) {
+	backends := []string{backendEms, backendFake}
+	if *backend != "" {
+		backends = []string{*backend}
+	}
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			h, err := newHarness(t, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.cleanup()
+
+			if err = h.startPlugin(); err != nil {
+				t.Fatal(err)
+			}
+			h.runScenarios()
+			h.stopPlugin()
+			h.run("Plugin didn't report data races", h.checkPluginLog)
+		})
+	}
+}
+
+func newHarness(t *testing.T, backend string) (*harness, error) {
+	dir, err := ioutil.TempDir("", "edvp-e2e-")
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to create temporary directory", 0)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "state"), 0755); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to create state directory", 0)
+	}
+
+	h := &harness{
+		t:         t,
+		backend:   backend,
+		dir:       dir,
+		socket:    filepath.Join(dir, "elastifile.sock"),
+		statePath: filepath.Join(dir, "state", "elastifile-state.json"),
+	}
+	h.client = &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", h.socket)
+			},
+		},
+	}
+
+	if h.nfs, err = startFakeNfsServer(); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to start fake NFS server", 0)
+	}
+
+	if h.backend == backendEms {
+		h.ems = fakeems.NewServer()
+		if h.emsAddr, err = h.ems.Start("127.0.0.1:0"); err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to start fake EMS", 0)
+		}
+	}
+	return h, nil
+}
+
+func (h *harness) cleanup() {
+	if h.plugin != nil {
+		h.stopPlugin()
+	}
+	if h.nfs != nil {
+		h.nfs.close()
+	}
+	if !*keep {
+		os.RemoveAll(h.dir)
+	}
+}
+
+func (h *harness) startPlugin(extraEnv ...string) error {
+	cmd := exec.Command(*pluginPath)
+	cmd.Env = append(os.Environ(),
+		"EDVP_TEST_PLUGIN=true", // Runs the plugin instead of the tests
+		"PLUGIN_ROOT="+h.dir,
+		"SOCKET_ADDRESS="+h.socket,
+		"NFS_ADDRESS=127.0.0.1",
+		"MOUNTER=fake",
+		"CRUD_IDEMPOTENT=false",
+		"ALLOW_FOREIGN_DELETE=false",
+		"OWNER_ID=e2e",
+		"HEALTH_CHECK_INTERVAL=1s",
+		"DEFAULT_MOUNT_OPTIONS=nolock,vers=3,"+h.nfsPortOpts(),
+		"PROBE_BEFORE_MOUNT=true",
+		"DENIED_MOUNT_OPTIONS=nosharecache,sec=none,vers=4",
+		"METRICS_ADDRESS=unix://"+h.metricsSocket(),
+		"DEBUG=true",
+		"LOG_FORMAT=json",
+		"AUDIT_LOG_MAX_SIZE=16KiB",
+		"AUDIT_LOG_MAX_FILES=2",
+		"ADMIN_TOKEN="+adminToken,
+		"GC_GRACE_PERIOD="+gcGracePeriod.String(),
+	)
+	if h.backend == backendEms {
+		cmd.Env = append(cmd.Env,
+			"STORAGE_BACKEND=ems",
+			"MGMT_ADDRESS="+h.emsAddr,
+			"MGMT_USERNAME="+fakeems.DefaultUser,
+			"MGMT_PASSWORD="+fakeems.DefaultPassword,
+		)
+	} else {
+		cmd.Env = append(cmd.Env, "STORAGE_BACKEND=fake")
+	}
+	cmd.Env = append(cmd.Env, extraEnv...)
+
+	logFile, err := os.OpenFile(h.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to open plugin log", 0)
+	}
+	cmd.Stdout = logFile
+	if *pluginLogs {
+		cmd.Stdout = io.MultiWriter(logFile, os.Stdout)
+	}
+	cmd.Stderr = cmd.Stdout
+
+	os.Remove(h.socket)
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return errors.WrapPrefix(err, "Failed to start plugin", 0)
+	}
+	h.plugin = cmd
+	h.pluginLog = logFile
+
+	deadline := time.Now().Add(pluginStartTimeout)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("unix", h.socket); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.Errorf("Plugin didn't start listening on %v within %v", h.socket, pluginStartTimeout)
+}
+
+func (h *harness) stopPlugin() {
+	if h.plugin == nil {
+		return
+	}
+	h.plugin.Process.Kill()
+	h.plugin.Wait()
+	h.plugin = nil
+	h.pluginLog.Close()
+}
+
+// nfsPortOpts are the mount options directing the plugin's probes to the fake NFS server
+func (h *harness) nfsPortOpts() string {
+	return fmt.Sprintf("port=%v,mountport=%v", h.nfs.port(), h.nfs.port())
+}
+
+func (h *harness) metricsSocket() string {
+	return filepath.Join(h.dir, "metrics.sock")
+}
+
+func (h *harness) logPath() string {
+	return filepath.Join(h.dir, "plugin.log")
+}
+
+// checkPluginLog fails if the plugin, built with -race, reported data races
+func (h *harness) checkPluginLog() error {
+	data, err := ioutil.ReadFile(h.logPath())
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read plugin log", 0)
+	}
+	if races := strings.Count(string(data), "WARNING: DATA RACE"); races > 0 {
+		return errors.Errorf("%v data races reported, see %v (use -keep)", races, h.logPath())
+	}
+	return nil
+}
+
+// pluginLogEntries parses the JSON lines of the plugin log, skipping other output such as race reports
+func (h *harness) pluginLogEntries() ([]map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(h.logPath())
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read plugin log", 0)
+	}
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(string(data), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// call sends the request to the plugin and decodes the response. Errors reported by the plugin are returned as errors.
+func (h *harness) call(path string, req interface{}, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpRes, err := h.client.Post("http://plugin"+path, "application/vnd.docker.plugins.v1.1+json", bytes.NewReader(body))
+	if err != nil {
+		return errors.WrapPrefix(err, fmt.Sprintf("%v request failed", path), 0)
+	}
+	defer httpRes.Body.Close()
+
+	data, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return err
+	}
+
+	var errRes volume.ErrorResponse
+	if err = json.Unmarshal(data, &errRes); err == nil && errRes.Err != "" {
+		return errors.New(errRes.Err)
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		return errors.Errorf("%v returned %v: %s", path, httpRes.Status, data)
+	}
+	if res != nil {
+		if err = json.Unmarshal(data, res); err != nil {
+			return errors.WrapPrefix(err, fmt.Sprintf("Failed to decode %v response: %s", path, data), 0)
+		}
+	}
+	return nil
+}
+
+// run executes a single test step as a subtest. The following steps run even if it fails.
+func (h *harness) run(description string, step func() error) {
+	h.t.Run(description, func(t *testing.T) {
+		if err := step(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// expectError fails unless err is set and contains substr
+func expectError(err error, substr string) error {
+	if err == nil {
+		return errors.Errorf("expected error containing '%v', got success", substr)
+	}
+	if !strings.Contains(err.Error(), substr) {
+		return errors.Errorf("expected error containing '%v', got: %v", substr, err)
+	}
+	return nil
+}
+
+func (h *harness) createVolume(name string, opts map[string]string) error {
+	return h.call("/VolumeDriver.Create", volume.CreateRequest{Name: name, Options: opts}, nil)
+}
+
+func (h *harness) removeVolume(name string) error {
+	return h.call("/VolumeDriver.Remove", volume.RemoveRequest{Name: name}, nil)
+}
+
+func (h *harness) mountVolume(name string, id string) (string, error) {
+	var res volume.MountResponse
+	err := h.call("/VolumeDriver.Mount", volume.MountRequest{Name: name, ID: id}, &res)
+	return res.Mountpoint, err
+}
+
+func (h *harness) unmountVolume(name string, id string) error {
+	return h.call("/VolumeDriver.Unmount", volume.UnmountRequest{Name: name, ID: id}, nil)
+}
+
+func (h *harness) listVolumes() (names []string, err error) {
+	var res volume.ListResponse
+	if err = h.call("/VolumeDriver.List", struct{}{}, &res); err != nil {
+		return nil, err
+	}
+	for _, v := range res.Volumes {
+		names = append(names, v.Name)
+	}
+	return names, nil
+}
+
+func (h *harness) getVolume(name string) (*volume.Volume, error) {
+	var res volume.GetResponse
+	if err := h.call("/VolumeDriver.Get", volume.GetRequest{Name: name}, &res); err != nil {
+		return nil, err
+	}
+	if res.Volume == nil {
+		return nil, errors.Errorf("volume %v missing from Get response", name)
+	}
+	return res.Volume, nil
+}
+
+// stateVolumes returns the names of the volumes in the plugin's state file
+func (h *harness) stateVolumes() (map[string]json.RawMessage, error) {
+	data, err := ioutil.ReadFile(h.statePath)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read state", 0)
+	}
+	var state struct {
+		Version int
+		Volumes map[string]json.RawMessage
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse state", 0)
+	}
+	if state.Version != stateVersion {
+		return nil, errors.Errorf("unexpected state version %v", state.Version)
+	}
+	return state.Volumes, nil
+}
+
+// scrapeMetrics returns the plugin's metrics by name and labels, e.g. edvp_volumes or
+// edvp_volume_api_requests_total{method="Create",result="success"}
+func (h *harness) scrapeMetrics() (map[string]float64, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", h.metricsSocket())
+			},
+		},
+	}
+	httpRes, err := client.Get("http://plugin/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+	data, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := map[string]float64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndex(line, " ")
+		if sep < 0 {
+			return nil, errors.Errorf("Malformed metrics line: %v", line)
+		}
+		value, err := strconv.ParseFloat(line[sep+1:], 64)
+		if err != nil {
+			return nil, errors.Errorf("Malformed metrics line: %v", line)
+		}
+		metrics[line[:sep]] = value
+	}
+	return metrics, nil
+}
+
+// adminCall sends a request to the plugin's admin API
+func (h *harness) adminCall(method string, path string, req interface{}) error {
+	return h.adminRequest(method, path, req, nil)
+}
+
+// adminRequest sends a request to the plugin's admin API and decodes the response, unless res is nil
+func (h *harness) adminRequest(method string, path string, req interface{}, res interface{}) error {
+	return h.adminRequestWithToken(adminToken, method, path, req, res)
+}
+
+// adminRequestWithToken is adminRequest with the specified bearer token, or none if token is empty. Errors are
+// prefixed with their error code, e.g. "not_found: ...".
+func (h *harness) adminRequestWithToken(token string, method string, path string, req interface{},
+	res interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", filepath.Join(h.dir, "state", "elastifile-admin.sock"))
+			},
+		},
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(method, "http://plugin"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+
+	data, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return err
+	}
+	var errRes struct{ Err, Code string }
+	json.Unmarshal(data, &errRes)
+	if errRes.Err != "" {
+		return errors.Errorf("%v: %v", errRes.Code, errRes.Err)
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		return errors.Errorf("%v %v returned %v", method, path, httpRes.Status)
+	}
+	if res != nil {
+		return json.Unmarshal(data, res)
+	}
+	return nil
+}
+
+// ctl runs the plugin binary as edvpctl against the plugin's admin API and returns its output
+func (h *harness) ctl(args ...string) (string, error) {
+	ctlPath := filepath.Join(h.dir, "edvpctl")
+	if _, err := os.Lstat(ctlPath); os.IsNotExist(err) {
+		pluginPath, err := filepath.Abs(*pluginPath)
+		if err != nil {
+			return "", err
+		}
+		if err = os.Symlink(pluginPath, ctlPath); err != nil {
+			return "", errors.WrapPrefix(err, "Failed to link edvpctl", 0)
+		}
+	}
+
+	args = append([]string{"-socket", filepath.Join(h.dir, "state", "elastifile-admin.sock"), "-token", adminToken},
+		args...)
+	output, err := exec.Command(ctlPath, args...).CombinedOutput()
+	if err != nil {
+		return string(output), errors.Errorf("edvpctl %v failed: %v: %s", strings.Join(args[4:], " "), err, output)
+	}
+	return string(output), nil
+}
+
+// ctlError runs edvpctl and returns its error only, which includes the output
+func (h *harness) ctlError(args ...string) error {
+	_, err := h.ctl(args...)
+	return err
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
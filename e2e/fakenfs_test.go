@@ -0,0 +1,156 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/davecgh/go-xdr/xdr2"
+	"github.com/sirupsen/logrus"
+)
+
+// SunRPC programs and statuses answered by the fake NFS server
+const (
+	rpcProgNfs    = 100003
+	rpcProgMountd = 100005
+
+	rpcSuccess      = 0
+	rpcProgUnavail  = 1
+	rpcProgMismatch = 2
+	rpcProcUnavail  = 3
+
+	mnt3ErrNoent = 2
+	mnt3ErrAcces = 13
+)
+
+// fakeNfsServer answers the SunRPC calls the plugin makes to probe exports before mounting - mountd MNT/UMNT
+// and NFS v3 NULL - all on a single TCP port, which is passed to the plugin with the port and mountport mount options
+type fakeNfsServer struct {
+	sync.Mutex
+
+	listener net.Listener
+	statuses map[string]uint32 // MNT status by export path, exports not listed are mounted successfully
+}
+
+type rpcOpaqueAuth struct {
+	Flavor uint32
+	Body   []byte
+}
+
+type rpcCallHeader struct {
+	Xid     uint32
+	MsgType uint32
+	RpcVers uint32
+	Prog    uint32
+	Vers    uint32
+	Proc    uint32
+	Cred    rpcOpaqueAuth
+	Verf    rpcOpaqueAuth
+}
+
+func startFakeNfsServer() (*fakeNfsServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeNfsServer{
+		listener: listener,
+		statuses: map[string]uint32{},
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *fakeNfsServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeNfsServer) setExportStatus(exportPath string, status uint32) {
+	s.Lock()
+	defer s.Unlock()
+	s.statuses[exportPath] = status
+}
+
+func (s *fakeNfsServer) close() {
+	s.listener.Close()
+}
+
+func (s *fakeNfsServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.handle(conn); err != nil && err != io.EOF {
+				logrus.Warnf("Fake NFS server: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *fakeNfsServer) handle(conn net.Conn) error {
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(conn, marker[:]); err != nil {
+			return err
+		}
+		call := make([]byte, binary.BigEndian.Uint32(marker[:])&^(1<<31)) // The plugin sends single fragments
+		if _, err := io.ReadFull(conn, call); err != nil {
+			return err
+		}
+
+		dec := xdr.NewDecoder(bytes.NewReader(call))
+		var header rpcCallHeader
+		if _, err := dec.Decode(&header); err != nil {
+			return err
+		}
+
+		var reply bytes.Buffer
+		reply.Write(make([]byte, 4))
+		xdr.Marshal(&reply, struct {
+			Xid, MsgType, ReplyStat uint32
+			Verf                    rpcOpaqueAuth
+		}{Xid: header.Xid, MsgType: 1, Verf: rpcOpaqueAuth{Body: []byte{}}})
+
+		switch {
+		case header.Prog == rpcProgMountd && header.Vers == 3:
+			switch header.Proc {
+			case 0, 3: // NULL, UMNT
+				xdr.Marshal(&reply, uint32(rpcSuccess))
+			case 1: // MNT
+				exportPath, _, err := dec.DecodeString()
+				if err != nil {
+					return err
+				}
+				s.Lock()
+				status := s.statuses[exportPath]
+				s.Unlock()
+				xdr.Marshal(&reply, [2]uint32{rpcSuccess, status})
+				if status == 0 {
+					xdr.Marshal(&reply, struct {
+						FileHandle  []byte
+						AuthFlavors []uint32
+					}{[]byte("fakefh00"), []uint32{1}})
+				}
+			default:
+				xdr.Marshal(&reply, uint32(rpcProcUnavail))
+			}
+		case header.Prog == rpcProgNfs && header.Vers == 3 && header.Proc == 0:
+			xdr.Marshal(&reply, uint32(rpcSuccess))
+		case header.Prog == rpcProgNfs:
+			xdr.Marshal(&reply, [3]uint32{rpcProgMismatch, 3, 3})
+		default:
+			xdr.Marshal(&reply, uint32(rpcProgUnavail))
+		}
+
+		data := reply.Bytes()
+		binary.BigEndian.PutUint32(data, uint32(len(data)-4)|1<<31)
+		if _, err := conn.Write(data); err != nil {
+			return err
+		}
+	}
+}
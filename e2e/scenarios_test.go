@@ -0,0 +1,1368 @@
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/go-errors/errors"
+
+	"github.com/elastifile/elastifile-docker-volume-provisioner/fakeems"
+)
+
+const (
+	testVolume = "vol1"
+	testDc     = "vol1" // Default DC name template
+)
+
+func (h *harness) runScenarios() {
+	h.runProtocolScenario()
+	h.runLifecycleScenario()
+	h.runSubdirScenario()
+	h.runSnapshotScenario()
+	h.runProbeScenario()
+	h.runErrorScenario()
+	h.runMetricsScenario()
+	h.runLoggingScenario()
+	h.runAuditScenario()
+	h.runAdminScenario()
+	h.runCtlScenario()
+	h.runGcScenario()
+	h.runPersistenceScenario()
+	h.runStateScenario()
+	if h.ems != nil {
+		h.runFaultScenario()
+	}
+}
+
+func (h *harness) runProtocolScenario() {
+	h.run("Plugin activates as a volume driver", func() error {
+		var res struct{ Implements []string }
+		if err := h.call("/Plugin.Activate", struct{}{}, &res); err != nil {
+			return err
+		}
+		if !contains(res.Implements, "VolumeDriver") {
+			return errors.Errorf("unexpected implements: %v", res.Implements)
+		}
+		return nil
+	})
+
+	h.run("Plugin reports global scope", func() error {
+		var res volume.CapabilitiesResponse
+		if err := h.call("/VolumeDriver.Capabilities", struct{}{}, &res); err != nil {
+			return err
+		}
+		if res.Capabilities.Scope != "global" {
+			return errors.Errorf("unexpected scope: %v", res.Capabilities.Scope)
+		}
+		return nil
+	})
+}
+
+func (h *harness) runLifecycleScenario() {
+	var mountpoint string
+
+	h.run("Create new volume", func() error {
+		if err := h.createVolume(testVolume, map[string]string{"size": "1GiB"}); err != nil {
+			return err
+		}
+		return h.expectEmsObjects(testDc, true)
+	})
+
+	h.run("Created volume is listed and persisted", func() error {
+		names, err := h.listVolumes()
+		if err != nil {
+			return err
+		}
+		if !contains(names, testVolume) {
+			return errors.Errorf("volume %v not listed: %v", testVolume, names)
+		}
+		state, err := h.stateVolumes()
+		if err != nil {
+			return err
+		}
+		if _, ok := state[testVolume]; !ok {
+			return errors.Errorf("volume %v not found in state", testVolume)
+		}
+		return nil
+	})
+
+	h.run("Get and Path report the same mount point", func() error {
+		v, err := h.getVolume(testVolume)
+		if err != nil {
+			return err
+		}
+		var res volume.PathResponse
+		if err = h.call("/VolumeDriver.Path", volume.PathRequest{Name: testVolume}, &res); err != nil {
+			return err
+		}
+		if v.Mountpoint == "" || v.Mountpoint != res.Mountpoint {
+			return errors.Errorf("mount point mismatch: Get %v, Path %v", v.Mountpoint, res.Mountpoint)
+		}
+		mountpoint = v.Mountpoint
+		return nil
+	})
+
+	h.run("Mount the volume for two containers", func() error {
+		for _, id := range []string{"m1", "m2"} {
+			mp, err := h.mountVolume(testVolume, id)
+			if err != nil {
+				return err
+			}
+			if mp != mountpoint {
+				return errors.Errorf("mount %v returned %v, expected %v", id, mp, mountpoint)
+			}
+		}
+		if fi, err := os.Stat(mountpoint); err != nil || !fi.IsDir() {
+			return errors.Errorf("mount point %v is not a directory: %v", mountpoint, err)
+		}
+		return nil
+	})
+
+	h.run("Mounted volume reports its mount health", func() error {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			v, err := h.getVolume(testVolume)
+			if err != nil {
+				return err
+			}
+			if state, ok := v.Status["MountHealth"]; ok {
+				if state != "healthy" {
+					return errors.Errorf("unexpected mount health: %v", v.Status)
+				}
+				return nil
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		return errors.New("mount health not reported")
+	})
+
+	h.run("Mounted volume reports its Data Container, usage and mounts", func() error {
+		v, err := h.getVolume(testVolume)
+		if err != nil {
+			return err
+		}
+		if v.Status["DataContainer"] != testDc || v.Status["MountState"] != "mounted" {
+			return errors.Errorf("unexpected status: %v", v.Status)
+		}
+		if mounts, ok := v.Status["ActiveMounts"].([]interface{}); !ok || len(mounts) != 2 {
+			return errors.Errorf("unexpected active mounts: %v", v.Status["ActiveMounts"])
+		}
+		for _, key := range []string{"HardQuota", "UsedCapacity", "NfsServer", "CreatedAt"} {
+			if _, ok := v.Status[key]; !ok {
+				return errors.Errorf("%v not reported: %v", key, v.Status)
+			}
+		}
+		return nil
+	})
+
+	h.run("Remove a mounted volume fails", func() error {
+		return expectError(h.removeVolume(testVolume), "currently used")
+	})
+
+	h.run("Unmount the volume for both containers", func() error {
+		for _, id := range []string{"m1", "m2"} {
+			if err := h.unmountVolume(testVolume, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	h.run("Remove a protected volume fails", func() error {
+		if err := h.adminCall("PUT", "/volumes/"+testVolume+"/protection", map[string]bool{"Protected": true}); err != nil {
+			return err
+		}
+		if err := expectError(h.removeVolume(testVolume), "protected"); err != nil {
+			return err
+		}
+		return h.adminCall("PUT", "/volumes/"+testVolume+"/protection", map[string]bool{"Protected": false})
+	})
+
+	h.run("Remove the volume", func() error {
+		if err := h.removeVolume(testVolume); err != nil {
+			return err
+		}
+		names, err := h.listVolumes()
+		if err != nil {
+			return err
+		}
+		if contains(names, testVolume) {
+			return errors.Errorf("removed volume %v still listed", testVolume)
+		}
+		state, err := h.stateVolumes()
+		if err != nil {
+			return err
+		}
+		if _, ok := state[testVolume]; ok {
+			return errors.Errorf("removed volume %v still in state", testVolume)
+		}
+		return h.expectEmsObjects(testDc, false)
+	})
+}
+
+func (h *harness) runSubdirScenario() {
+	const parent, child1, child2 = "parent1", "child1", "child2"
+
+	h.run("Create sub-directory volumes", func() error {
+		if err := h.createVolume(parent, nil); err != nil {
+			return err
+		}
+		if err := h.createVolume(child1, map[string]string{"parent": parent, "subdir": "data/app"}); err != nil {
+			return err
+		}
+		if err := h.createVolume(child2, map[string]string{"parent": parent}); err != nil {
+			return err
+		}
+		v, err := h.getVolume(child1)
+		if err != nil {
+			return err
+		}
+		if v.Status["Parent"] != parent || v.Status["Subdir"] != "data/app" {
+			return errors.Errorf("unexpected status: %v", v.Status)
+		}
+		return nil
+	})
+
+	h.run("Create of sub-directory volumes with conflicting options fails", func() error {
+		err := expectError(h.createVolume("child3", map[string]string{"parent": parent, "subdir": "data/app"}), "already used")
+		if err != nil {
+			return err
+		}
+		err = expectError(h.createVolume("child3", map[string]string{"parent": parent, "subdir": "../escape"}), "Invalid")
+		if err != nil {
+			return err
+		}
+		return expectError(h.createVolume("child3", map[string]string{"parent": parent, "size": "1GiB"}), "not supported")
+	})
+
+	h.run("Protection of a sub-directory volume leaves its parent's Data Container alone", func() error {
+		if err := h.adminCall("PUT", "/volumes/"+child1+"/protection", map[string]bool{"Protected": true}); err != nil {
+			return err
+		}
+		if h.ems != nil {
+			for _, dc := range h.ems.DataContainers() {
+				if dc.Name == parent && strings.Contains(dc.Description, "edvp.protected") {
+					return errors.Errorf("Data Container of %v was protected: %v", parent, dc.Description)
+				}
+			}
+		}
+		if err := expectError(h.removeVolume(child1), "protected"); err != nil {
+			return err
+		}
+		return h.adminCall("PUT", "/volumes/"+child1+"/protection", map[string]bool{"Protected": false})
+	})
+
+	h.run("Mount sub-directory volumes sharing the Data Container", func() error {
+		for _, name := range []string{child1, child2} {
+			mp, err := h.mountVolume(name, "m1")
+			if err != nil {
+				return err
+			}
+			if fi, err := os.Stat(mp); err != nil || !fi.IsDir() {
+				return errors.Errorf("mount point %v is not a directory: %v", mp, err)
+			}
+		}
+		return nil
+	})
+
+	h.run("Remove a volume with sub-directory volumes fails", func() error {
+		return expectError(h.removeVolume(parent), "sub-directory / snapshot volumes")
+	})
+
+	h.run("Remove sub-directory volumes and their parent", func() error {
+		for _, name := range []string{child1, child2} {
+			if err := h.unmountVolume(name, "m1"); err != nil {
+				return err
+			}
+			if err := h.removeVolume(name); err != nil {
+				return err
+			}
+		}
+		return h.removeVolume(parent)
+	})
+}
+
+func (h *harness) runSnapshotScenario() {
+	const source, snapshotVolume = "source1", "daily1"
+
+	h.run("Create a snapshot volume", func() error {
+		if err := h.createVolume(source, nil); err != nil {
+			return err
+		}
+		// Stands for the snapshot directory of ECFS, as the plugin runs with a fake mounter
+		if err := os.MkdirAll(filepath.Join(h.dir, "shared", source, ".snapshot", "daily"), 0755); err != nil {
+			return err
+		}
+		if err := h.createVolume(snapshotVolume, map[string]string{"snapshot-of": source, "snapshot": "daily"}); err != nil {
+			return err
+		}
+		v, err := h.getVolume(snapshotVolume)
+		if err != nil {
+			return err
+		}
+		if v.Status["ReadOnly"] != true || v.Status["SnapshotOf"] != source {
+			return errors.Errorf("unexpected status: %v", v.Status)
+		}
+		return nil
+	})
+
+	h.run("Create a volume of a missing snapshot fails", func() error {
+		return expectError(h.createVolume("weekly1", map[string]string{"snapshot-of": source, "snapshot": "weekly"}), "not found")
+	})
+
+	h.run("Mount and remove the snapshot volume", func() error {
+		if _, err := h.mountVolume(snapshotVolume, "m1"); err != nil {
+			return err
+		}
+		if err := h.unmountVolume(snapshotVolume, "m1"); err != nil {
+			return err
+		}
+		if err := expectError(h.removeVolume(source), "snapshot volumes"); err != nil {
+			return err
+		}
+		if err := h.removeVolume(snapshotVolume); err != nil {
+			return err
+		}
+		return h.removeVolume(source)
+	})
+
+	const cloneSource, cloneVolume = "source2", "daily2"
+
+	h.run("Snapshot volume of a Data Container without snapshot directory clones the snapshot", func() error {
+		if err := h.createVolume(cloneSource, nil); err != nil {
+			return err
+		}
+		err := h.createVolume(cloneVolume, map[string]string{"snapshot-of": cloneSource, "snapshot": "daily"})
+		if err = expectError(err, "not found"); err != nil {
+			return err
+		}
+		if err = h.adminCall("POST", "/volumes/"+cloneSource+"/snapshot", map[string]string{"Snapshot": "daily"}); err != nil {
+			return err
+		}
+		if err = h.createVolume(cloneVolume, map[string]string{"snapshot-of": cloneSource, "snapshot": "daily"}); err != nil {
+			return err
+		}
+		v, err := h.getVolume(cloneVolume)
+		if err != nil {
+			return err
+		}
+		if v.Status["ReadOnly"] != true || v.Status["SnapshotOf"] != cloneSource || v.Status["DataContainer"] != cloneVolume {
+			return errors.Errorf("unexpected status: %v", v.Status)
+		}
+		if err = h.expectMountOpts(cloneVolume, "nolock,vers=3,"+h.nfsPortOpts()+",ro"); err != nil {
+			return err
+		}
+		return h.expectEmsObjects(cloneVolume, true)
+	})
+
+	h.run("Snapshot volume backed by a clone is independent of its source", func() error {
+		if err := h.removeVolume(cloneSource); err != nil {
+			return err
+		}
+		if _, err := h.mountVolume(cloneVolume, "m1"); err != nil {
+			return err
+		}
+		if err := h.unmountVolume(cloneVolume, "m1"); err != nil {
+			return err
+		}
+		if err := h.removeVolume(cloneVolume); err != nil {
+			return err
+		}
+		return h.expectEmsObjects(cloneVolume, false)
+	})
+}
+
+func (h *harness) runProbeScenario() {
+	h.run("Mount of an export mountd doesn't know fails with a diagnosis", func() error {
+		if err := h.createVolume(testVolume, nil); err != nil {
+			return err
+		}
+		h.nfs.setExportStatus("/"+testDc+"/root", mnt3ErrNoent)
+		_, err := h.mountVolume(testVolume, "m1")
+		err = expectError(err, "Export /"+testDc+"/root not found")
+		if err == nil {
+			h.nfs.setExportStatus("/"+testDc+"/root", mnt3ErrAcces)
+			_, err = h.mountVolume(testVolume, "m1")
+			err = expectError(err, "Access denied for this client")
+		}
+		h.nfs.setExportStatus("/"+testDc+"/root", 0)
+		if removeErr := h.removeVolume(testVolume); removeErr != nil {
+			return removeErr
+		}
+		return err
+	})
+
+	h.run("Mount with an unreachable NFS port fails with a diagnosis", func() error {
+		if err := h.createVolume(testVolume, map[string]string{"port": "1"}); err != nil {
+			return err
+		}
+		_, err := h.mountVolume(testVolume, "m1")
+		err = expectError(err, "NFS port unreachable")
+		if removeErr := h.removeVolume(testVolume); removeErr != nil {
+			return removeErr
+		}
+		return err
+	})
+}
+
+func (h *harness) runErrorScenario() {
+	h.run("Operations on a missing volume fail", func() error {
+		if _, err := h.getVolume("missing"); expectError(err, "not found") != nil {
+			return expectError(err, "not found")
+		}
+		if _, err := h.mountVolume("missing", "m1"); expectError(err, "not found") != nil {
+			return expectError(err, "not found")
+		}
+		return expectError(h.removeVolume("missing"), "not found")
+	})
+
+	h.run("Create with malformed options fails", func() error {
+		if err := expectError(h.createVolume("bad", map[string]string{"size": "lots"}), "size"); err != nil {
+			return err
+		}
+		return expectError(h.createVolume("bad", map[string]string{"user-mapping-type": "everyone"}), "user mapping")
+	})
+
+	h.run("Create with invalid or denied mount options fails", func() error {
+		if err := expectError(h.createVolume("bad", map[string]string{"vers": "9"}), "vers"); err != nil {
+			return err
+		}
+		if err := expectError(h.createVolume("bad", map[string]string{"sec": "none"}), "denied"); err != nil {
+			return err
+		}
+		if err := expectError(h.createVolume("bad", map[string]string{"nfsvers": "4"}), "denied"); err != nil {
+			return err
+		}
+		return expectError(h.createVolume("bad", map[string]string{"nosharecache": ""}), "denied")
+	})
+
+	h.run("Mount options override the defaults and can be updated", func() error {
+		if err := h.createVolume(testVolume, map[string]string{"vers": "4.1", "hard": ""}); err != nil {
+			return err
+		}
+		err := h.expectMountOpts(testVolume, "nolock,vers=4.1,hard,"+h.nfsPortOpts())
+		if err == nil {
+			err = h.adminCall("PUT", "/volumes/"+testVolume+"/mount-options", map[string][]string{"MountOpts": {"soft"}})
+		}
+		if err == nil {
+			err = h.expectMountOpts(testVolume, "nolock,vers=3,soft,"+h.nfsPortOpts())
+		}
+		if err == nil {
+			err = expectError(h.adminCall("PUT", "/volumes/"+testVolume+"/mount-options",
+				map[string][]string{"MountOpts": {"sec=none"}}), "denied")
+		}
+		if removeErr := h.removeVolume(testVolume); removeErr != nil {
+			return removeErr
+		}
+		return err
+	})
+
+	h.run("Create of an existing volume fails in strict mode", func() error {
+		if err := h.createVolume(testVolume, nil); err != nil {
+			return err
+		}
+		err := expectError(h.createVolume(testVolume, nil), "")
+		if removeErr := h.removeVolume(testVolume); removeErr != nil {
+			return removeErr
+		}
+		return err
+	})
+
+	h.run("Idempotent create with conflicting size fails", func() error {
+		if err := h.createVolume(testVolume, map[string]string{"size": "1GiB"}); err != nil {
+			return err
+		}
+		err := expectError(h.createVolume(testVolume, map[string]string{"size": "2GiB", "if-not-exists": "true"}), "conflict")
+		if err == nil {
+			err = h.createVolume(testVolume, map[string]string{"size": "1GiB", "if-not-exists": "true"})
+		}
+		if removeErr := h.removeVolume(testVolume); removeErr != nil {
+			return removeErr
+		}
+		return err
+	})
+}
+
+func (h *harness) runMetricsScenario() {
+	const name = "metrics1"
+
+	h.run("Metrics report requests, EMS calls, mounts and volume usage", func() error {
+		if err := h.createVolume(name, map[string]string{"size": "1GiB"}); err != nil {
+			return err
+		}
+		if _, err := h.mountVolume(name, "m1"); err != nil {
+			return err
+		}
+		metrics, err := h.scrapeMetrics()
+		if err != nil {
+			return err
+		}
+		if err = h.unmountVolume(name, "m1"); err != nil {
+			return err
+		}
+		if err = h.removeVolume(name); err != nil {
+			return err
+		}
+
+		for _, key := range []string{
+			`edvp_volume_api_requests_total{method="Create",result="success"}`,
+			`edvp_volume_api_requests_total{method="Create",result="error"}`,
+			`edvp_volume_api_request_duration_seconds_count{method="Mount"}`,
+			`edvp_ems_requests_total{endpoint="create_dc_export",result="success"}`,
+			`edvp_mount_operations_total{operation="mount",result="success"}`,
+			`edvp_mount_operation_duration_seconds_bucket{operation="mount",le="+Inf"}`,
+		} {
+			if metrics[key] <= 0 {
+				return errors.Errorf("%v not reported", key)
+			}
+		}
+		if metrics["edvp_active_mounts"] != 1 {
+			return errors.Errorf("unexpected active mounts: %v", metrics["edvp_active_mounts"])
+		}
+		if metrics["edvp_volumes"] < 1 {
+			return errors.Errorf("unexpected volume count: %v", metrics["edvp_volumes"])
+		}
+		quota := fmt.Sprintf(`edvp_volume_quota_bytes{volume="%v",data_container="%v"}`, name, name)
+		if metrics[quota] != 1<<30 {
+			return errors.Errorf("unexpected %v: %v", quota, metrics[quota])
+		}
+		return nil
+	})
+}
+
+func (h *harness) runLoggingScenario() {
+	const name = "logging1"
+
+	h.run("Log lines of a request share its correlation ID", func() error {
+		if err := h.createVolume(name, nil); err != nil {
+			return err
+		}
+		if _, err := h.mountVolume(name, "m1"); err != nil {
+			return err
+		}
+		if err := h.unmountVolume(name, "m1"); err != nil {
+			return err
+		}
+		if err := h.removeVolume(name); err != nil {
+			return err
+		}
+
+		entries, err := h.pluginLogEntries()
+		if err != nil {
+			return err
+		}
+		var requestId string
+		for _, entry := range entries {
+			if entry["method"] == "mount" && entry["volume"] == name && entry["msg"] == "Request received" {
+				requestId, _ = entry["request_id"].(string)
+				break
+			}
+		}
+		if requestId == "" {
+			return errors.Errorf("Mount request of %v not logged with a request_id", name)
+		}
+		for _, entry := range entries {
+			if entry["request_id"] == requestId && entry["msg"] == "Mount operation completed" {
+				if entry["duration"] == nil {
+					return errors.Errorf("mount operation logged without duration: %v", entry)
+				}
+				return nil
+			}
+		}
+		return errors.Errorf("mount operation of request %v not logged with its request_id", requestId)
+	})
+}
+
+func (h *harness) runAuditScenario() {
+	const name = "audit1"
+
+	h.run("Audit log records the volume lifecycle", func() error {
+		if err := h.createVolume(name, map[string]string{"size": "1GiB"}); err != nil {
+			return err
+		}
+		if _, err := h.mountVolume(name, "m1"); err != nil {
+			return err
+		}
+		if err := h.unmountVolume(name, "m1"); err != nil {
+			return err
+		}
+		if err := h.removeVolume(name); err != nil {
+			return err
+		}
+		if err := expectError(h.removeVolume(name), "not found"); err != nil {
+			return err
+		}
+
+		var res struct {
+			Entries []struct {
+				Operation     string
+				RequestId     string
+				CallerId      string
+				Options       map[string]string
+				DataContainer *struct{ Name string }
+				Result        string
+			}
+		}
+		if err := h.adminRequest("GET", "/audit?volume="+name, nil, &res); err != nil {
+			return err
+		}
+		var operations []string
+		for _, entry := range res.Entries {
+			operations = append(operations, entry.Operation+":"+entry.Result)
+		}
+		expected := []string{"create:success", "mount:success", "unmount:success", "remove:success", "remove:error"}
+		if strings.Join(operations, ",") != strings.Join(expected, ",") {
+			return errors.Errorf("unexpected audit entries: %v", operations)
+		}
+		for _, entry := range res.Entries[:4] {
+			if entry.DataContainer == nil || entry.DataContainer.Name != name || entry.RequestId == "" {
+				return errors.Errorf("%v entry lacks its Data Container or request ID", entry.Operation)
+			}
+		}
+		if res.Entries[0].Options["size"] != "1GiB" {
+			return errors.Errorf("create entry lacks its options: %v", res.Entries[0].Options)
+		}
+		if res.Entries[1].CallerId != "m1" || res.Entries[2].CallerId != "m1" {
+			return errors.New("mount entries lack the caller ID")
+		}
+
+		if err := h.adminRequest("GET", "/audit?volume="+name+"&operation=remove&limit=1", nil, &res); err != nil {
+			return err
+		}
+		if len(res.Entries) != 1 || res.Entries[0].Result != "error" {
+			return errors.Errorf("unexpected filtered audit entries: %+v", res.Entries)
+		}
+		return nil
+	})
+}
+
+func (h *harness) runAdminScenario() {
+	const name = "admin1"
+
+	h.run("Admin API rejects requests without a valid token", func() error {
+		if err := expectError(h.adminRequestWithToken("", "GET", "/state", nil, nil), "unauthorized"); err != nil {
+			return err
+		}
+		return expectError(h.adminRequestWithToken("wrong", "GET", "/state", nil, nil), "unauthorized")
+	})
+
+	h.run("Admin API inspects volumes and dumps the state", func() error {
+		if err := h.createVolume(name, map[string]string{"size": "1GiB"}); err != nil {
+			return err
+		}
+		var inspect struct {
+			Name   string
+			Volume struct{ DataContainer *struct{ Name string } }
+			Status map[string]interface{}
+		}
+		if err := h.adminRequest("GET", "/volumes/"+name, nil, &inspect); err != nil {
+			return err
+		}
+		if inspect.Name != name || inspect.Volume.DataContainer == nil || inspect.Volume.DataContainer.Name != name {
+			return errors.Errorf("unexpected inspect response: %+v", inspect)
+		}
+		if err := expectError(h.adminRequest("GET", "/volumes/missing1", nil, nil), "not_found"); err != nil {
+			return err
+		}
+
+		var state struct{ Volumes map[string]json.RawMessage }
+		if err := h.adminRequest("GET", "/state", nil, &state); err != nil {
+			return err
+		}
+		if _, ok := state.Volumes[name]; !ok {
+			return errors.Errorf("volume %v missing in the state dump", name)
+		}
+
+		var schema struct{ Definitions map[string]json.RawMessage }
+		if err := h.adminRequest("GET", "/schema", nil, &schema); err != nil {
+			return err
+		}
+		if _, ok := schema.Definitions["ErrorResponse"]; !ok {
+			return errors.New("schema lacks the error response")
+		}
+		return nil
+	})
+
+	h.run("Admin API snapshots a volume", func() error {
+		var res struct{ Snapshot string }
+		if err := h.adminRequest("POST", "/volumes/"+name+"/snapshot", map[string]string{"Snapshot": "manual1"},
+			&res); err != nil {
+			return err
+		}
+		if res.Snapshot != "manual1" {
+			return errors.Errorf("unexpected snapshot name %v", res.Snapshot)
+		}
+		err := h.adminCall("POST", "/volumes/"+name+"/snapshot", map[string]string{"Snapshot": "manual1"})
+		if err = expectError(err, "backend_error"); err != nil {
+			return err
+		}
+		if err = h.adminRequest("POST", "/volumes/"+name+"/snapshot", nil, &res); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(res.Snapshot, "edvp-") {
+			return errors.Errorf("unexpected generated snapshot name %v", res.Snapshot)
+		}
+		err = h.adminCall("POST", "/volumes/missing1/snapshot", map[string]string{"Snapshot": "manual1"})
+		if err = expectError(err, "not_found"); err != nil {
+			return err
+		}
+		if h.ems != nil && len(h.ems.Snapshots()) != 2 {
+			return errors.Errorf("unexpected EMS snapshots: %v", h.ems.Snapshots())
+		}
+		return nil
+	})
+
+	h.run("Admin API resizes a volume", func() error {
+		var res struct{ Size int }
+		if err := h.adminRequest("PUT", "/volumes/"+name+"/size", map[string]string{"Size": "2GiB"}, &res); err != nil {
+			return err
+		}
+		if res.Size != 2<<30 {
+			return errors.Errorf("unexpected size %v", res.Size)
+		}
+		if err := h.expectQuota(name, 2<<30); err != nil {
+			return err
+		}
+		err := h.adminCall("PUT", "/volumes/"+name+"/size", map[string]string{"Size": "lots"})
+		if err = expectError(err, "invalid_request"); err != nil {
+			return err
+		}
+		return expectError(h.adminCall("PUT", "/volumes/missing1/size", map[string]string{"Size": "1GiB"}),
+			"not_found")
+	})
+
+	h.run("Admin API clones a snapshot into a writable volume and restores a volume from it", func() error {
+		const clone = "admin-clone1"
+		req := map[string]string{"Source": name, "Snapshot": "manual1"}
+		if err := h.adminCall("POST", "/volumes/"+clone+"/clone", req); err != nil {
+			return err
+		}
+		if err := expectError(h.adminCall("POST", "/volumes/"+clone+"/clone", req), "conflict"); err != nil {
+			return err
+		}
+		sourceDc, err := h.stateDc(name)
+		if err != nil {
+			return err
+		}
+		cloneDc, err := h.stateDc(clone)
+		if err != nil {
+			return err
+		}
+		if cloneDc.Id == sourceDc.Id {
+			return errors.Errorf("clone shares Data Container %v with its source", cloneDc.Name)
+		}
+		if err = h.expectMountOpts(clone, "nolock,vers=3,"+h.nfsPortOpts()); err != nil { // Writable
+			return err
+		}
+		if err = h.removeVolume(clone); err != nil {
+			return err
+		}
+
+		if _, err = h.mountVolume(name, "m1"); err != nil {
+			return err
+		}
+		err = expectError(h.adminCall("POST", "/volumes/"+name+"/restore", map[string]string{"Snapshot": "manual1"}),
+			"currently mounted")
+		if unmountErr := h.unmountVolume(name, "m1"); unmountErr != nil {
+			return unmountErr
+		}
+		if err != nil {
+			return err
+		}
+		err = h.adminCall("POST", "/volumes/"+name+"/restore", map[string]string{"Snapshot": "missing1"})
+		if err = expectError(err, "backend_error"); err != nil {
+			return err
+		}
+		if err = h.adminCall("POST", "/volumes/"+name+"/restore", map[string]string{"Snapshot": "manual1"}); err != nil {
+			return err
+		}
+		restoredDc, err := h.stateDc(name)
+		if err != nil {
+			return err
+		}
+		if restoredDc.Id == sourceDc.Id || restoredDc.Name != sourceDc.Name {
+			return errors.Errorf("unexpected Data Container after restore: %+v, was %+v", restoredDc, sourceDc)
+		}
+		if err = h.expectQuota(name, 2<<30); err != nil {
+			return err
+		}
+		if h.ems != nil {
+			for _, dc := range h.ems.DataContainers() {
+				if dc.Id == sourceDc.Id {
+					return errors.Errorf("replaced Data Container %v not deleted", dc.Name)
+				}
+			}
+		}
+		return nil
+	})
+
+	h.run("Admin API imports a Data Container", func() error {
+		err := h.adminCall("POST", "/volumes/imported1/import", map[string]string{"DataContainer": name})
+		if err = expectError(err, "conflict"); err != nil {
+			return err
+		}
+		err = h.adminCall("POST", "/volumes/imported1/import", map[string]string{"DataContainer": "missing1"})
+		if err = expectError(err, "not_found"); err != nil {
+			return err
+		}
+		if h.ems == nil {
+			return nil // Data Containers of the in-memory backend can only be created through the plugin
+		}
+
+		h.ems.AddDataContainer(fakeems.DataContainer{Name: "legacy1", PolicyId: 1, HardQuota: 1 << 30,
+			Description: "edvp.owner=e2e"})
+		if err = h.adminCall("POST", "/volumes/imported1/import", map[string]string{"DataContainer": "legacy1"}); err != nil {
+			return err
+		}
+		if err = h.expectEmsObjects("legacy1", true); err != nil {
+			return err
+		}
+		if _, err = h.mountVolume("imported1", "m1"); err != nil {
+			return err
+		}
+		if err = h.unmountVolume("imported1", "m1"); err != nil {
+			return err
+		}
+		if err = h.removeVolume("imported1"); err != nil {
+			return err
+		}
+		return h.expectEmsObjects("legacy1", false)
+	})
+
+	h.run("Admin API reconciles the state with EMS", func() error {
+		var res struct {
+			Findings []struct {
+				Volume string
+				Issue  string
+				Fixed  bool
+			}
+		}
+		if h.ems != nil {
+			for _, dc := range h.ems.DataContainers() {
+				if dc.Name == name {
+					dc.HardQuota, dc.SoftQuota = 3<<30, 3<<30
+					h.ems.UpdateDataContainer(dc)
+				}
+			}
+			if err := h.adminRequest("POST", "/reconcile", map[string]bool{"DryRun": true}, &res); err != nil {
+				return err
+			}
+			if len(res.Findings) != 1 || res.Findings[0].Issue != "dc_changed" || res.Findings[0].Fixed {
+				return errors.Errorf("unexpected dry-run findings: %+v", res.Findings)
+			}
+			if err := h.expectQuota(name, 2<<30); err != nil {
+				return err
+			}
+			if err := h.adminRequest("POST", "/reconcile", nil, &res); err != nil {
+				return err
+			}
+			if len(res.Findings) != 1 || !res.Findings[0].Fixed {
+				return errors.Errorf("unexpected findings: %+v", res.Findings)
+			}
+			if err := h.expectQuota(name, 3<<30); err != nil {
+				return err
+			}
+		}
+		if err := h.adminRequest("POST", "/reconcile", nil, &res); err != nil {
+			return err
+		}
+		if len(res.Findings) != 0 {
+			return errors.Errorf("unexpected findings after reconciliation: %+v", res.Findings)
+		}
+		return nil
+	})
+
+	h.run("Admin API collects garbage", func() error {
+		var res struct {
+			DryRun bool
+			Errors []string
+		}
+		if err := h.adminRequest("POST", "/gc", map[string]bool{"DryRun": true}, &res); err != nil {
+			return err
+		}
+		if !res.DryRun || len(res.Errors) != 0 {
+			return errors.Errorf("unexpected garbage collection report: %+v", res)
+		}
+		return h.removeVolume(name)
+	})
+}
+
+func (h *harness) runCtlScenario() {
+	const name = "ctl1"
+
+	h.run("edvpctl lists, inspects, snapshots, clones, restores and resizes volumes", func() error {
+		if err := h.createVolume(name, map[string]string{"size": "1GiB"}); err != nil {
+			return err
+		}
+		output, err := h.ctl("ls")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(output, "VOLUME") || !strings.Contains(output, name) {
+			return errors.Errorf("unexpected ls output: %v", output)
+		}
+		if output, err = h.ctl("inspect", name); err != nil {
+			return err
+		}
+		var inspect struct{ Name string }
+		if err = json.Unmarshal([]byte(output), &inspect); err != nil || inspect.Name != name {
+			return errors.Errorf("unexpected inspect output: %v", output)
+		}
+		if output, err = h.ctl("snapshot", name, "ctl-snap"); err != nil {
+			return err
+		}
+		if strings.TrimSpace(output) != "ctl-snap" {
+			return errors.Errorf("unexpected snapshot output: %v", output)
+		}
+		if output, err = h.ctl("resize", name, "2GiB"); err != nil {
+			return err
+		}
+		if strings.TrimSpace(output) != "2.0GiB" {
+			return errors.Errorf("unexpected resize output: %v", output)
+		}
+		if _, err = h.ctl("clone", name, "ctl-snap", "ctl-clone1"); err != nil {
+			return err
+		}
+		if err = expectError(h.ctlError("clone", name, "ctl-snap", "ctl-clone1"), "conflict"); err != nil {
+			return err
+		}
+		if err = h.removeVolume("ctl-clone1"); err != nil {
+			return err
+		}
+		if _, err = h.ctl("restore", "-snapshot", "ctl-snap", name); err != nil {
+			return err
+		}
+		if err = expectError(h.ctlError("restore", "-snapshot", "ctl-snap"), "expected"); err != nil {
+			return err
+		}
+		return expectError(h.ctlError("inspect", "missing1"), "not_found")
+	})
+
+	h.run("edvpctl reports orphans, collects garbage and reconciles", func() error {
+		for _, args := range [][]string{{"orphans"}, {"gc", "-dry-run"}, {"reconcile", "-dry-run"}, {"trash"}} {
+			if _, err := h.ctl(args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	h.run("edvpctl exports and imports the state", func() error {
+		exported := filepath.Join(h.dir, "exported-state.json")
+		if _, err := h.ctl("state", "export", "-o", exported); err != nil {
+			return err
+		}
+		if err := expectError(h.ctlError("state", "import", exported), "plugin is running"); err != nil {
+			return err
+		}
+		importDir := filepath.Join(h.dir, "imported")
+		if err := os.MkdirAll(importDir, 0755); err != nil {
+			return err
+		}
+		if _, err := h.ctl("state", "import", "-state-dir", importDir, exported); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(filepath.Join(importDir, "elastifile-state.json"))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(data), `"`+name+`"`) {
+			return errors.Errorf("volume %v missing in the imported state", name)
+		}
+		return h.removeVolume(name)
+	})
+
+	h.run("edvpctl validates the plugin configuration", func() error {
+		envFile := filepath.Join(h.dir, "plugin.env")
+		valid := "CRUD_IDEMPOTENT=false\nALLOW_FOREIGN_DELETE=false\nDEBUG=false\nSTORAGE_BACKEND=fake\nMOUNTER=fake\n"
+		if err := ioutil.WriteFile(envFile, []byte(valid), 0644); err != nil {
+			return err
+		}
+		if _, err := h.ctl("validate-config", "-env-file", envFile); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(envFile, []byte(valid+"MOUNT_RETRIES=-1\n"), 0644); err != nil {
+			return err
+		}
+		if err := expectError(h.ctlError("validate-config", "-env-file", envFile), "MOUNT_RETRIES"); err != nil {
+			return err
+		}
+		return expectError(h.ctlError("no-such-command"), "unknown command")
+	})
+}
+
+// gcReport is the admin API's garbage collection report
+type gcReport struct {
+	OrphanedDcs  []gcOrphan
+	OrphanedDirs []gcOrphan
+	Errors       []string
+}
+
+type gcOrphan struct {
+	Name      string
+	Collected bool
+}
+
+// findGcOrphan returns the orphan with the name
+func findGcOrphan(orphans []gcOrphan, name string) *gcOrphan {
+	for i := range orphans {
+		if orphans[i].Name == name {
+			return &orphans[i]
+		}
+	}
+	return nil
+}
+
+func (h *harness) gc(dryRun bool) (*gcReport, error) {
+	var report gcReport
+	if err := h.adminRequest("POST", "/gc", map[string]bool{"DryRun": dryRun}, &report); err != nil {
+		return nil, err
+	}
+	if len(report.Errors) != 0 {
+		return nil, errors.Errorf("garbage collection failed: %v", report.Errors)
+	}
+	return &report, nil
+}
+
+func (h *harness) runGcScenario() {
+	const name = "gc1"
+	strayDir := filepath.Join(h.dir, "volumes", "stray1")
+	strayDc := "stray-dc1"
+	foreignDc := "foreign-dc1"
+
+	h.run("Garbage collection finds orphans, sparing volumes and other instances' Data Containers", func() error {
+		if err := h.createVolume(name, nil); err != nil {
+			return err
+		}
+		if _, err := h.mountVolume(name, "m1"); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(strayDir, 0755); err != nil {
+			return err
+		}
+
+		if h.ems != nil {
+			// A Data Container of this instance left without Export, e.g. by a failed create
+			var description string
+			for _, dc := range h.ems.DataContainers() {
+				if dc.Name == name {
+					description = dc.Description
+				}
+			}
+			if !strings.Contains(description, "edvp.creator=") {
+				return errors.Errorf("Data Container %v isn't tagged with its creator: %v", name, description)
+			}
+			h.ems.AddDataContainer(fakeems.DataContainer{Name: strayDc, PolicyId: 1, HardQuota: 1 << 30,
+				Description: description})
+			// Same owner, created by another plugin instance
+			h.ems.AddDataContainer(fakeems.DataContainer{Name: foreignDc, PolicyId: 1, HardQuota: 1 << 30,
+				Description: "edvp.creator=otherhost/1234;edvp.owner=e2e"})
+		}
+
+		report, err := h.gc(true)
+		if err != nil {
+			return err
+		}
+		if orphan := findGcOrphan(report.OrphanedDirs, strayDir); orphan == nil || orphan.Collected {
+			return errors.Errorf("mount directory %v not reported as orphaned: %+v", strayDir, report.OrphanedDirs)
+		}
+		if orphan := findGcOrphan(report.OrphanedDirs, filepath.Join(h.dir, "volumes", name)); orphan != nil {
+			return errors.Errorf("mount directory of volume %v reported as orphaned", name)
+		}
+		if findGcOrphan(report.OrphanedDcs, name) != nil || findGcOrphan(report.OrphanedDcs, foreignDc) != nil {
+			return errors.Errorf("unexpected orphaned Data Containers: %+v", report.OrphanedDcs)
+		}
+		if h.ems != nil && findGcOrphan(report.OrphanedDcs, strayDc) == nil {
+			return errors.Errorf("Data Container %v not reported as orphaned: %+v", strayDc, report.OrphanedDcs)
+		}
+		if _, err = os.Stat(strayDir); err != nil {
+			return errors.Errorf("dry run removed %v: %v", strayDir, err)
+		}
+		return nil
+	})
+
+	h.run("Garbage collection collects orphans after the grace period", func() error {
+		time.Sleep(gcGracePeriod + 100*time.Millisecond)
+		report, err := h.gc(false)
+		if err != nil {
+			return err
+		}
+		if orphan := findGcOrphan(report.OrphanedDirs, strayDir); orphan == nil || !orphan.Collected {
+			return errors.Errorf("mount directory %v not collected: %+v", strayDir, report.OrphanedDirs)
+		}
+		if _, err = os.Stat(strayDir); !os.IsNotExist(err) {
+			return errors.Errorf("mount directory %v still exists: %v", strayDir, err)
+		}
+		if h.ems != nil {
+			if orphan := findGcOrphan(report.OrphanedDcs, strayDc); orphan == nil || !orphan.Collected {
+				return errors.Errorf("Data Container %v not collected: %+v", strayDc, report.OrphanedDcs)
+			}
+			var remaining []string
+			for _, dc := range h.ems.DataContainers() {
+				remaining = append(remaining, dc.Name)
+			}
+			if contains(remaining, strayDc) || !contains(remaining, foreignDc) || !contains(remaining, name) {
+				return errors.Errorf("unexpected Data Containers after garbage collection: %v", remaining)
+			}
+		}
+
+		// The volume survives garbage collection
+		if err = h.unmountVolume(name, "m1"); err != nil {
+			return err
+		}
+		if err = h.expectEmsObjects(name, true); err != nil {
+			return err
+		}
+		return h.removeVolume(name)
+	})
+}
+
+func (h *harness) runPersistenceScenario() {
+	if h.ems == nil {
+		return // The in-memory backend doesn't survive plugin restarts
+	}
+
+	h.run("Volumes survive plugin restart", func() error {
+		if err := h.createVolume(testVolume, nil); err != nil {
+			return err
+		}
+		h.stopPlugin()
+		if err := h.startPlugin(); err != nil {
+			return err
+		}
+		names, err := h.listVolumes()
+		if err != nil {
+			return err
+		}
+		if !contains(names, testVolume) {
+			return errors.Errorf("volume %v not listed after restart: %v", testVolume, names)
+		}
+		return h.removeVolume(testVolume)
+	})
+}
+
+// restartPluginWithState restarts the plugin with the state file's contents replaced by the data
+func (h *harness) restartPluginWithState(data []byte) error {
+	h.stopPlugin()
+	if err := ioutil.WriteFile(h.statePath, data, 0644); err != nil {
+		return err
+	}
+	return h.startPlugin()
+}
+
+func (h *harness) runStateScenario() {
+	names := []string{"state1", "state2"}
+	opts := map[string]string{"remove-if-exists": "true"} // The in-memory backend doesn't survive plugin restarts
+	var saved []byte
+
+	h.run("State file is replaced atomically, keeping a backup", func() error {
+		for _, name := range names {
+			if err := h.createVolume(name, opts); err != nil {
+				return err
+			}
+		}
+		state, err := h.stateVolumes()
+		if err != nil {
+			return err
+		}
+		if state[names[0]] == nil || state[names[1]] == nil {
+			return errors.Errorf("volumes %v missing in the state", names)
+		}
+		backup, err := ioutil.ReadFile(h.statePath + ".bak")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(backup), `"`+names[0]+`"`) || strings.Contains(string(backup), `"`+names[1]+`"`) {
+			return errors.Errorf("unexpected backup of the state: %s", backup)
+		}
+		if _, err = os.Stat(h.statePath + ".tmp"); !os.IsNotExist(err) {
+			return errors.Errorf("temporary state file left behind: %v", err)
+		}
+		saved, err = ioutil.ReadFile(h.statePath)
+		return err
+	})
+
+	h.run("Plugin recovers a corrupt state file from the backup", func() error {
+		if err := h.restartPluginWithState(saved[:len(saved)/2]); err != nil {
+			return err
+		}
+		listed, err := h.listVolumes()
+		if err != nil {
+			return err
+		}
+		if !contains(listed, names[0]) || contains(listed, names[1]) {
+			return errors.Errorf("unexpected volumes after recovery from the backup: %v", listed)
+		}
+		corrupt, err := filepath.Glob(h.statePath + ".corrupt-*")
+		if err != nil {
+			return err
+		}
+		if len(corrupt) != 1 {
+			return errors.Errorf("corrupt state file not moved aside: %v", corrupt)
+		}
+		return nil
+	})
+
+	h.run("Plugin migrates a state file of version 1", func() error {
+		var state struct{ Volumes map[string]json.RawMessage }
+		if err := json.Unmarshal(saved, &state); err != nil {
+			return err
+		}
+		v1, err := json.Marshal(state.Volumes)
+		if err != nil {
+			return err
+		}
+		if err = h.restartPluginWithState(v1); err != nil {
+			return err
+		}
+		listed, err := h.listVolumes()
+		if err != nil {
+			return err
+		}
+		if !contains(listed, names[0]) || !contains(listed, names[1]) {
+			return errors.Errorf("volumes %v missing after migration: %v", names, listed)
+		}
+		if _, err = h.stateVolumes(); err != nil { // Migrated state is saved right away
+			return err
+		}
+		backup, err := ioutil.ReadFile(h.statePath + ".bak")
+		if err != nil {
+			return err
+		}
+		if string(backup) != string(v1) {
+			return errors.Errorf("state of version 1 not kept as the backup: %s", backup)
+		}
+		for _, name := range names {
+			if err = h.removeVolume(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	h.run("State of a newer version is refused", func() error {
+		newer := filepath.Join(h.dir, "newer-state.json")
+		if err := ioutil.WriteFile(newer, []byte(`{"Version":3,"Volumes":{}}`), 0644); err != nil {
+			return err
+		}
+		return expectError(h.ctlError("state", "import", "-state-dir", h.dir, newer), "newer than the supported")
+	})
+}
+
+func (h *harness) runFaultScenario() {
+	h.run("EMS failure is reported to Docker", func() error {
+		h.ems.SetFaults(fakeems.Faults{FailPath: "/api/data_containers", FailStatus: 503, FailCount: 100})
+		err := expectError(h.createVolume(testVolume, nil), "")
+		h.ems.SetFaults(fakeems.Faults{})
+		if err != nil {
+			return err
+		}
+		names, err := h.listVolumes()
+		if err != nil {
+			return err
+		}
+		if contains(names, testVolume) {
+			return errors.Errorf("failed volume %v is listed", testVolume)
+		}
+		return nil
+	})
+
+	h.run("Create succeeds once EMS recovers", func() error {
+		if err := h.createVolume(testVolume, nil); err != nil {
+			return err
+		}
+		return h.removeVolume(testVolume)
+	})
+}
+
+// expectQuota verifies the hard quota of the volume's Data Container in the plugin's state
+func (h *harness) expectQuota(name string, quota int) error {
+	state, err := h.stateVolumes()
+	if err != nil {
+		return err
+	}
+	var v struct {
+		DataContainer struct {
+			HardQuota int `json:"hard_quota"`
+		}
+	}
+	if err = json.Unmarshal(state[name], &v); err != nil {
+		return err
+	}
+	if v.DataContainer.HardQuota != quota {
+		return errors.Errorf("unexpected quota of %v: %v, expected %v", name, v.DataContainer.HardQuota, quota)
+	}
+	return nil
+}
+
+// stateDc returns the volume's Data Container in the state file
+func (h *harness) stateDc(name string) (dc struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}, err error) {
+	state, err := h.stateVolumes()
+	if err != nil {
+		return dc, err
+	}
+	var v struct {
+		DataContainer json.RawMessage
+	}
+	if err = json.Unmarshal(state[name], &v); err != nil {
+		return dc, err
+	}
+	return dc, json.Unmarshal(v.DataContainer, &dc)
+}
+
+// expectEmsObjects verifies existence of the DC and its export on the fake EMS
+// expectMountOpts compares the volume's mount options regardless of order, as Docker passes the options as a map
+func (h *harness) expectMountOpts(name string, expected string) error {
+	state, err := h.stateVolumes()
+	if err != nil {
+		return err
+	}
+	var v struct{ MountOpts []string }
+	if err = json.Unmarshal(state[name], &v); err != nil {
+		return err
+	}
+	sort.Strings(v.MountOpts)
+	expectedOpts := strings.Split(expected, ",")
+	sort.Strings(expectedOpts)
+	if strings.Join(v.MountOpts, ",") != strings.Join(expectedOpts, ",") {
+		return errors.Errorf("unexpected mount options of %v: %v, expected %v", name, v.MountOpts, expected)
+	}
+	return nil
+}
+
+func (h *harness) expectEmsObjects(dcName string, exist bool) error {
+	if h.ems == nil {
+		return nil
+	}
+
+	var dc *fakeems.DataContainer
+	for _, candidate := range h.ems.DataContainers() {
+		if candidate.Name == dcName {
+			candidate := candidate
+			dc = &candidate
+		}
+	}
+	if (dc != nil) != exist {
+		return errors.Errorf("Data Container %v exists: %v, expected %v", dcName, dc != nil, exist)
+	}
+	if dc == nil {
+		return nil
+	}
+
+	for _, export := range h.ems.Exports() {
+		if export.DataContainerId == dc.Id {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Data Container %v has no export", dcName))
+}
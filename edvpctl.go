@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// edvpctl is the plugin's companion CLI. It's built into the plugin binary and runs when invoked as edvpctl, e.g. via
+// a symlink (see the edvpctl target of the Makefile). Most commands talk to the admin API of a running plugin, on its
+// unix socket or over TLS. ems-ls, validate-config and state import work without a running plugin.
+
+const (
+	ctlName          = "edvpctl"
+	defaultCtlSocket = "/var/lib/docker/plugins/" + adminSocketName
+	ctlTokenEnvVar   = "EDVP_ADMIN_TOKEN"
+)
+
+type ctlCommand struct {
+	name    string
+	args    string
+	summary string
+	run     func(c *ctl, args []string) error
+}
+
+var ctlCommands = []ctlCommand{
+	{"ls", "", "List volumes with their usage", (*ctl).list},
+	{"inspect", "<volume>", "Show a volume's state and status", (*ctl).inspect},
+	{"snapshot", "<volume> [snapshot]", "Snapshot a volume's Data Container", (*ctl).snapshot},
+	{"clone", "<source volume> <snapshot> <volume>", "Create a writable volume of a snapshot", (*ctl).clone},
+	{"trash", "", "List removed volumes kept in retention mode", (*ctl).trash},
+	{"restore", "<trashed Data Container> [volume] | -snapshot <snapshot> <volume>",
+		"Restore a removed volume, or a volume's data from a snapshot", (*ctl).restore},
+	{"resize", "<volume> <size>", "Change a volume's quota, e.g. to 20GiB", (*ctl).resize},
+	{"import", "[-o mount options] <Data Container> <volume>", "Import an existing Data Container as a volume",
+		(*ctl).importDc},
+	{"orphans", "", "Find orphaned mounts and garbage the plugin would collect", (*ctl).orphans},
+	{"gc", "[-dry-run]", "Collect garbage, i.e. purge expired trash and orphans", (*ctl).gc},
+	{"reconcile", "[-dry-run]", "Reconcile the plugin state with EMS", (*ctl).reconcile},
+	{"ems-ls", "[-owner id | -all]", "List plugin-owned Data Containers directly on EMS", (*ctl).emsList},
+	{"validate-config", "[-env-file file] [-ems]", "Validate the plugin configuration", (*ctl).validateConfig},
+	{"state", "export [-o file] | import [-state-dir dir] [-force] <file>", "Export or import the plugin state",
+		(*ctl).state},
+}
+
+type ctl struct {
+	socket     string
+	address    string
+	token      string
+	caCert     string
+	clientCert string
+	clientKey  string
+	jsonOutput bool
+
+	out io.Writer
+}
+
+// isCtlInvocation tells whether the binary was invoked as the CLI rather than as the plugin
+func isCtlInvocation() bool {
+	return strings.HasPrefix(filepath.Base(os.Args[0]), ctlName)
+}
+
+// runCtl runs the CLI and returns its exit code
+func runCtl(args []string) int {
+	logrus.SetOutput(os.Stderr)
+	logrus.SetLevel(logrus.WarnLevel)
+
+	c := &ctl{out: os.Stdout}
+	flags := flag.NewFlagSet(ctlName, flag.ContinueOnError)
+	flags.StringVar(&c.socket, "socket", defaultCtlSocket, "Admin API unix socket")
+	flags.StringVar(&c.address, "address", "", "Admin API TLS address, e.g. docker-host1:9443, instead of the socket")
+	flags.StringVar(&c.token, "token", os.Getenv(ctlTokenEnvVar), "Admin API token, defaults to $"+ctlTokenEnvVar)
+	flags.StringVar(&c.caCert, "cacert", "", "CA certificates (PEM) to verify the admin API's TLS certificate")
+	flags.StringVar(&c.clientCert, "cert", "", "Client certificate (PEM) for the admin API's TLS listener")
+	flags.StringVar(&c.clientKey, "key", "", "Client private key (PEM) for the admin API's TLS listener")
+	flags.BoolVar(&c.jsonOutput, "json", false, "Print responses as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v [options] <command> [arguments]\n\nCommands:\n", ctlName)
+		w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		for _, cmd := range ctlCommands {
+			fmt.Fprintf(w, "  %v %v\t%v\n", cmd.name, cmd.args, cmd.summary)
+		}
+		w.Flush()
+		fmt.Fprintln(os.Stderr, "\nOptions:")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	name := flags.Arg(0)
+	for _, cmd := range ctlCommands {
+		if cmd.name != name {
+			continue
+		}
+		if err := cmd.run(c, flags.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v %v: %v\n", ctlName, name, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%v: unknown command %v\n", ctlName, name)
+	flags.Usage()
+	return 2
+}
+
+// parseCtlArgs parses the command's flags and verifies the number of its positional arguments
+func parseCtlArgs(flags *flag.FlagSet, args []string, minArgs int, maxArgs int) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() < minArgs || flags.NArg() > maxArgs {
+		return nil, errors.Errorf("expected %v to %v arguments, got %v", minArgs, maxArgs, flags.NArg())
+	}
+	return flags.Args(), nil
+}
+
+func (c *ctl) httpClient() (*http.Client, string, error) {
+	if c.address == "" {
+		return &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", c.socket)
+				},
+			},
+			Timeout: 5 * time.Minute,
+		}, "http://edvp", nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.caCert != "" {
+		caPem, err := ioutil.ReadFile(c.caCert)
+		if err != nil {
+			return nil, "", errors.WrapPrefix(err, "Failed to read CA certificates", 0)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, "", errors.Errorf("No certificates found in %v", c.caCert)
+		}
+	}
+	if c.clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.clientCert, c.clientKey)
+		if err != nil {
+			return nil, "", errors.WrapPrefix(err, "Failed to load client certificate", 0)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   5 * time.Minute,
+	}, "https://" + c.address, nil
+}
+
+// call sends a request to the admin API and decodes the response into res, unless it's nil
+func (c *ctl) call(method string, path string, req interface{}, res interface{}) error {
+	client, baseUrl, err := c.httpClient()
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	httpReq, err := http.NewRequest(method, baseUrl+path, body)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to reach the admin API - is the plugin enabled?", 0)
+	}
+	defer httpRes.Body.Close()
+
+	data, err := ioutil.ReadAll(httpRes.Body)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read admin API response", 0)
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		var errRes adminResponse
+		if json.Unmarshal(data, &errRes) == nil && errRes.Err != "" {
+			return errors.Errorf("%v (%v)", errRes.Err, errRes.Code)
+		}
+		return errors.Errorf("%v %v returned %v", method, path, httpRes.Status)
+	}
+	if res != nil {
+		return json.Unmarshal(data, res)
+	}
+	return nil
+}
+
+func (c *ctl) printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, string(data))
+	return err
+}
+
+// printTable prints the rows aligned in columns under the header
+func (c *ctl) printTable(header string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// formatBytes renders a number of bytes in binary units, e.g. 1.5GiB
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 || bytes >= 100 {
+		return fmt.Sprintf("%.0f%v", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f%v", bytes, units[unit])
+}
+
+func (c *ctl) list(args []string) error {
+	if _, err := parseCtlArgs(flag.NewFlagSet("ls", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+
+	var state struct{ Volumes map[string]*elastifileVolume }
+	if err := c.call(http.MethodGet, adminStatePath, nil, &state); err != nil {
+		return err
+	}
+	var names []string
+	for name := range state.Volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := map[string]map[string]interface{}{}
+	for _, name := range names {
+		var res inspectResponse
+		if err := c.call(http.MethodGet, adminVolumesPath+name, nil, &res); err != nil {
+			return err
+		}
+		statuses[name] = res.Status
+	}
+	if c.jsonOutput {
+		return c.printJSON(statuses)
+	}
+
+	var rows [][]string
+	for _, name := range names {
+		v, status := state.Volumes[name], statuses[name]
+		kind, dcName := "dc", ""
+		switch {
+		case v.Snapshot != "":
+			kind = "snapshot of " + v.snapshotSource()
+		case v.Parent != "":
+			kind = "subdir of " + v.Parent
+		}
+		if v.DataContainer != nil {
+			dcName = v.DataContainer.Name
+		}
+		quota, used, usedPercent := "-", "-", "-"
+		if value, ok := status["HardQuota"].(float64); ok && value > 0 {
+			quota = formatBytes(value)
+		}
+		if value, ok := status["UsedCapacity"].(float64); ok {
+			used = formatBytes(value)
+		}
+		if value, ok := status["UsedPercent"].(float64); ok {
+			usedPercent = fmt.Sprintf("%.0f%%", value)
+		}
+		mounts := 0
+		if ids, ok := status["ActiveMounts"].([]interface{}); ok {
+			mounts = len(ids)
+		}
+		rows = append(rows, []string{name, kind, dcName, quota, used, usedPercent, fmt.Sprint(mounts),
+			fmt.Sprint(v.Protected)})
+	}
+	return c.printTable("VOLUME\tTYPE\tDATA CONTAINER\tSIZE\tUSED\tUSE%\tMOUNTS\tPROTECTED", rows)
+}
+
+func (c *ctl) inspect(args []string) error {
+	args, err := parseCtlArgs(flag.NewFlagSet("inspect", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	var res inspectResponse
+	if err = c.call(http.MethodGet, adminVolumesPath+args[0], nil, &res); err != nil {
+		return err
+	}
+	return c.printJSON(res)
+}
+
+func (c *ctl) snapshot(args []string) error {
+	args, err := parseCtlArgs(flag.NewFlagSet("snapshot", flag.ContinueOnError), args, 1, 2)
+	if err != nil {
+		return err
+	}
+	req := snapshotRequest{}
+	if len(args) == 2 {
+		req.Snapshot = args[1]
+	}
+	var res snapshotResponse
+	if err = c.call(http.MethodPost, adminVolumesPath+args[0]+"/snapshot", req, &res); err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		return c.printJSON(res)
+	}
+	fmt.Fprintln(c.out, res.Snapshot)
+	return nil
+}
+
+func (c *ctl) clone(args []string) error {
+	args, err := parseCtlArgs(flag.NewFlagSet("clone", flag.ContinueOnError), args, 3, 3)
+	if err != nil {
+		return err
+	}
+	req := cloneRequest{Source: args[0], Snapshot: args[1]}
+	if err = c.call(http.MethodPost, adminVolumesPath+args[2]+"/clone", req, nil); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, args[2])
+	return nil
+}
+
+func (c *ctl) trash(args []string) error {
+	if _, err := parseCtlArgs(flag.NewFlagSet("trash", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	var res trashListResponse
+	if err := c.call(http.MethodGet, adminTrashPath, nil, &res); err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		return c.printJSON(res.Entries)
+	}
+	var rows [][]string
+	for _, entry := range res.Entries {
+		rows = append(rows, []string{entry.DcName, entry.Volume, entry.TrashedAt.Format(time.RFC3339)})
+	}
+	return c.printTable("DATA CONTAINER\tVOLUME\tREMOVED", rows)
+}
+
+func (c *ctl) restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	snapshot := flags.String("snapshot", "", "Restore the volume's data from the snapshot, replacing its Data Container")
+	args, err := parseCtlArgs(flags, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	if *snapshot != "" {
+		if len(args) != 1 {
+			return errors.New("expected the volume to restore from the snapshot")
+		}
+		return c.call(http.MethodPost, adminVolumesPath+args[0]+"/restore", restoreSnapshotRequest{Snapshot: *snapshot},
+			nil)
+	}
+	req := restoreRequest{}
+	if len(args) == 2 {
+		req.Name = args[1]
+	}
+	return c.call(http.MethodPost, adminTrashPath+"/"+args[0]+"/restore", req, nil)
+}
+
+func (c *ctl) resize(args []string) error {
+	args, err := parseCtlArgs(flag.NewFlagSet("resize", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	var res resizeResponse
+	if err = c.call(http.MethodPut, adminVolumesPath+args[0]+"/size", resizeRequest{Size: args[1]}, &res); err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		return c.printJSON(res)
+	}
+	fmt.Fprintln(c.out, formatBytes(float64(res.Size)))
+	return nil
+}
+
+func (c *ctl) importDc(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	mountOpts := flags.String("o", "", "Mount options, comma separated, as specified on create")
+	args, err := parseCtlArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	req := importRequest{DataContainer: args[0], MountOpts: parseMountOptions(*mountOpts)}
+	if err = c.call(http.MethodPost, adminVolumesPath+args[1]+"/import", req, nil); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, args[1])
+	return nil
+}
+
+func (c *ctl) orphans(args []string) error {
+	if _, err := parseCtlArgs(flag.NewFlagSet("orphans", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	var orphans orphansResponse
+	if err := c.call(http.MethodGet, adminOrphansPath, nil, &orphans); err != nil {
+		return err
+	}
+	var report gcReport
+	if err := c.call(http.MethodPost, adminGcPath, dryRunRequest{DryRun: true}, &report); err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		return c.printJSON(map[string]interface{}{"Orphans": orphans.Orphans, "Garbage": report})
+	}
+
+	var rows [][]string
+	for name, orphan := range orphans.Orphans {
+		rows = append(rows, []string{"mount", name, orphan.Since.Format(time.RFC3339), orphan.Error})
+	}
+	for _, entry := range report.Trash {
+		rows = append(rows, []string{"expired trash", entry.DcName, entry.TrashedAt.Format(time.RFC3339), ""})
+	}
+	for _, orphan := range report.OrphanedDcs {
+		rows = append(rows, []string{"data container", orphan.Name, orphan.FirstSeen.Format(time.RFC3339), orphan.Details})
+	}
+	for _, orphan := range report.OrphanedDirs {
+		rows = append(rows, []string{"mount directory", orphan.Name, orphan.FirstSeen.Format(time.RFC3339), orphan.Details})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0]+rows[i][1] < rows[j][0]+rows[j][1] })
+	return c.printTable("KIND\tNAME\tSINCE\tDETAILS", rows)
+}
+
+func (c *ctl) gc(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Report only")
+	if _, err := parseCtlArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	var report gcReport
+	if err := c.call(http.MethodPost, adminGcPath, dryRunRequest{DryRun: *dryRun}, &report); err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		return c.printJSON(report)
+	}
+
+	status := "collected"
+	if report.DryRun {
+		status = "found"
+	}
+	var rows [][]string
+	for _, entry := range report.Trash {
+		rows = append(rows, []string{"expired trash", entry.DcName, status})
+	}
+	for _, name := range report.OrphanedMounts {
+		rows = append(rows, []string{"orphaned mount", name, status})
+	}
+	for _, orphan := range report.OrphanedDcs {
+		rows = append(rows, []string{"orphaned data container", orphan.Name, gcOrphanStatus(orphan, report.DryRun)})
+	}
+	for _, orphan := range report.OrphanedDirs {
+		rows = append(rows, []string{"orphaned mount directory", orphan.Name, gcOrphanStatus(orphan, report.DryRun)})
+	}
+	if err := c.printTable("KIND\tNAME\tSTATUS", rows); err != nil {
+		return err
+	}
+	if len(report.Errors) > 0 {
+		return errors.Errorf("failed to collect some garbage:\n%v", strings.Join(report.Errors, "\n"))
+	}
+	return nil
+}
+
+// gcOrphanStatus tells what garbage collection did with the orphan
+func gcOrphanStatus(orphan gcOrphan, dryRun bool) string {
+	switch {
+	case orphan.Collected:
+		return "collected"
+	case dryRun:
+		return "found"
+	default:
+		return "kept - " + orphan.Details
+	}
+}
+
+func (c *ctl) reconcile(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Report only")
+	if _, err := parseCtlArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	var res reconcileResponse
+	if err := c.call(http.MethodPost, adminReconcilePath, dryRunRequest{DryRun: *dryRun}, &res); err != nil {
+		return err
+	}
+	if c.jsonOutput {
+		return c.printJSON(res)
+	}
+	var rows [][]string
+	for _, f := range res.Findings {
+		rows = append(rows, []string{f.Volume, f.DataContainer, f.Issue, f.Details, fmt.Sprint(f.Fixed)})
+	}
+	return c.printTable("VOLUME\tDATA CONTAINER\tISSUE\tDETAILS\tFIXED", rows)
+}
+
+// emsList lists Data Containers directly on EMS, using the EMS settings of the plugin (MGMT_ADDRESS, MGMT_USERNAME
+// and MGMT_PASSWORD) from the environment
+func (c *ctl) emsList(args []string) error {
+	flags := flag.NewFlagSet("ems-ls", flag.ContinueOnError)
+	owner := flags.String("owner", os.Getenv("OWNER_ID"), "Owner ID, defaults to $OWNER_ID")
+	all := flags.Bool("all", false, "List the Data Containers of all plugin instances")
+	if _, err := parseCtlArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if *owner == "" && !*all {
+		return errors.New("specify -owner, OWNER_ID or -all")
+	}
+	if os.Getenv("MGMT_ADDRESS") == "" {
+		return errors.New("MGMT_ADDRESS, MGMT_USERNAME and MGMT_PASSWORD are required")
+	}
+	driverInfo.RestAddr = os.Getenv("MGMT_ADDRESS")
+	driverInfo.RestUser = os.Getenv("MGMT_USERNAME")
+	driverInfo.RestPass = os.Getenv("MGMT_PASSWORD")
+
+	dcs, err := Ems.allDcs(context.Background())
+	if err != nil {
+		return err
+	}
+	var owned []emanage.DataContainer
+	for _, dc := range dcs {
+		dcOwner := parseDcMetadata(dc.Description).Owner()
+		if dcOwner != "" && (*all || dcOwner == *owner) {
+			owned = append(owned, dc)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].Name < owned[j].Name })
+	if c.jsonOutput {
+		return c.printJSON(owned)
+	}
+
+	var rows [][]string
+	for _, dc := range owned {
+		meta := parseDcMetadata(dc.Description)
+		state := "active"
+		if meta.Get(dcMetaTrashedAt) != "" {
+			state = "trashed"
+		}
+		rows = append(rows, []string{dc.Name, fmt.Sprint(dc.Id), meta.Owner(), formatBytes(float64(dc.HardQuota)),
+			formatBytes(float64(dc.UsedCapacity)), state})
+	}
+	return c.printTable("DATA CONTAINER\tID\tOWNER\tSIZE\tUSED\tSTATE", rows)
+}
+
+// validateConfig validates the plugin settings in the environment or in an env file, e.g. the output of
+// docker plugin inspect -f '{{range .Settings.Env}}{{println .}}{{end}}' elastifileio/edvp
+func (c *ctl) validateConfig(args []string) error {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	envFile := flags.String("env-file", "", "File of KEY=VALUE lines")
+	checkEms := flags.Bool("ems", false, "Log into EMS and look up the Data Containers")
+	if _, err := parseCtlArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	if *envFile != "" {
+		if err := loadEnvFile(*envFile); err != nil {
+			return err
+		}
+	}
+	initFromEnv() // Exits on invalid values
+
+	var problems []string
+	if driverInfo.StorageBackend == storageBackendEms || driverInfo.StorageBackend == "" {
+		for _, name := range []string{"MGMT_ADDRESS", "MGMT_USERNAME", "MGMT_PASSWORD", "NFS_ADDRESS"} {
+			if os.Getenv(name) == "" {
+				problems = append(problems, name+" is required")
+			}
+		}
+	} else if _, ok := storageBackends[driverInfo.StorageBackend]; !ok {
+		problems = append(problems, "unsupported STORAGE_BACKEND "+driverInfo.StorageBackend)
+	}
+	if _, err := newMounter(driverInfo.Mounter); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := newMountOptionPolicy(driverInfo.DefaultMountOpts, driverInfo.AllowedMountOpts,
+		driverInfo.DeniedMountOpts); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, path := range []string{driverInfo.AdminTlsCert, driverInfo.AdminTlsKey, driverInfo.AdminTlsClientCa} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration:\n%v", strings.Join(problems, "\n"))
+	}
+
+	if *checkEms {
+		dcs, err := Ems.allDcs(context.Background())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Logged into EMS at %v, found %v Data Containers\n", driverInfo.RestAddr, len(dcs))
+	}
+	fmt.Fprintln(c.out, "Configuration is valid")
+	return nil
+}
+
+func loadEnvFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to open env file", 0)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("Malformed line in env file: %v", line)
+		}
+		os.Setenv(kv[0], kv[1])
+	}
+	return scanner.Err()
+}
+
+func (c *ctl) state(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected export or import")
+	}
+	switch args[0] {
+	case "export":
+		return c.exportState(args[1:])
+	case "import":
+		return c.importState(args[1:])
+	default:
+		return errors.Errorf("unknown state command %v", args[0])
+	}
+}
+
+// exportState writes the state of the running plugin in the format of its state file
+func (c *ctl) exportState(args []string) error {
+	flags := flag.NewFlagSet("state export", flag.ContinueOnError)
+	output := flags.String("o", "", "Output file, defaults to stdout")
+	if _, err := parseCtlArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	var state struct{ Volumes map[string]*elastifileVolume }
+	if err := c.call(http.MethodGet, adminStatePath, nil, &state); err != nil {
+		return err
+	}
+	if *output == "" {
+		return c.printJSON(stateFile{Version: stateVersion, Volumes: state.Volumes})
+	}
+	data, err := encodeState(state.Volumes)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(*output, data); err != nil {
+		return errors.WrapPrefix(err, "Failed to write "+*output, 0)
+	}
+	return nil
+}
+
+// importState replaces the state file of a disabled plugin, keeping the previous one as <state file>.pre-import
+func (c *ctl) importState(args []string) error {
+	flags := flag.NewFlagSet("state import", flag.ContinueOnError)
+	stateDir := flags.String("state-dir", filepath.Dir(c.socket), "Plugin state directory")
+	force := flags.Bool("force", false, "Import even though the plugin seems to be running")
+	args, err := parseCtlArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := loadStateFile(args[0])
+	if err != nil {
+		return err
+	}
+	if volumes == nil {
+		return errors.Errorf("%v not found", args[0])
+	}
+
+	if conn, err := net.Dial("unix", filepath.Join(*stateDir, adminSocketName)); err == nil {
+		conn.Close()
+		if !*force {
+			return errors.New("the plugin is running and would overwrite the imported state - " +
+				"disable it first, or use -force")
+		}
+	}
+
+	statePath := filepath.Join(*stateDir, stateFileName)
+	if data, err := ioutil.ReadFile(statePath); err == nil {
+		if err = ioutil.WriteFile(statePath+".pre-import", data, 0644); err != nil {
+			return errors.WrapPrefix(err, "Failed to back up the current state", 0)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.WrapPrefix(err, "Failed to read the current state", 0)
+	}
+	if err = writeStateFile(statePath, volumes); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Imported %v volumes into %v\n", len(volumes), statePath)
+	return nil
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"path"
 	"regexp"
+	"sync"
 
 	"github.com/go-errors/errors"
 	"github.com/sirupsen/logrus"
@@ -15,6 +17,8 @@ import (
 )
 
 type EmsWrapper struct {
+	sync.Mutex // Guards the session, as volume operations run concurrently
+
 	client             *emanage.Client // Do not access this field directly, use Client() instead
 	sessionInitialized bool
 }
@@ -25,11 +29,19 @@ const (
 	optionsUserMappingType = "user-mapping-type" // Supported values: no_mapping, remap_root, remap_all
 	optionsUserMappingUid  = "user-mapping-uid"
 	optionsUserMappingGid  = "user-mapping-gid"
+	optionsForce           = "force"            // Allow deleting Data Containers not owned by this plugin instance
+	optionsProtect         = "protect"          // Refuse deleting the volume
+	optionsPolicy          = "policy"           // Data Container policy name, the default policy is used if not specified
+	optionsIfNotExists     = "if-not-exists"    // Per-volume override of CRUD_IDEMPOTENT for create
+	optionsRemoveIfExists  = "remove-if-exists" // Per-volume override of CRUD_IDEMPOTENT for remove
+	optionsParent          = "parent"           // Create a sub-directory volume inside the Data Container of this volume
+	optionsSubdir          = "subdir"           // Path of the sub-directory volume, defaults to the volume name
+	optionsSnapshotOf      = "snapshot-of"      // Create a read-only volume of a snapshot of this volume
+	optionsSnapshot        = "snapshot"         // Name of the snapshot, used with snapshot-of
 	defaultExportName      = "root"
 )
 
 // TODO: take default volume size from env
-// TODO: Take default mount options from env
 var (
 	Ems               EmsWrapper // Keep global to be reachable from ExportPath()
 	defaultVolumeSize = 100 * size.GiB
@@ -63,6 +75,8 @@ func (ems *EmsWrapper) initSession(details driverDetails) (client *emanage.Clien
 
 // Client is used to cache EMS login
 func (ems *EmsWrapper) Client() (*emanage.Client, error) {
+	ems.Lock()
+	defer ems.Unlock()
 	if !ems.sessionInitialized {
 		client, err := ems.initSession(driverInfo)
 		if err != nil {
@@ -75,8 +89,15 @@ func (ems *EmsWrapper) Client() (*emanage.Client, error) {
 }
 
 func (ems *EmsWrapper) defaultDcCreateOpts(name string) *emanage.DcCreateOpts {
+	meta := newDcMetadata()
+	meta.Set(dcMetaOwner, driverInfo.OwnerId)
+	if driverInfo.InstanceId != "" {
+		meta.Set(dcMetaCreator, driverInfo.InstanceId)
+	}
+
 	return &emanage.DcCreateOpts{
 		Name:           name,
+		Description:    meta.String(),
 		DirPermissions: 777,
 		Dedup:          0,
 		Compression:    1,
@@ -97,7 +118,14 @@ func (ems *EmsWrapper) defaultDcExportCreateOpts(name string) (*emanage.DcCreate
 	return ems.defaultDcCreateOpts(name), ems.defaultExportCreateOpts()
 }
 
-func (ems *EmsWrapper) defaultPolicy() (policy emanage.Policy, err error) {
+// copyUserMapping sets the user mapping of the export options to the one of the export
+func copyUserMapping(exportOpts *emanage.ExportCreateOpts, export *emanage.Export) {
+	exportOpts.UserMapping = export.UserMapping
+	exportOpts.Uid = optional.NewInt(export.Uid)
+	exportOpts.Gid = optional.NewInt(export.Gid)
+}
+
+func (ems *EmsWrapper) defaultPolicy(ctx context.Context) (policy emanage.Policy, err error) {
 	if ems == nil {
 		err = errors.New("Got nil EMS client")
 		return
@@ -132,20 +160,71 @@ func (ems *EmsWrapper) defaultPolicy() (policy emanage.Policy, err error) {
 	return
 }
 
-func (ems *EmsWrapper) CreateDc(opts *emanage.DcCreateOpts) (dcRef *emanage.DataContainer, err error) {
+// policyByName returns the policy by its name, or the default policy if the name is empty
+func (ems *EmsWrapper) policyByName(ctx context.Context, name string) (policy emanage.Policy, err error) {
+	if name == "" {
+		return ems.defaultPolicy(ctx)
+	}
+
+	emsClient, err := ems.Client()
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
+		return
+	}
+
+	policies, err := emsClient.Policies.GetAll(nil)
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to get policies from EMS", 0)
+		return
+	}
+
+	for i := range policies {
+		if policies[i].Name == name {
+			return policies[i], nil
+		}
+	}
+
+	err = errors.Errorf("Policy %v not found", name)
+	return
+}
+
+func (ems *EmsWrapper) policyById(ctx context.Context, id int) (policy emanage.Policy, err error) {
+	emsClient, err := ems.Client()
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
+		return
+	}
+
+	policies, err := emsClient.Policies.GetAll(nil)
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to get policies from EMS", 0)
+		return
+	}
+
+	for i := range policies {
+		if policies[i].Id == id {
+			return policies[i], nil
+		}
+	}
+
+	err = errors.Errorf("Policy %v not found", id)
+	return
+}
+
+func (ems *EmsWrapper) CreateDc(ctx context.Context, opts *emanage.DcCreateOpts, policyName string) (
+	dcRef *emanage.DataContainer, err error) {
 	name := legalVolumeName(opts.Name)
 
-	// TODO: Support non-default policies via command line options and only use the default one if no policy was specified
-	policy, err := ems.defaultPolicy()
+	policy, err := ems.policyByName(ctx, policyName)
 	if err != nil {
 		err = errors.WrapPrefix(err, fmt.Sprintf("Failed to get policy for volume %s", opts.Name), 0)
 		return
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"name":     name,
-		"policyId": policy.Id,
-		"opts":     opts,
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: name,
+		"policy_id":    policy.Id,
+		"opts":         opts,
 	}).Debug("Creating Data Container")
 
 	emsClient, err := ems.Client()
@@ -164,27 +243,50 @@ func (ems *EmsWrapper) CreateDc(opts *emanage.DcCreateOpts) (dcRef *emanage.Data
 	return
 }
 
-func (ems *EmsWrapper) CreateExport(name string, opts *emanage.ExportCreateOpts) (export emanage.Export, err error) {
+func (ems *EmsWrapper) CreateExport(ctx context.Context, name string, opts *emanage.ExportCreateOpts) (
+	export emanage.Export, err error) {
 	emsClient, err := ems.Client()
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
 		return
 	}
 
-	logrus.Debug(fmt.Sprintf("Creating export %+v", opts))
+	loggerFrom(ctx).Debug(fmt.Sprintf("Creating export %+v", opts))
 	return emsClient.Exports.Create(name, opts)
 }
 
-func (ems *EmsWrapper) dcExists(dcName string) (exists bool, dcRef *emanage.DataContainer, err error) {
+func (ems *EmsWrapper) allDcs(ctx context.Context) (dcs []emanage.DataContainer, err error) {
 	emsClient, err := ems.Client()
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
 		return
 	}
 
-	dcs, err := emsClient.DataContainers.GetAll(nil)
+	dcs, err = emsClient.DataContainers.GetAll(nil)
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to get Data Containers", 0)
+	}
+	return
+}
+
+func (ems *EmsWrapper) allExports(ctx context.Context) (exports []emanage.Export, err error) {
+	emsClient, err := ems.Client()
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
+		return
+	}
+
+	exports, err = emsClient.Exports.GetAll(nil)
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to get Exports", 0)
+	}
+	return
+}
+
+func (ems *EmsWrapper) dcExists(ctx context.Context, dcName string) (
+	exists bool, dcRef *emanage.DataContainer, err error) {
+	dcs, err := ems.allDcs(ctx)
+	if err != nil {
 		return
 	}
 	for _, dc := range dcs {
@@ -197,7 +299,8 @@ func (ems *EmsWrapper) dcExists(dcName string) (exists bool, dcRef *emanage.Data
 	return
 }
 
-func (ems *EmsWrapper) exportExists(exportName string, dcId int) (exists bool, exportRef *emanage.Export, err error) {
+func (ems *EmsWrapper) exportExists(ctx context.Context, exportName string, dcId int) (
+	exists bool, exportRef *emanage.Export, err error) {
 	emsClient, err := ems.Client()
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
@@ -219,51 +322,83 @@ func (ems *EmsWrapper) exportExists(exportName string, dcId int) (exists bool, e
 	return
 }
 
+// adoptLegacyDcName provides a migration path for volumes created before DC name templates were introduced.
+// Returns legacyName if a DC by that name exists while none exists under dcName, and dcName otherwise.
+func (ems *EmsWrapper) adoptLegacyDcName(ctx context.Context, dcName string, legacyName string) (string, error) {
+	if dcName == legacyName {
+		return dcName, nil
+	}
+
+	exists, _, err := ems.dcExists(ctx, dcName)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Failed to check if Data Container exists", 0)
+	}
+	if exists {
+		return dcName, nil
+	}
+
+	legacyExists, _, err := ems.dcExists(ctx, legacyName)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Failed to check if legacy Data Container exists", 0)
+	}
+	if !legacyExists {
+		return dcName, nil
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dcName,
+		"legacyName":   legacyName,
+	}).Info("Adopting Data Container created with legacy naming scheme")
+	return legacyName, nil
+}
+
 // maybeCreateDc creates DC if it doesn't exist.
 // Returns the DC regardless of whether it existed earlier of was just created.
-func (ems *EmsWrapper) maybeCreateDc(dcOpts *emanage.DcCreateOpts) (*emanage.DataContainer, error) {
-	exists, dc, err := ems.dcExists(dcOpts.Name)
+func (ems *EmsWrapper) maybeCreateDc(ctx context.Context, dcOpts *emanage.DcCreateOpts, policyName string) (
+	*emanage.DataContainer, error) {
+	exists, dc, err := ems.dcExists(ctx, dcOpts.Name)
 	if err != nil {
 		return nil, errors.WrapPrefix(err, "Failed to check if Data Container exists", 0)
 	}
 	if !exists {
-		dc, err = ems.CreateDc(dcOpts)
+		dc, err = ems.CreateDc(ctx, dcOpts, policyName)
 		if err != nil {
 			return nil, errors.WrapPrefix(err, "Failed to create Data Container", 0)
 		}
 	} else {
-		logrus.Debugf("Skipping creation of Data Container %s - it has been created elsewhere", dcOpts.Name)
+		loggerFrom(ctx).Debugf("Skipping creation of Data Container %s - it has been created elsewhere", dcOpts.Name)
 	}
 	return dc, nil
 }
 
 // maybeCreateExport creates Export if it doesn't exist.
 // Returns the Export regardless of whether it existed earlier of was just created.
-func (ems *EmsWrapper) maybeCreateExport(exportName string, exportOpts *emanage.ExportCreateOpts) (*emanage.Export, error) {
-	exists, export, err := ems.exportExists(exportName, exportOpts.DcId)
+func (ems *EmsWrapper) maybeCreateExport(ctx context.Context, exportName string, exportOpts *emanage.ExportCreateOpts) (
+	*emanage.Export, error) {
+	exists, export, err := ems.exportExists(ctx, exportName, exportOpts.DcId)
 	if err != nil {
 		return nil, errors.WrapPrefix(err, "Failed to check if Export exists", 0)
 	}
 	if !exists {
-		exp, err := ems.CreateExport(exportName, exportOpts)
+		exp, err := ems.CreateExport(ctx, exportName, exportOpts)
 		if err != nil {
 			return nil, errors.WrapPrefix(err, "Failed to create Export", 0)
 		}
 		export = &exp
 	} else {
-		logrus.WithFields(logrus.Fields{
-			"exportName": exportName,
-			"DcId":       exportOpts.DcId,
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			logFieldExport: exportName,
+			logFieldDcId:   exportOpts.DcId,
 		}).Debug("Skipping creation of export - it has been created elsewhere")
 	}
 	return export, nil
 }
 
-func (ems *EmsWrapper) CreateDcExport(dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts) (
-	exportRef *emanage.Export, dc *emanage.DataContainer, err error) {
+func (ems *EmsWrapper) CreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts,
+	policyName string) (exportRef *emanage.Export, dc *emanage.DataContainer, err error) {
 
 	// Create Data Container if it doesn't exist
-	dc, err = ems.CreateDc(dcOpts)
+	dc, err = ems.CreateDc(ctx, dcOpts, policyName)
 	if err != nil {
 		err = errors.Wrap(err, 0)
 		return
@@ -271,28 +406,28 @@ func (ems *EmsWrapper) CreateDcExport(dcOpts *emanage.DcCreateOpts, exportOpts *
 
 	// Create Export if it doesn't exist
 	exportOpts.DcId = dc.Id
-	export, err := ems.CreateExport(defaultExportName, exportOpts)
+	export, err := ems.CreateExport(ctx, defaultExportName, exportOpts)
 	if err != nil {
 		err = errors.Wrap(err, 0)
 		return
 	}
 	exportRef = &export
-	logrus.WithFields(logrus.Fields{
-		"dcName":     dc.Name,
-		"dcId":       dc.Id,
-		"exportName": exportRef.Name,
-		"exportPath": exportRef.Path,
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		logFieldDcId:   dc.Id,
+		logFieldExport: exportRef.Name,
+		"export_path":  exportRef.Path,
 	}).Info("Created Data Container and Export")
 	return exportRef, dc, nil
 }
 
 // MaybeCreateDcExport creates DC and Export if they don't exist.
 // Returns the Export and the DC regardless of whether they existed earlier of were just created.
-func (ems *EmsWrapper) MaybeCreateDcExport(dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts) (
-	export *emanage.Export, dc *emanage.DataContainer, err error) {
+func (ems *EmsWrapper) MaybeCreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts,
+	policyName string) (export *emanage.Export, dc *emanage.DataContainer, err error) {
 
 	// Create Data Container if it doesn't exist
-	dc, err = ems.maybeCreateDc(dcOpts)
+	dc, err = ems.maybeCreateDc(ctx, dcOpts, policyName)
 	if err != nil {
 		err = errors.Wrap(err, 0)
 		return
@@ -300,54 +435,122 @@ func (ems *EmsWrapper) MaybeCreateDcExport(dcOpts *emanage.DcCreateOpts, exportO
 
 	// Create Export if it doesn't exist
 	exportOpts.DcId = dc.Id
-	export, err = ems.maybeCreateExport(defaultExportName, exportOpts)
+	export, err = ems.maybeCreateExport(ctx, defaultExportName, exportOpts)
 	if err != nil {
 		err = errors.Wrap(err, 0)
 		return
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"dcName":     dc.Name,
-		"dcId":       dc.Id,
-		"exportName": export.Name,
-		"exportPath": export.Path,
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		logFieldDcId:   dc.Id,
+		logFieldExport: export.Name,
+		"export_path":  export.Path,
 	}).Info("Created Data Container and Export")
 
 	return export, dc, nil
 }
 
-func (ems *EmsWrapper) DeleteDc(dc *emanage.DataContainer) (err error) {
+func (ems *EmsWrapper) DeleteDc(ctx context.Context, dc *emanage.DataContainer) (err error) {
 	emsClient, err := ems.Client()
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to create EMS client", 0)
 	}
 
-	logrus.WithField("dcName", dc.Name).Info("Deleting Data Container")
+	loggerFrom(ctx).WithField(logFieldDcName, dc.Name).Info("Deleting Data Container")
 	_, err = emsClient.DataContainers.Delete(dc)
 	return err
 }
 
-func (ems *EmsWrapper) DeleteExport(export *emanage.Export) (err error) {
+func (ems *EmsWrapper) CreateSnapshot(ctx context.Context, dc *emanage.DataContainer, name string) (err error) {
+	emsClient, err := ems.Client()
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to create EMS client", 0)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		"snapshot":     name,
+	}).Info("Creating snapshot")
+	_, err = emsClient.Snapshots.Create(&emanage.Snapshot{Name: name, DataContainerID: dc.Id})
+	return err
+}
+
+// CloneSnapshot creates a Data Container from the snapshot of the Data Container, along with its Export.
+// The Data Container gets the name and the description of dcOpts.
+func (ems *EmsWrapper) CloneSnapshot(ctx context.Context, dc *emanage.DataContainer, snapshot string,
+	dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts) (
+	exportRef *emanage.Export, cloneRef *emanage.DataContainer, err error) {
+	emsClient, err := ems.Client()
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
+		return
+	}
+
+	snapshots, err := emsClient.Snapshots.GetAll(nil)
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to get snapshots", 0)
+		return
+	}
+	var source *emanage.Snapshot
+	for i := range snapshots {
+		if snapshots[i].DataContainerID == dc.Id && snapshots[i].Name == snapshot {
+			source = &snapshots[i]
+			break
+		}
+	}
+	if source == nil {
+		err = errors.Errorf("Snapshot %v of Data Container %v not found", snapshot, dc.Name)
+		return
+	}
+
+	name := legalVolumeName(dcOpts.Name)
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		"snapshot":     snapshot,
+		"clone":        name,
+	}).Info("Cloning snapshot")
+	clone, err := emsClient.Snapshots.Clone(source, name)
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to clone snapshot", 0)
+		return
+	}
+	clone.Description = dcOpts.Description
+	if clone, err = emsClient.DataContainers.Update(&clone); err != nil {
+		err = errors.WrapPrefix(err, "Failed to update Data Container "+name, 0)
+		return
+	}
+
+	exportOpts.DcId = clone.Id
+	export, err := ems.CreateExport(ctx, defaultExportName, exportOpts)
+	if err != nil {
+		err = errors.Wrap(err, 0)
+		return
+	}
+	return &export, &clone, nil
+}
+
+func (ems *EmsWrapper) DeleteExport(ctx context.Context, export *emanage.Export) (err error) {
 	emsClient, err := ems.Client()
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to create EMS client", 0)
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"exportName":      export.Name,
-		"DataContainerId": export.DataContainerId,
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldExport: export.Name,
+		logFieldDcId:   export.DataContainerId,
 	}).Info("Deleting Export")
 	_, err = emsClient.Exports.Delete(export)
 	return
 }
 
-func (ems *EmsWrapper) DeleteDcExport(v *elastifileVolume) (err error) {
-	err = ems.DeleteExport(v.Export)
+func (ems *EmsWrapper) DeleteDcExport(ctx context.Context, v *elastifileVolume) (err error) {
+	err = ems.DeleteExport(ctx, v.Export)
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to delete Export", 0)
 		return
 	}
-	err = ems.DeleteDc(v.DataContainer)
+	err = ems.DeleteDc(ctx, v.DataContainer)
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to delete Data Container", 0)
 		return
@@ -357,35 +560,35 @@ func (ems *EmsWrapper) DeleteDcExport(v *elastifileVolume) (err error) {
 
 // MaybeDeleteDcExport deletes DC and Export if they exist.
 // Returns success regardless of whether they were just deleted or didn't exist at all.
-func (ems *EmsWrapper) MaybeDeleteDcExport(v *elastifileVolume) (err error) {
-	dcExists, _, err := ems.dcExists(v.DataContainer.Name)
+func (ems *EmsWrapper) MaybeDeleteDcExport(ctx context.Context, v *elastifileVolume) (err error) {
+	dcExists, _, err := ems.dcExists(ctx, v.DataContainer.Name)
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to check if Data Container exists", 0)
 	}
 	if !dcExists {
-		logrus.WithField("name", v.DataContainer.Name).Debug(
+		loggerFrom(ctx).WithField(logFieldDcName, v.DataContainer.Name).Debug(
 			"Skipping removal of Data Container - it has been deleted elsewhere")
 		return nil
 	}
 
-	exportExists, _, err := ems.exportExists(v.Export.Name, v.DataContainer.Id)
+	exportExists, _, err := ems.exportExists(ctx, v.Export.Name, v.DataContainer.Id)
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to check if Export exists", 0)
 	}
 
 	if exportExists {
-		err = ems.DeleteExport(v.Export)
+		err = ems.DeleteExport(ctx, v.Export)
 		if err != nil {
 			return errors.WrapPrefix(err, "Failed to delete Export", 0)
 		}
 	} else {
-		logrus.WithFields(logrus.Fields{
-			"ExportName":        v.Export.Name,
-			"DataContainerName": v.DataContainer.Name,
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			logFieldExport: v.Export.Name,
+			logFieldDcName: v.DataContainer.Name,
 		}).Debug("Skipping removal of export - it has been deleted elsewhere")
 	}
 
-	err = ems.DeleteDc(v.DataContainer)
+	err = ems.DeleteDc(ctx, v.DataContainer)
 	if err != nil {
 		return errors.WrapPrefix(err, "Failed to delete Data Container", 0)
 	}
@@ -393,7 +596,48 @@ func (ems *EmsWrapper) MaybeDeleteDcExport(v *elastifileVolume) (err error) {
 	return
 }
 
-func (ems *EmsWrapper) dcExportPath(export *emanage.Export) (dir string, err error) {
+// updateDc applies modify to the current representation of the Data Container and stores the result in EMS
+func (ems *EmsWrapper) updateDc(ctx context.Context, dcId int, modify func(dc *emanage.DataContainer)) (
+	dcRef *emanage.DataContainer, err error) {
+	emsClient, err := ems.Client()
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
+		return
+	}
+
+	dc, err := emsClient.DataContainers.GetFull(dcId)
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to get Data Container", 0)
+		return
+	}
+
+	modify(&dc)
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		"description":  dc.Description,
+	}).Debug("Updating Data Container")
+	dc, err = emsClient.DataContainers.Update(&dc)
+	if err != nil {
+		err = errors.WrapPrefix(err, "Failed to update Data Container", 0)
+		return
+	}
+
+	dcRef = &dc
+	return
+}
+
+// updateDcMetadata sets the plugin metadata key on the Data Container and returns the updated Data Container
+func (ems *EmsWrapper) updateDcMetadata(ctx context.Context, dcId int, key string, value string) (
+	*emanage.DataContainer, error) {
+	return ems.updateDc(ctx, dcId, func(dc *emanage.DataContainer) {
+		meta := parseDcMetadata(dc.Description)
+		meta.Set(key, value)
+		dc.Description = meta.String()
+	})
+}
+
+func (ems *EmsWrapper) dcExportPath(ctx context.Context, export *emanage.Export) (dir string, err error) {
 	emsClient, err := ems.Client()
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to create EMS client", 0)
@@ -0,0 +1,519 @@
+// Package fakeems is an in-memory fake of the Elastifile management server (EMS) REST API.
+// It covers the endpoints used by the plugin - sessions, policies, data containers, exports and snapshots -
+// and supports fault injection, so that the plugin can be exercised in CI without an Elastifile cluster.
+package fakeems
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiPrefix         = "/api/"
+	sessionCookieName = "_session_id"
+
+	// ControlPath is used to inject faults into a fake server running in another process
+	ControlPath = "/_fake/faults"
+
+	DefaultUser     = "admin"
+	DefaultPassword = "changeme"
+)
+
+type Policy struct {
+	Id        int    `json:"id"`
+	Name      string `json:"name"`
+	IsDefault bool   `json:"is_default"`
+}
+
+type DataContainer struct {
+	Id             int    `json:"id"`
+	Name           string `json:"name"`
+	PolicyId       int    `json:"policy_id"`
+	HardQuota      int    `json:"hard_quota"`
+	SoftQuota      int    `json:"soft_quota"`
+	UsedCapacity   int    `json:"used_capacity"`
+	Description    string `json:"description"`
+	DirPermissions int    `json:"dir_permissions"`
+	Dedup          int    `json:"dedup"`
+	Compression    int    `json:"compression"`
+}
+
+type Export struct {
+	Id              int    `json:"id"`
+	Name            string `json:"name"`
+	Path            string `json:"path"`
+	DataContainerId int    `json:"data_container_id"`
+	Access          string `json:"access_permission"`
+	UserMapping     string `json:"user_mapping"`
+	Uid             int    `json:"uid"`
+	Gid             int    `json:"gid"`
+}
+
+type Snapshot struct {
+	Id              int    `json:"id"`
+	Name            string `json:"name"`
+	DataContainerId int    `json:"data_container_id"`
+}
+
+type loginRequest struct {
+	User struct {
+		Login    string `json:"login"`
+		Password string `json:"password"`
+	} `json:"user"`
+}
+
+// Faults describes the faults injected into the responses of the fake server
+type Faults struct {
+	Latency time.Duration // Delay before serving each API request
+	// FailCount API requests whose path starts with FailPath fail with FailStatus (5xx by default)
+	FailPath   string
+	FailStatus int
+	FailCount  int
+	// ExpireSessions invalidates all sessions, i.e. subsequent requests fail with 401 until the client logs in again
+	ExpireSessions bool
+}
+
+// Server is the fake EMS. Use Handler() with an http.Server of your own, or Start().
+type Server struct {
+	sync.Mutex
+
+	User     string
+	Password string
+
+	nextId    int
+	sessions  map[string]bool
+	policies  []Policy
+	dcs       map[int]*DataContainer
+	exports   map[int]*Export
+	snapshots map[int]*Snapshot
+	faults    Faults
+	requests  map[string]int // "<method> <path prefix>" -> number of requests
+}
+
+func NewServer() *Server {
+	return &Server{
+		User:     DefaultUser,
+		Password: DefaultPassword,
+		nextId:   100,
+		sessions: map[string]bool{},
+		policies: []Policy{
+			{Id: 1, Name: "default", IsDefault: true},
+			{Id: 2, Name: "gold"},
+		},
+		dcs:       map[int]*DataContainer{},
+		exports:   map[int]*Export{},
+		snapshots: map[int]*Snapshot{},
+		requests:  map[string]int{},
+	}
+}
+
+// Start serves the fake EMS on the specified address, e.g. 127.0.0.1:0, and returns the actual address
+func (s *Server) Start(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(listener, s.Handler())
+	return listener.Addr().String(), nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix, s.serveApi)
+	mux.HandleFunc(ControlPath, s.serveControl)
+	return mux
+}
+
+// SetFaults replaces the currently injected faults
+func (s *Server) SetFaults(faults Faults) {
+	s.Lock()
+	defer s.Unlock()
+
+	if faults.FailCount > 0 && faults.FailStatus == 0 {
+		faults.FailStatus = http.StatusInternalServerError
+	}
+	if faults.ExpireSessions {
+		s.sessions = map[string]bool{}
+		faults.ExpireSessions = false
+	}
+	s.faults = faults
+}
+
+// DataContainers returns a snapshot of the existing data containers
+func (s *Server) DataContainers() []DataContainer {
+	s.Lock()
+	defer s.Unlock()
+
+	var dcs []DataContainer
+	for _, dc := range s.dcs {
+		dcs = append(dcs, *dc)
+	}
+	return dcs
+}
+
+// Exports returns a snapshot of the existing exports
+func (s *Server) Exports() []Export {
+	s.Lock()
+	defer s.Unlock()
+
+	var exports []Export
+	for _, export := range s.exports {
+		exports = append(exports, *export)
+	}
+	return exports
+}
+
+// Snapshots returns a snapshot of the existing snapshots
+func (s *Server) Snapshots() []Snapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	var snapshots []Snapshot
+	for _, snapshot := range s.snapshots {
+		snapshots = append(snapshots, *snapshot)
+	}
+	return snapshots
+}
+
+// AddDataContainer creates a data container as if through the EMS UI, and returns it with its ID
+func (s *Server) AddDataContainer(dc DataContainer) DataContainer {
+	s.Lock()
+	defer s.Unlock()
+
+	dc.Id = s.allocateId()
+	s.dcs[dc.Id] = &dc
+	return dc
+}
+
+// UpdateDataContainer replaces the data container with the same ID, as if changed through the EMS UI
+func (s *Server) UpdateDataContainer(dc DataContainer) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.dcs[dc.Id]; !ok {
+		return false
+	}
+	s.dcs[dc.Id] = &dc
+	return true
+}
+
+// Requests returns the number of API requests by method and resource, e.g. "POST data_containers"
+func (s *Server) Requests(key string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.requests[key]
+}
+
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method %v", r.Method)
+		return
+	}
+
+	var faults Faults
+	if err := json.NewDecoder(r.Body).Decode(&faults); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed faults: %v", err)
+		return
+	}
+	s.SetFaults(faults)
+	writeJSON(w, http.StatusOK, faults)
+}
+
+func (s *Server) serveApi(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	resource := parts[0]
+	id := 0
+	if len(parts) > 1 {
+		var err error
+		if id, err = strconv.Atoi(parts[1]); err != nil {
+			writeError(w, http.StatusNotFound, "malformed id %v", parts[1])
+			return
+		}
+	}
+
+	s.Lock()
+	s.requests[r.Method+" "+resource]++
+	latency := s.faults.Latency
+	s.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.faults.FailCount > 0 && strings.HasPrefix(r.URL.Path, s.faults.FailPath) {
+		s.faults.FailCount--
+		writeError(w, s.faults.FailStatus, "injected failure")
+		return
+	}
+
+	if resource == "sessions" {
+		s.login(w, r)
+		return
+	}
+
+	if !s.authenticated(r) {
+		writeError(w, http.StatusUnauthorized, "session expired or missing, please log in")
+		return
+	}
+
+	switch {
+	case resource == "policies" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.policies)
+	case resource == "data_containers":
+		s.serveDataContainers(w, r, id)
+	case resource == "exports":
+		s.serveExports(w, r, id)
+	case resource == "snapshots" && id == 0:
+		s.serveSnapshots(w, r)
+	case resource == "snapshots" && len(parts) == 3 && parts[2] == "clone" && r.Method == http.MethodPost:
+		s.cloneSnapshot(w, r, id)
+	default:
+		writeError(w, http.StatusNotFound, "unsupported request %v %v", r.Method, r.URL.Path)
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method %v", r.Method)
+		return
+	}
+
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed login request: %v", err)
+		return
+	}
+	if req.User.Login != s.User || req.User.Password != s.Password {
+		writeError(w, http.StatusUnauthorized, "invalid user name or password")
+		return
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	sessionId := hex.EncodeToString(buf)
+	s.sessions[sessionId] = true
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: sessionId, Path: "/"})
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": 1, "login": req.User.Login})
+}
+
+func (s *Server) authenticated(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookieName)
+	return err == nil && s.sessions[cookie.Value]
+}
+
+func (s *Server) serveDataContainers(w http.ResponseWriter, r *http.Request, id int) {
+	var dc *DataContainer
+	if id != 0 {
+		var ok bool
+		if dc, ok = s.dcs[id]; !ok {
+			writeError(w, http.StatusNotFound, "data container %v not found", id)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && dc == nil:
+		dcs := []DataContainer{}
+		for _, dc := range s.dcs {
+			dcs = append(dcs, *dc)
+		}
+		writeJSON(w, http.StatusOK, dcs)
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, dc)
+	case r.Method == http.MethodPost && dc == nil:
+		var req DataContainer
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "malformed data container: %v", err)
+			return
+		}
+		if req.Name == "" {
+			writeError(w, http.StatusUnprocessableEntity, "data container name is required")
+			return
+		}
+		for _, existing := range s.dcs {
+			if existing.Name == req.Name {
+				writeError(w, http.StatusUnprocessableEntity, "data container %v already exists", req.Name)
+				return
+			}
+		}
+		if !s.policyExists(req.PolicyId) {
+			writeError(w, http.StatusUnprocessableEntity, "policy %v not found", req.PolicyId)
+			return
+		}
+		req.Id = s.allocateId()
+		s.dcs[req.Id] = &req
+		writeJSON(w, http.StatusCreated, req)
+	case r.Method == http.MethodPut && dc != nil:
+		updated := *dc
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			writeError(w, http.StatusBadRequest, "malformed data container: %v", err)
+			return
+		}
+		updated.Id = dc.Id
+		*dc = updated
+		writeJSON(w, http.StatusOK, dc)
+	case r.Method == http.MethodDelete && dc != nil:
+		for _, export := range s.exports {
+			if export.DataContainerId == dc.Id {
+				writeError(w, http.StatusUnprocessableEntity, "data container %v has exports", dc.Name)
+				return
+			}
+		}
+		delete(s.dcs, dc.Id)
+		writeJSON(w, http.StatusOK, dc)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported request %v %v", r.Method, r.URL.Path)
+	}
+}
+
+func (s *Server) serveExports(w http.ResponseWriter, r *http.Request, id int) {
+	var export *Export
+	if id != 0 {
+		var ok bool
+		if export, ok = s.exports[id]; !ok {
+			writeError(w, http.StatusNotFound, "export %v not found", id)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && export == nil:
+		exports := []Export{}
+		for _, export := range s.exports {
+			exports = append(exports, *export)
+		}
+		writeJSON(w, http.StatusOK, exports)
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, export)
+	case r.Method == http.MethodPost && export == nil:
+		var req Export
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "malformed export: %v", err)
+			return
+		}
+		if _, ok := s.dcs[req.DataContainerId]; !ok {
+			writeError(w, http.StatusUnprocessableEntity, "data container %v not found", req.DataContainerId)
+			return
+		}
+		for _, existing := range s.exports {
+			if existing.Name == req.Name && existing.DataContainerId == req.DataContainerId {
+				writeError(w, http.StatusUnprocessableEntity, "export %v already exists", req.Name)
+				return
+			}
+		}
+		req.Id = s.allocateId()
+		s.exports[req.Id] = &req
+		writeJSON(w, http.StatusCreated, req)
+	case r.Method == http.MethodDelete && export != nil:
+		delete(s.exports, export.Id)
+		writeJSON(w, http.StatusOK, export)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported request %v %v", r.Method, r.URL.Path)
+	}
+}
+
+func (s *Server) serveSnapshots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		snapshots := []Snapshot{}
+		for _, snapshot := range s.snapshots {
+			snapshots = append(snapshots, *snapshot)
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+	case http.MethodPost:
+		var req Snapshot
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "malformed snapshot: %v", err)
+			return
+		}
+		if _, ok := s.dcs[req.DataContainerId]; !ok {
+			writeError(w, http.StatusUnprocessableEntity, "data container %v not found", req.DataContainerId)
+			return
+		}
+		for _, existing := range s.snapshots {
+			if existing.Name == req.Name && existing.DataContainerId == req.DataContainerId {
+				writeError(w, http.StatusUnprocessableEntity, "snapshot %v already exists", req.Name)
+				return
+			}
+		}
+		req.Id = s.allocateId()
+		s.snapshots[req.Id] = &req
+		writeJSON(w, http.StatusCreated, req)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported request %v %v", r.Method, r.URL.Path)
+	}
+}
+
+// cloneSnapshot creates a data container from the snapshot, with the quotas and the policy of the snapshot's
+// data container
+func (s *Server) cloneSnapshot(w http.ResponseWriter, r *http.Request, id int) {
+	snapshot, ok := s.snapshots[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "snapshot %v not found", id)
+		return
+	}
+	source, ok := s.dcs[snapshot.DataContainerId]
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, "data container %v not found", snapshot.DataContainerId)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeError(w, http.StatusBadRequest, "malformed clone request: %v", err)
+		return
+	}
+	for _, existing := range s.dcs {
+		if existing.Name == req.Name {
+			writeError(w, http.StatusUnprocessableEntity, "data container %v already exists", req.Name)
+			return
+		}
+	}
+
+	clone := *source
+	clone.Id = s.allocateId()
+	clone.Name = req.Name
+	clone.Description = ""
+	clone.UsedCapacity = 0
+	s.dcs[clone.Id] = &clone
+	writeJSON(w, http.StatusCreated, clone)
+}
+
+func (s *Server) policyExists(id int) bool {
+	for _, policy := range s.policies {
+		if policy.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) allocateId() int {
+	id := s.nextId
+	s.nextId++
+	return id
+}
+
+func writeJSON(w http.ResponseWriter, status int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []string{fmt.Sprintf(format, args...)},
+	})
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// The fakes allow running the driver without an Elastifile cluster and without NFS mounts, in the tests as well as
+// in the plugin run by the e2e harness (STORAGE_BACKEND=fake MOUNTER=fake, see main_test.go).
+// Errors can be injected per operation via failOn.
+
+const (
+	storageBackendFake = "fake"
+	mounterFake        = "fake"
+
+	fakeDefaultPolicyId = 1
+)
+
+func init() {
+	storageBackends[storageBackendFake] = func() (storageBackend, error) { return newFakeBackend(), nil }
+	mounters[mounterFake] = func() (mounter, error) { return newFakeMounter(), nil }
+}
+
+// fakeBackend keeps Data Containers and Exports in memory
+type fakeBackend struct {
+	sync.Mutex
+
+	nextId    int
+	dcs       map[int]*emanage.DataContainer
+	exports   map[int]*emanage.Export
+	snapshots map[int][]string // Snapshot names by DC ID
+	policies  []emanage.Policy
+	failOn    map[string]error // Operation name -> error to return
+}
+
+var _ storageBackend = &fakeBackend{}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		nextId:    1,
+		dcs:       map[int]*emanage.DataContainer{},
+		exports:   map[int]*emanage.Export{},
+		snapshots: map[int][]string{},
+		policies: []emanage.Policy{
+			{Id: fakeDefaultPolicyId, Name: "default", IsDefault: true},
+		},
+		failOn: map[string]error{},
+	}
+}
+
+func (b *fakeBackend) injectedError(ctx context.Context, op string) error {
+	if err, ok := b.failOn[op]; ok {
+		loggerFrom(ctx).WithField("op", op).Debug("Returning injected error")
+		return err
+	}
+	return nil
+}
+
+func (b *fakeBackend) findDc(name string) *emanage.DataContainer {
+	for _, dc := range b.dcs {
+		if dc.Name == name {
+			return dc
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) findExport(name string, dcId int) *emanage.Export {
+	for _, export := range b.exports {
+		if export.Name == name && export.DataContainerId == dcId {
+			return export
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) createDc(opts *emanage.DcCreateOpts, policyName string) (*emanage.DataContainer, error) {
+	if b.findDc(opts.Name) != nil {
+		return nil, errors.Errorf("Data Container %v already exists", opts.Name)
+	}
+
+	policy, err := b.findPolicy(policyName)
+	if err != nil {
+		return nil, err
+	}
+
+	dc := &emanage.DataContainer{
+		Id:          b.nextId,
+		Name:        legalVolumeName(opts.Name),
+		PolicyId:    policy.Id,
+		HardQuota:   opts.HardQuota,
+		SoftQuota:   opts.SoftQuota,
+		Description: opts.Description,
+	}
+	b.nextId++
+	b.dcs[dc.Id] = dc
+	copied := *dc
+	return &copied, nil
+}
+
+func (b *fakeBackend) createExport(name string, opts *emanage.ExportCreateOpts) (*emanage.Export, error) {
+	if _, ok := b.dcs[opts.DcId]; !ok {
+		return nil, errors.Errorf("Data Container %v not found", opts.DcId)
+	}
+	if b.findExport(name, opts.DcId) != nil {
+		return nil, errors.Errorf("Export %v already exists", name)
+	}
+
+	export := &emanage.Export{
+		Id:              b.nextId,
+		Name:            name,
+		Path:            opts.Path,
+		DataContainerId: opts.DcId,
+		Access:          opts.Access,
+		UserMapping:     opts.UserMapping,
+	}
+	if opts.Uid != nil {
+		export.Uid = *opts.Uid
+	}
+	if opts.Gid != nil {
+		export.Gid = *opts.Gid
+	}
+	b.nextId++
+	b.exports[export.Id] = export
+	copied := *export
+	return &copied, nil
+}
+
+func (b *fakeBackend) findPolicy(name string) (emanage.Policy, error) {
+	for _, policy := range b.policies {
+		if (name == "" && policy.IsDefault) || (name != "" && policy.Name == name) {
+			return policy, nil
+		}
+	}
+	return emanage.Policy{}, errors.Errorf("Policy %v not found", name)
+}
+
+func (b *fakeBackend) CreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts,
+	policyName string) (*emanage.Export, *emanage.DataContainer, error) {
+
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "CreateDcExport"); err != nil {
+		return nil, nil, err
+	}
+
+	dc, err := b.createDc(dcOpts, policyName)
+	if err != nil {
+		return nil, nil, err
+	}
+	exportOpts.DcId = dc.Id
+	export, err := b.createExport(defaultExportName, exportOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return export, dc, nil
+}
+
+func (b *fakeBackend) MaybeCreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts,
+	policyName string) (*emanage.Export, *emanage.DataContainer, error) {
+
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "MaybeCreateDcExport"); err != nil {
+		return nil, nil, err
+	}
+
+	var err error
+	dc := b.findDc(dcOpts.Name)
+	if dc == nil {
+		if dc, err = b.createDc(dcOpts, policyName); err != nil {
+			return nil, nil, err
+		}
+	}
+	exportOpts.DcId = dc.Id
+	export := b.findExport(defaultExportName, dc.Id)
+	if export == nil {
+		if export, err = b.createExport(defaultExportName, exportOpts); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	copiedDc, copiedExport := *dc, *export
+	return &copiedExport, &copiedDc, nil
+}
+
+func (b *fakeBackend) DeleteDcExport(ctx context.Context, v *elastifileVolume) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "DeleteDcExport"); err != nil {
+		return err
+	}
+
+	if _, ok := b.exports[v.Export.Id]; !ok {
+		return errors.Errorf("Export %v not found", v.Export.Name)
+	}
+	if _, ok := b.dcs[v.DataContainer.Id]; !ok {
+		return errors.Errorf("Data Container %v not found", v.DataContainer.Name)
+	}
+	delete(b.exports, v.Export.Id)
+	delete(b.dcs, v.DataContainer.Id)
+	return nil
+}
+
+func (b *fakeBackend) MaybeDeleteDcExport(ctx context.Context, v *elastifileVolume) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "MaybeDeleteDcExport"); err != nil {
+		return err
+	}
+
+	delete(b.exports, v.Export.Id)
+	delete(b.dcs, v.DataContainer.Id)
+	return nil
+}
+
+func (b *fakeBackend) TrashDcExport(ctx context.Context, name string, v *elastifileVolume) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "TrashDcExport"); err != nil {
+		return err
+	}
+
+	dc, ok := b.dcs[v.DataContainer.Id]
+	if !ok {
+		return errors.Errorf("Data Container %v not found", v.DataContainer.Name)
+	}
+	delete(b.exports, v.Export.Id)
+
+	setTrashMetadata(dc, name, v, time.Now())
+	return nil
+}
+
+func (b *fakeBackend) CreateExport(ctx context.Context, name string, opts *emanage.ExportCreateOpts) (
+	emanage.Export, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "CreateExport"); err != nil {
+		return emanage.Export{}, err
+	}
+
+	export, err := b.createExport(name, opts)
+	if err != nil {
+		return emanage.Export{}, err
+	}
+	return *export, nil
+}
+
+func (b *fakeBackend) DeleteExport(ctx context.Context, export *emanage.Export) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "DeleteExport"); err != nil {
+		return err
+	}
+
+	if _, ok := b.exports[export.Id]; !ok {
+		return errors.Errorf("Export %v not found", export.Name)
+	}
+	delete(b.exports, export.Id)
+	return nil
+}
+
+func (b *fakeBackend) DeleteDc(ctx context.Context, dc *emanage.DataContainer) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "DeleteDc"); err != nil {
+		return err
+	}
+
+	if _, ok := b.dcs[dc.Id]; !ok {
+		return errors.Errorf("Data Container %v not found", dc.Name)
+	}
+	delete(b.dcs, dc.Id)
+	return nil
+}
+
+func (b *fakeBackend) CreateSnapshot(ctx context.Context, dc *emanage.DataContainer, name string) error {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "CreateSnapshot"); err != nil {
+		return err
+	}
+
+	if _, ok := b.dcs[dc.Id]; !ok {
+		return errors.Errorf("Data Container %v not found", dc.Name)
+	}
+	for _, existing := range b.snapshots[dc.Id] {
+		if existing == name {
+			return errors.Errorf("Snapshot %v of Data Container %v already exists", name, dc.Name)
+		}
+	}
+	b.snapshots[dc.Id] = append(b.snapshots[dc.Id], name)
+	return nil
+}
+
+func (b *fakeBackend) CloneSnapshot(ctx context.Context, dc *emanage.DataContainer, snapshot string,
+	dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts) (*emanage.Export, *emanage.DataContainer, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "CloneSnapshot"); err != nil {
+		return nil, nil, err
+	}
+
+	source, ok := b.dcs[dc.Id]
+	if !ok {
+		return nil, nil, errors.Errorf("Data Container %v not found", dc.Name)
+	}
+	found := false
+	for _, existing := range b.snapshots[dc.Id] {
+		found = found || existing == snapshot
+	}
+	if !found {
+		return nil, nil, errors.Errorf("Snapshot %v of Data Container %v not found", snapshot, dc.Name)
+	}
+	if b.findDc(dcOpts.Name) != nil {
+		return nil, nil, errors.Errorf("Data Container %v already exists", dcOpts.Name)
+	}
+
+	clone := &emanage.DataContainer{
+		Id:          b.nextId,
+		Name:        legalVolumeName(dcOpts.Name),
+		PolicyId:    source.PolicyId,
+		HardQuota:   source.HardQuota,
+		SoftQuota:   source.SoftQuota,
+		Description: dcOpts.Description,
+	}
+	b.nextId++
+	b.dcs[clone.Id] = clone
+	exportOpts.DcId = clone.Id
+	export, err := b.createExport(defaultExportName, exportOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	copied := *clone
+	return export, &copied, nil
+}
+
+func (b *fakeBackend) adoptLegacyDcName(ctx context.Context, dcName string, legacyName string) (string, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.findDc(dcName) == nil && b.findDc(legacyName) != nil {
+		return legacyName, nil
+	}
+	return dcName, nil
+}
+
+func (b *fakeBackend) allDcs(ctx context.Context) ([]emanage.DataContainer, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "allDcs"); err != nil {
+		return nil, err
+	}
+
+	var dcs []emanage.DataContainer
+	for _, dc := range b.dcs {
+		dcs = append(dcs, *dc)
+	}
+	return dcs, nil
+}
+
+func (b *fakeBackend) allExports(ctx context.Context) ([]emanage.Export, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "allExports"); err != nil {
+		return nil, err
+	}
+
+	var exports []emanage.Export
+	for _, export := range b.exports {
+		exports = append(exports, *export)
+	}
+	return exports, nil
+}
+
+func (b *fakeBackend) dcExists(ctx context.Context, dcName string) (bool, *emanage.DataContainer, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "dcExists"); err != nil {
+		return false, nil, err
+	}
+
+	dc := b.findDc(dcName)
+	if dc == nil {
+		return false, nil, nil
+	}
+	copied := *dc
+	return true, &copied, nil
+}
+
+func (b *fakeBackend) dcExportPath(ctx context.Context, export *emanage.Export) (string, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	dc, ok := b.dcs[export.DataContainerId]
+	if !ok {
+		return "", errors.Errorf("Data Container %v not found", export.DataContainerId)
+	}
+	return path.Join(dc.Name, export.Name), nil
+}
+
+func (b *fakeBackend) policyByName(ctx context.Context, name string) (emanage.Policy, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.findPolicy(name)
+}
+
+func (b *fakeBackend) policyById(ctx context.Context, id int) (emanage.Policy, error) {
+	b.Lock()
+	defer b.Unlock()
+	for _, policy := range b.policies {
+		if policy.Id == id {
+			return policy, nil
+		}
+	}
+	return emanage.Policy{}, errors.Errorf("Policy %v not found", id)
+}
+
+func (b *fakeBackend) updateDc(ctx context.Context, dcId int, modify func(dc *emanage.DataContainer)) (
+	*emanage.DataContainer, error) {
+	b.Lock()
+	defer b.Unlock()
+	if err := b.injectedError(ctx, "updateDc"); err != nil {
+		return nil, err
+	}
+
+	dc, ok := b.dcs[dcId]
+	if !ok {
+		return nil, errors.Errorf("Data Container %v not found", dcId)
+	}
+	modify(dc)
+	copied := *dc
+	return &copied, nil
+}
+
+func (b *fakeBackend) updateDcMetadata(ctx context.Context, dcId int, key string, value string) (
+	*emanage.DataContainer, error) {
+	return b.updateDc(ctx, dcId, func(dc *emanage.DataContainer) {
+		meta := parseDcMetadata(dc.Description)
+		meta.Set(key, value)
+		dc.Description = meta.String()
+	})
+}
+
+// fakeMounter records mounts without mounting anything, leaving the mount point a plain directory
+type fakeMounter struct {
+	sync.Mutex
+
+	mounts map[string]string // Target -> source
+	failOn map[string]error  // Operation name -> error to return
+}
+
+var _ mounter = &fakeMounter{}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{
+		mounts: map[string]string{},
+		failOn: map[string]error{},
+	}
+}
+
+func (m *fakeMounter) Mount(ctx context.Context, source string, target string, opts []string) error {
+	m.Lock()
+	defer m.Unlock()
+	if err, ok := m.failOn["Mount"]; ok {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, ok := m.mounts[target]; ok {
+		return errors.Errorf("%v is already mounted", target)
+	}
+	m.mounts[target] = source
+	return nil
+}
+
+func (m *fakeMounter) Bind(ctx context.Context, source string, target string, opts []string) error {
+	return m.Mount(ctx, source, target, opts)
+}
+
+func (m *fakeMounter) Unmount(ctx context.Context, target string) error {
+	return m.unmount(ctx, "Unmount", target)
+}
+
+func (m *fakeMounter) ForceUnmount(ctx context.Context, target string) error {
+	return m.unmount(ctx, "ForceUnmount", target)
+}
+
+func (m *fakeMounter) Detach(ctx context.Context, target string) error {
+	return m.unmount(ctx, "Detach", target)
+}
+
+func (m *fakeMounter) unmount(ctx context.Context, op string, target string) error {
+	m.Lock()
+	defer m.Unlock()
+	if err, ok := m.failOn[op]; ok {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, ok := m.mounts[target]; !ok {
+		return errors.Errorf("%v is not mounted", target)
+	}
+	delete(m.mounts, target)
+	return nil
+}
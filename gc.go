@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// Garbage collection releases what the plugin leaves behind - trashed Data Containers whose retention period
+// expired, orphaned mounts, Data Containers and Exports unknown to the state (e.g. left by failed creates, crashed
+// removes or a lost state file) and mount directories without a volume.
+// Orphaned Data Containers and mount directories are collected once they've been seen for GC_GRACE_PERIOD, so that
+// volumes being created meanwhile aren't affected. Only Data Containers created by this plugin instance are
+// collected, as other instances may share its OWNER_ID. Protected Data Containers are reported but never collected.
+
+const defaultGcGracePeriod = time.Hour
+
+// gcOrphan is an orphaned Data Container or mount directory
+type gcOrphan struct {
+	Name      string
+	Id        int `json:",omitempty"` // Data Container ID
+	Details   string
+	FirstSeen time.Time
+	Collected bool // False in dry-run mode and within the grace period
+}
+
+// gcReport lists what was collected, or would be collected in dry-run mode
+type gcReport struct {
+	DryRun         bool
+	Trash          []trashEntry // Trashed Data Containers whose retention period expired
+	OrphanedMounts []string     // Volumes whose orphaned mount was released
+	OrphanedDcs    []gcOrphan   // Data Containers of this plugin instance unknown to the state
+	OrphanedDirs   []gcOrphan   // Mount directories without a volume
+	Errors         []string     // Garbage that couldn't be collected, to be retried on the next run
+}
+
+// gcSightings keeps the time orphans were first seen, to apply the grace period. It's not persisted, i.e. the
+// grace period starts over when the plugin restarts.
+type gcSightings struct {
+	sync.Mutex
+	firstSeen map[string]time.Time
+}
+
+func newGcSightings() *gcSightings {
+	return &gcSightings{firstSeen: map[string]time.Time{}}
+}
+
+// seen returns the time the orphan was first seen
+func (s *gcSightings) seen(key string, now time.Time) time.Time {
+	s.Lock()
+	defer s.Unlock()
+	if firstSeen, ok := s.firstSeen[key]; ok {
+		return firstSeen
+	}
+	s.firstSeen[key] = now
+	return now
+}
+
+// forgetExcept forgets the orphans of the kind (key prefix) that weren't seen in the current run
+func (s *gcSightings) forgetExcept(prefix string, current map[string]bool) {
+	s.Lock()
+	defer s.Unlock()
+	for key := range s.firstSeen {
+		if strings.HasPrefix(key, prefix) && !current[key] {
+			delete(s.firstSeen, key)
+		}
+	}
+}
+
+func (d *elastifileDriver) gc(ctx context.Context, dryRun bool) (*gcReport, error) {
+	report := &gcReport{
+		DryRun:         dryRun,
+		Trash:          []trashEntry{},
+		OrphanedMounts: []string{},
+		OrphanedDcs:    []gcOrphan{},
+		OrphanedDirs:   []gcOrphan{},
+		Errors:         []string{},
+	}
+
+	expired, err := d.expiredTrash(ctx)
+	if err != nil {
+		return nil, withErrorCode(errorCodeBackend, err)
+	}
+	for _, entry := range expired {
+		if !dryRun {
+			if err := d.purgeTrashEntry(ctx, entry); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+		}
+		report.Trash = append(report.Trash, entry)
+	}
+
+	var orphans []string
+	for name := range d.orphanedMounts() {
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+	for _, name := range orphans {
+		if !dryRun {
+			if err := d.cleanupOrphanedMount(ctx, name, nil); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+		}
+		report.OrphanedMounts = append(report.OrphanedMounts, name)
+	}
+
+	if err = d.gcOrphanedDcs(ctx, report); err != nil {
+		return nil, withErrorCode(errorCodeBackend, err)
+	}
+	d.gcOrphanedDirs(ctx, report)
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"dryRun":         dryRun,
+		"trash":          len(report.Trash),
+		"orphanedMounts": len(report.OrphanedMounts),
+		"orphanedDcs":    len(report.OrphanedDcs),
+		"orphanedDirs":   len(report.OrphanedDirs),
+		"errors":         len(report.Errors),
+	}).Info("Garbage collection completed")
+	return report, nil
+}
+
+// knownDc tells whether a volume in the state uses the Data Container
+func (d *elastifileDriver) knownDc(dc *emanage.DataContainer) bool {
+	d.RLock()
+	defer d.RUnlock()
+	for _, v := range d.volumes {
+		if v.DataContainer != nil && (v.DataContainer.Id == dc.Id || v.DataContainer.Name == dc.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *elastifileDriver) gcOrphanedDcs(ctx context.Context, report *gcReport) error {
+	if d.instanceId == "" {
+		return nil // Data Containers of this instance can't be told apart
+	}
+
+	dcs, err := d.backend.allDcs(ctx)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to get Data Containers", 0)
+	}
+	var exports []emanage.Export
+	exportsListed := false
+
+	now := time.Now()
+	current := map[string]bool{}
+	for i := range dcs {
+		dc := &dcs[i]
+		meta := parseDcMetadata(dc.Description)
+		if meta.Owner() != d.ownerId || meta.Get(dcMetaCreator) != d.instanceId || meta.Get(dcMetaTrashedAt) != "" ||
+			d.knownDc(dc) {
+			continue
+		}
+
+		if !exportsListed {
+			if exports, err = d.backend.allExports(ctx); err != nil {
+				return errors.WrapPrefix(err, "Failed to get Exports", 0)
+			}
+			exportsListed = true
+		}
+		var dcExports []emanage.Export
+		for _, export := range exports {
+			if export.DataContainerId == dc.Id {
+				dcExports = append(dcExports, export)
+			}
+		}
+
+		key := "dc:" + strconv.Itoa(dc.Id)
+		current[key] = true
+		orphan := gcOrphan{Name: dc.Name, Id: dc.Id, Details: "not in the state", FirstSeen: d.gcSightings.seen(key, now)}
+		if len(dcExports) == 0 {
+			orphan.Details += ", no Export"
+		}
+		switch {
+		case meta.Protected():
+			orphan.Details += ", protected - delete it on EMS if it's no longer needed"
+		case report.DryRun || now.Sub(orphan.FirstSeen) < d.gcGracePeriod:
+		default:
+			if err := d.collectOrphanedDc(ctx, dc, dcExports); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			} else {
+				orphan.Collected = true
+			}
+		}
+		report.OrphanedDcs = append(report.OrphanedDcs, orphan)
+	}
+	d.gcSightings.forgetExcept("dc:", current)
+	sort.Slice(report.OrphanedDcs, func(i, j int) bool { return report.OrphanedDcs[i].Name < report.OrphanedDcs[j].Name })
+	return nil
+}
+
+// collectOrphanedDc deletes the Data Container and its Exports, unless it changed since it was listed
+func (d *elastifileDriver) collectOrphanedDc(ctx context.Context, dc *emanage.DataContainer,
+	exports []emanage.Export) (err error) {
+	audit := &auditEntry{
+		Operation:     auditGc,
+		RequestId:     requestIdFrom(ctx),
+		DataContainer: &auditObject{Id: dc.Id, Name: dc.Name},
+	}
+	if len(exports) > 0 {
+		audit.Export = &auditObject{Id: exports[0].Id, Name: exports[0].Name}
+	}
+	defer d.recordAudit(ctx, audit, &err)
+
+	exists, current, err := d.backend.dcExists(ctx, dc.Name)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to get Data Container "+dc.Name, 0)
+	}
+	if !exists {
+		return nil // Deleted meanwhile
+	}
+	meta := parseDcMetadata(current.Description)
+	if current.Id != dc.Id || meta.Get(dcMetaCreator) != d.instanceId || meta.Get(dcMetaTrashedAt) != "" ||
+		meta.Protected() || d.knownDc(current) {
+		return errors.Errorf("Data Container %v changed since it was found orphaned - skipped", dc.Name)
+	}
+
+	for i := range exports {
+		if err = d.backend.DeleteExport(ctx, &exports[i]); err != nil {
+			return errors.WrapPrefix(err, "Failed to delete Export of orphaned Data Container "+dc.Name, 0)
+		}
+	}
+	if err = d.backend.DeleteDc(ctx, current); err != nil {
+		return errors.WrapPrefix(err, "Failed to delete orphaned Data Container "+dc.Name, 0)
+	}
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		logFieldDcId:   dc.Id,
+		"exports":      len(exports),
+	}).Info("Collected orphaned Data Container")
+	return nil
+}
+
+// gcOrphanedDirs removes the directories in the volumes root that don't belong to any volume. Only empty directories
+// are removed, so neither data nor mounts are affected.
+func (d *elastifileDriver) gcOrphanedDirs(ctx context.Context, report *gcReport) {
+	entries, err := ioutil.ReadDir(d.root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Errors = append(report.Errors, errors.WrapPrefix(err, "Failed to list mount directories", 0).Error())
+		}
+		return
+	}
+
+	now := time.Now()
+	current := map[string]bool{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			continue
+		}
+		if _, ok := d.lookupVolume(name); ok {
+			continue
+		}
+
+		key := "dir:" + name
+		current[key] = true
+		orphan := gcOrphan{
+			Name:      filepath.Join(d.root, name),
+			Details:   "no volume",
+			FirstSeen: d.gcSightings.seen(key, now),
+		}
+		if !report.DryRun && now.Sub(orphan.FirstSeen) >= d.gcGracePeriod {
+			if err := d.collectOrphanedDir(ctx, name); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			} else {
+				orphan.Collected = true
+			}
+		}
+		report.OrphanedDirs = append(report.OrphanedDirs, orphan)
+	}
+	d.gcSightings.forgetExcept("dir:", current)
+}
+
+func (d *elastifileDriver) collectOrphanedDir(ctx context.Context, name string) error {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	if _, ok := d.lookupVolume(name); ok {
+		return nil // Created meanwhile
+	}
+	path := filepath.Join(d.root, name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.WrapPrefix(err, "Failed to remove orphaned mount directory", 0)
+	}
+	loggerFrom(ctx).WithField("path", path).Info("Removed orphaned mount directory")
+	return nil
+}
+
+// runGc collects garbage every interval
+func (d *elastifileDriver) runGc(interval time.Duration) {
+	logrus.WithFields(logrus.Fields{
+		"interval":    interval,
+		"gracePeriod": d.gcGracePeriod,
+	}).Info("Starting garbage collector")
+	for {
+		time.Sleep(interval)
+		ctx := newLogContext("gc", "")
+		if _, err := d.gc(ctx, false); err != nil {
+			loggerFrom(ctx).Error(err.Error())
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Mount health states, reported in the status of mounted volumes
+const (
+	mountHealthy = "healthy"
+	mountStale   = "stale"  // ESTALE, e.g. the export was recreated or ECFS failed over
+	mountHung    = "hung"   // The NFS server didn't respond within healthCheckTimeout
+	mountFailed  = "failed" // Any other error, including a failed remount
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// mountHealth is the outcome of the last health check of a mounted volume
+type mountHealth struct {
+	State     string
+	Error     string
+	CheckedAt time.Time
+	Remounts  int // Automatic remounts since the volume was mounted
+}
+
+// healthMonitor periodically checks the mounted volumes, and optionally remounts stale or hung mounts,
+// as long as no process has open files on them
+type healthMonitor struct {
+	sync.Mutex
+
+	driver      *elastifileDriver
+	interval    time.Duration
+	autoRemount bool
+	pending     map[string]bool // Mount points with a check still blocked in the kernel
+}
+
+func newHealthMonitor(d *elastifileDriver, interval time.Duration, autoRemount bool) *healthMonitor {
+	return &healthMonitor{
+		driver:      d,
+		interval:    interval,
+		autoRemount: autoRemount,
+		pending:     map[string]bool{},
+	}
+}
+
+func (m *healthMonitor) run() {
+	logrus.WithFields(logrus.Fields{
+		"interval":    m.interval,
+		"autoRemount": m.autoRemount,
+	}).Info("Starting mount health monitor")
+	for {
+		time.Sleep(m.interval)
+		m.checkAll()
+	}
+}
+
+// checkAll checks the volumes concurrently, so that a hung mount doesn't delay the others
+func (m *healthMonitor) checkAll() {
+	m.driver.RLock()
+	var names []string
+	for name := range m.driver.volumes {
+		names = append(names, name)
+	}
+	m.driver.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			m.checkVolume(name)
+		}(name)
+	}
+	wg.Wait()
+}
+
+func (m *healthMonitor) checkVolume(name string) {
+	d := m.driver
+
+	// The mount point is probed without the volume lock, as the probe may take up to healthCheckTimeout
+	d.volumeLocks.Lock(name)
+	v, ok := d.lookupVolume(name)
+	mounted := ok && v.connections > 0
+	var mountpoint string
+	var detached bool
+	if mounted {
+		mountpoint, detached = v.Mountpoint, v.detached
+	}
+	d.volumeLocks.Unlock(name)
+	if !mounted {
+		return
+	}
+
+	health := &mountHealth{CheckedAt: time.Now()}
+	var err error
+	if detached {
+		health.State, err = mountFailed, errors.New("not mounted - a previous remount failed")
+	} else {
+		health.State, err = m.probe(mountpoint)
+	}
+	if err != nil {
+		health.Error = err.Error()
+	}
+
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+	if current, ok := d.lookupVolume(name); !ok || current != v || v.connections == 0 {
+		return // Removed or unmounted meanwhile
+	}
+	if v.health != nil {
+		health.Remounts = v.health.Remounts
+	}
+
+	if health.State != mountHealthy {
+		ctx := newLogContext("health-check", name)
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"mountpoint": v.Mountpoint,
+			"state":      health.State,
+		}).Warnf("Unhealthy mount: %v", health.Error)
+		// Sub-directory volumes share the mount of the Data Container, which is remounted once no longer used
+		if m.autoRemount && v.Parent == "" && (health.State != mountFailed || v.detached) {
+			m.remount(ctx, v, health)
+		}
+	}
+
+	d.Lock()
+	v.health = health
+	d.Unlock()
+}
+
+// remount replaces a stale or hung mount with a new one: lazy unmount + mount.
+// Must be called with the volume lock held.
+func (m *healthMonitor) remount(ctx context.Context, v *elastifileVolume, health *mountHealth) {
+	d := m.driver
+	logger := loggerFrom(ctx).WithField("mountpoint", v.Mountpoint)
+
+	if !v.detached {
+		holders, err := mountHolders(v.Mountpoint)
+		if err != nil {
+			logger.Warnf("Not remounting - failed to verify the mount is idle: %v", err)
+			return
+		}
+		if len(holders) > 0 {
+			logger.WithField("holders", holders).Warn("Not remounting - the mount has active I/O")
+			return
+		}
+
+		if err = d.mounter.Detach(ctx, v.Mountpoint); err != nil {
+			logger.Errorf("Failed to detach unhealthy mount: %v", err)
+			return
+		}
+		d.Lock()
+		v.detached = true
+		d.Unlock()
+	}
+
+	if err := d.mountVolume(ctx, v); err != nil {
+		health.State = mountFailed
+		health.Error = errors.WrapPrefix(err, "Remount failed", 0).Error()
+		return
+	}
+
+	logger.Info("Remounted unhealthy mount")
+	d.Lock()
+	v.detached = false
+	d.Unlock()
+	health.State = mountHealthy
+	health.Error = ""
+	health.Remounts++
+}
+
+// probe reads the mount point's root directory, which makes the NFS client revalidate it with the server
+func (m *healthMonitor) probe(mountpoint string) (string, error) {
+	m.Lock()
+	if m.pending[mountpoint] {
+		m.Unlock()
+		return mountHung, errors.Errorf("a previous check of %v is still blocked", mountpoint)
+	}
+	m.pending[mountpoint] = true
+	m.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		err := readMountRoot(mountpoint)
+		m.Lock()
+		delete(m.pending, mountpoint)
+		m.Unlock()
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			return mountHealthy, nil
+		}
+		if isStaleMountError(err) {
+			return mountStale, err
+		}
+		return mountFailed, err
+	case <-time.After(healthCheckTimeout):
+		return mountHung, errors.Errorf("no response within %v", healthCheckTimeout)
+	}
+}
+
+func readMountRoot(mountpoint string) error {
+	f, err := os.Open(mountpoint)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
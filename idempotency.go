@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-errors/errors"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// Idempotent create adopts an existing Data Container / Export only if the settings explicitly
+// specified in the request match the existing ones. Otherwise a conflict is reported.
+
+func conflictError(name string, conflicts []string) error {
+	return errors.Errorf("volume %v conflicts with the existing Data Container / Export: %v",
+		name, strings.Join(conflicts, ", "))
+}
+
+// verifyExistingDc checks the existing Data Container against the requested settings
+func (d *elastifileDriver) verifyExistingDc(ctx context.Context, name string, options map[string]string, dcOpts *emanage.DcCreateOpts,
+	policyName string, dc *emanage.DataContainer) error {
+
+	var conflicts []string
+	if _, ok := options[optionsSize]; ok && dc.HardQuota != dcOpts.HardQuota {
+		conflicts = append(conflicts, fmt.Sprintf("%v: requested %v, existing %v", optionsSize, dcOpts.HardQuota, dc.HardQuota))
+	}
+
+	if _, ok := options[optionsPolicy]; ok {
+		policy, err := d.backend.policyByName(ctx, policyName)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to get requested policy", 0)
+		}
+		if dc.PolicyId != policy.Id {
+			conflicts = append(conflicts, fmt.Sprintf("%v: requested %v (id %v), existing policy id %v",
+				optionsPolicy, policyName, policy.Id, dc.PolicyId))
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return conflictError(name, conflicts)
+	}
+	return nil
+}
+
+// verifyExistingExport checks the existing Export against the requested settings
+func verifyExistingExport(name string, options map[string]string, exportOpts *emanage.ExportCreateOpts,
+	export *emanage.Export) error {
+
+	var conflicts []string
+	if _, ok := options[optionsUserMappingType]; ok && export.UserMapping != exportOpts.UserMapping {
+		conflicts = append(conflicts, fmt.Sprintf("%v: requested %v, existing %v",
+			optionsUserMappingType, exportOpts.UserMapping, export.UserMapping))
+	}
+	if _, ok := options[optionsUserMappingUid]; ok && export.Uid != *exportOpts.Uid {
+		conflicts = append(conflicts, fmt.Sprintf("%v: requested %v, existing %v",
+			optionsUserMappingUid, *exportOpts.Uid, export.Uid))
+	}
+	if _, ok := options[optionsUserMappingGid]; ok && export.Gid != *exportOpts.Gid {
+		conflicts = append(conflicts, fmt.Sprintf("%v: requested %v, existing %v",
+			optionsUserMappingGid, *exportOpts.Gid, export.Gid))
+	}
+
+	if len(conflicts) > 0 {
+		return conflictError(name, conflicts)
+	}
+	return nil
+}
+
+// removeIdempotent tells whether removing the volume should succeed even if its Data Container / Export don't exist
+func (d *elastifileDriver) removeIdempotent(v *elastifileVolume) bool {
+	if v.RemoveIfExists != nil {
+		return *v.RemoveIfExists
+	}
+	return d.crudIdempotent
+}
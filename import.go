@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// importVolume turns an existing Data Container, e.g. one created outside of Docker or by another plugin instance,
+// into a Docker volume. Its Export is created if missing. Data Containers of another owner are adopted, and
+// deleting them is subject to ALLOW_FOREIGN_DELETE like for any adopted Data Container.
+func (d *elastifileDriver) importVolume(ctx context.Context, name string, dcName string, mountOpts []string) (
+	err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	audit := d.newAuditEntry(ctx, auditImport, name)
+	audit.Options = map[string]string{"data-container": dcName}
+	defer d.recordAudit(ctx, audit, &err)
+
+	if name == "" || dcName == "" {
+		return newCodedError(errorCodeInvalidRequest, "volume and Data Container names are required")
+	}
+	if _, ok := d.lookupVolume(name); ok {
+		return newCodedError(errorCodeConflict, "volume %s already exists", name)
+	}
+	if other := d.volumeOfDc(dcName); other != "" {
+		return newCodedError(errorCodeConflict, "Data Container %v is already used by volume %v", dcName, other)
+	}
+
+	exists, dc, err := d.backend.dcExists(ctx, dcName)
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to get Data Container", 0))
+	}
+	if !exists {
+		return newCodedError(errorCodeNotFound, "Data Container %v not found", dcName)
+	}
+	dcMeta := parseDcMetadata(dc.Description)
+	if dcMeta.Get(dcMetaTrashedAt) != "" {
+		return newCodedError(errorCodeConflict, "Data Container %v is in the trash - restore it instead", dcName)
+	}
+
+	opts, err := d.mountOptions.apply(mountOpts)
+	if err != nil {
+		return withErrorCode(errorCodeInvalidRequest, err)
+	}
+
+	export, dc, err := d.backend.MaybeCreateDcExport(ctx, &emanage.DcCreateOpts{Name: dc.Name},
+		Ems.defaultExportCreateOpts(), "")
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to get or create Export", 0))
+	}
+
+	v := &elastifileVolume{
+		Mountpoint:    filepath.Join(d.root, name),
+		MountOpts:     opts,
+		Export:        export,
+		DataContainer: dc,
+		Owner:         dcMeta.Owner(),
+		Adopted:       dcMeta.Owner() != d.ownerId,
+		Protected:     dcMeta.Protected(),
+		CreatedAt:     time.Now().UTC(),
+	}
+
+	d.Lock()
+	d.volumes[name] = v
+	if err = d.saveState(); err != nil {
+		delete(d.volumes, name)
+	}
+	d.Unlock()
+	if err != nil {
+		return withErrorCode(errorCodeInternal, err)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		"owner":        v.Owner,
+		"adopted":      v.Adopted,
+	}).Info("Imported Data Container as a volume")
+	return nil
+}
+
+// volumeOfDc returns the name of the volume backed by the Data Container, not counting sub-directory and snapshot
+// volumes, or an empty string if there is none
+func (d *elastifileDriver) volumeOfDc(dcName string) string {
+	d.RLock()
+	defer d.RUnlock()
+	for name, v := range d.volumes {
+		if v.Parent == "" && v.DataContainer != nil && v.DataContainer.Name == dcName {
+			return name
+		}
+	}
+	return ""
+}
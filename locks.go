@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+)
+
+// Locking
+//
+// Each volume has a lock of its own, held throughout operations on the volume, including EMS calls and mounts,
+// so that independent volumes can be created, mounted and removed concurrently.
+// The driver's RWMutex guards the volume map and the state file, and is only held briefly:
+// - Lookups take the read lock
+// - Adding / removing volumes and changing their persisted fields takes the write lock, followed by saveState()
+// Always take the volume lock before the driver lock, never the other way around.
+
+// keyedMutex provides a mutex per key. Mutexes are created on demand and dropped once nobody holds or awaits them.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refCountedMutex
+}
+
+type refCountedMutex struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*refCountedMutex{}}
+}
+
+func (k *keyedMutex) Lock(key string) {
+	k.mu.Lock()
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refCountedMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	k.mu.Unlock()
+
+	m.Lock()
+}
+
+func (k *keyedMutex) Unlock(key string) {
+	k.mu.Lock()
+	m, ok := k.locks[key]
+	if !ok {
+		k.mu.Unlock()
+		panic("unlock of unlocked key " + key)
+	}
+	m.refs--
+	if m.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.mu.Unlock()
+
+	m.Unlock()
+}
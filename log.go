@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Each Docker Volume API request, admin API request and background task gets a correlation ID. The ID and the
+// volume name travel in the operation's context, along with its logger, so that every line logged on its behalf -
+// including the EMS calls and mount commands it makes - carries them.
+
+// Supported values of LOG_FORMAT
+const (
+	logFormatText = "text"
+	logFormatJson = "json"
+)
+
+// Log fields used across the plugin
+const (
+	logFieldRequestId = "request_id"
+	logFieldMethod    = "method"
+	logFieldVolume    = "volume"
+	logFieldDcId      = "dc_id"
+	logFieldDcName    = "dc_name"
+	logFieldExport    = "export"
+	logFieldDuration  = "duration"
+)
+
+type logContextKey struct{}
+
+// configureLogging sets the format and level of the plugin's log. An empty level keeps the current one.
+func configureLogging(format string, level string) error {
+	switch strings.ToLower(format) {
+	case logFormatText, "":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case logFormatJson:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("Unsupported log format: %v", format)
+	}
+
+	if level != "" {
+		parsed, err := logrus.ParseLevel(level)
+		if err != nil {
+			return errors.Errorf("Unsupported log level: %v", level)
+		}
+		logrus.SetLevel(parsed)
+	}
+	return nil
+}
+
+func newRequestId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// newLogContext starts an operation on the volume, or on no specific volume if the name is empty
+func newLogContext(method string, volumeName string) context.Context {
+	fields := logrus.Fields{
+		logFieldRequestId: newRequestId(),
+		logFieldMethod:    method,
+	}
+	if volumeName != "" {
+		fields[logFieldVolume] = volumeName
+	}
+	return context.WithValue(context.Background(), logContextKey{}, logrus.WithFields(fields))
+}
+
+// withLogFields returns a context whose logger adds the fields
+func withLogFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, logContextKey{}, loggerFrom(ctx).WithFields(fields))
+}
+
+// loggerFrom returns the logger of the operation, or the plain logger outside of any operation
+func loggerFrom(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(logContextKey{}).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// requestIdFrom returns the correlation ID of the operation, or an empty string outside of any operation
+func requestIdFrom(ctx context.Context) string {
+	id, _ := loggerFrom(ctx).Data[logFieldRequestId].(string)
+	return id
+}
+
+// logRequestDone logs the outcome and duration of the request, e.g. defer logRequestDone(ctx, time.Now(), &err)
+func logRequestDone(ctx context.Context, start time.Time, err *error) {
+	logger := loggerFrom(ctx).WithField(logFieldDuration, time.Since(start).String())
+	if err != nil && *err != nil {
+		logger.WithError(*err).Warn("Request failed")
+		return
+	}
+	logger.Debug("Request completed")
+}
+
+func logErrorAndReturn(ctx context.Context, format string, args ...interface{}) error {
+	loggerFrom(ctx).Errorf(format, args...)
+	return fmt.Errorf(format, args...)
+}
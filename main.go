@@ -3,11 +3,15 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/go-errors/errors"
 	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/size"
 )
 
 const (
@@ -15,18 +19,31 @@ const (
 	pluginName    = "Elastifile Docker Volume Plugin"
 )
 
-func logErrorAndReturn(format string, args ...interface{}) error {
-	logrus.Errorf(format, args...)
-	return fmt.Errorf(format, args...)
-}
+// listenAddress is the socket the plugin listens on. Can be overridden via SOCKET_ADDRESS, e.g. by the e2e harness.
+var listenAddress = socketAddress
 
 // initFromEnv initializes the plugin configuration from environment variables defined in config.json
 // The variables start with default specified in config.json and can be overridden via docker plugin install/set
 func initFromEnv() {
+	// Not defined in config.json - used to run the plugin outside of Docker, e.g. by the e2e harness
+	if root := os.Getenv("PLUGIN_ROOT"); root != "" {
+		driverInfo.Root = root
+	}
+	if address := os.Getenv("SOCKET_ADDRESS"); address != "" {
+		listenAddress = address
+	}
+
 	driverInfo.RestAddr = os.Getenv("MGMT_ADDRESS")
 	driverInfo.RestUser = os.Getenv("MGMT_USERNAME")
 	driverInfo.RestPass = os.Getenv("MGMT_PASSWORD")
 	driverInfo.StorageAddr = os.Getenv("NFS_ADDRESS")
+	driverInfo.DcNameTemplate = os.Getenv("DC_NAME_TEMPLATE")
+	driverInfo.DcNamePrefix = os.Getenv("DC_NAME_PREFIX")
+	driverInfo.SwarmID = os.Getenv("SWARM_ID")
+	driverInfo.OwnerId = os.Getenv("OWNER_ID")
+	driverInfo.Mounter = os.Getenv("MOUNTER")
+	// Not defined in config.json - selects the in-memory backend of the tests, e.g. when run by the e2e harness
+	driverInfo.StorageBackend = os.Getenv("STORAGE_BACKEND")
 
 	envVarName := "CRUD_IDEMPOTENT"
 	envVarValue := os.Getenv(envVarName)
@@ -38,6 +55,187 @@ func initFromEnv() {
 	}
 	driverInfo.CrudIdempotent = volCrudIdempotent
 
+	envVarName = "ALLOW_FOREIGN_DELETE"
+	envVarValue = os.Getenv(envVarName)
+	allowForeignDelete, err := strconv.ParseBool(envVarValue)
+	if err != nil {
+		err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+			envVarName, envVarValue), 0)
+		logrus.Fatal(err.Error())
+	}
+	driverInfo.AllowForeignDelete = allowForeignDelete
+
+	envVarName = "RETENTION_PERIOD"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		retentionPeriod, err := time.ParseDuration(envVarValue)
+		if err != nil {
+			err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+				envVarName, envVarValue), 0)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.RetentionPeriod = retentionPeriod
+	}
+
+	envVarName = "MOUNT_TIMEOUT"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		mountTimeout, err := time.ParseDuration(envVarValue)
+		if err != nil {
+			err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+				envVarName, envVarValue), 0)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.MountTimeout = mountTimeout
+	}
+
+	envVarName = "MOUNT_RETRIES"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		mountRetries, err := strconv.Atoi(envVarValue)
+		if err != nil || mountRetries < 0 {
+			err = errors.Errorf("Failed to parse environment variable's value. %v='%v'", envVarName, envVarValue)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.MountRetries = mountRetries
+	}
+
+	envVarName = "UNMOUNT_STRATEGY"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		unmountStrategy, err := parseUnmountStrategy(envVarValue)
+		if err != nil {
+			err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+				envVarName, envVarValue), 0)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.UnmountStrategy = unmountStrategy
+	}
+
+	envVarName = "HEALTH_CHECK_INTERVAL"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		healthCheckInterval, err := time.ParseDuration(envVarValue)
+		if err != nil {
+			err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+				envVarName, envVarValue), 0)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.HealthCheckInterval = healthCheckInterval
+	}
+
+	envVarName = "AUTO_REMOUNT"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		autoRemount, err := strconv.ParseBool(envVarValue)
+		if err != nil {
+			err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+				envVarName, envVarValue), 0)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.AutoRemount = autoRemount
+	}
+
+	envVarName = "PROBE_BEFORE_MOUNT"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		probeBeforeMount, err := strconv.ParseBool(envVarValue)
+		if err != nil {
+			err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+				envVarName, envVarValue), 0)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.ProbeBeforeMount = probeBeforeMount
+	}
+
+	envVarName = "DEFAULT_MOUNT_OPTIONS"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		driverInfo.DefaultMountOpts = parseMountOptions(envVarValue)
+	}
+
+	envVarName = "ALLOWED_MOUNT_OPTIONS"
+	driverInfo.AllowedMountOpts = parseMountOptions(os.Getenv(envVarName))
+
+	envVarName = "DENIED_MOUNT_OPTIONS"
+	driverInfo.DeniedMountOpts = parseMountOptions(os.Getenv(envVarName))
+
+	envVarName = "METRICS_ADDRESS"
+	driverInfo.MetricsAddress = os.Getenv(envVarName)
+
+	envVarName = "AUDIT_LOG"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		auditLog, err := strconv.ParseBool(envVarValue)
+		if err != nil {
+			err = errors.WrapPrefix(err, fmt.Sprintf("Failed to parse environment variable's value. %v='%v'",
+				envVarName, envVarValue), 0)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.AuditLog = auditLog
+	}
+
+	envVarName = "AUDIT_LOG_MAX_SIZE"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		auditLogMaxSize, err := size.Parse(envVarValue)
+		if err != nil || auditLogMaxSize == 0 {
+			err = errors.Errorf("Failed to parse environment variable's value. %v='%v'", envVarName, envVarValue)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.AuditLogMaxSize = int64(auditLogMaxSize)
+	}
+
+	envVarName = "AUDIT_LOG_MAX_FILES"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		auditLogMaxFiles, err := strconv.Atoi(envVarValue)
+		if err != nil || auditLogMaxFiles < 1 {
+			err = errors.Errorf("Failed to parse environment variable's value. %v='%v'", envVarName, envVarValue)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.AuditLogMaxFiles = auditLogMaxFiles
+	}
+
+	envVarName = "ADMIN_TOKEN"
+	driverInfo.AdminToken = os.Getenv(envVarName)
+
+	envVarName = "ADMIN_ADDRESS"
+	driverInfo.AdminAddress = os.Getenv(envVarName)
+	driverInfo.AdminTlsCert = os.Getenv("ADMIN_TLS_CERT")
+	driverInfo.AdminTlsKey = os.Getenv("ADMIN_TLS_KEY")
+	driverInfo.AdminTlsClientCa = os.Getenv("ADMIN_TLS_CLIENT_CA")
+	if driverInfo.AdminAddress != "" {
+		if driverInfo.AdminTlsCert == "" || driverInfo.AdminTlsKey == "" {
+			logrus.Fatalf("%v requires ADMIN_TLS_CERT and ADMIN_TLS_KEY", envVarName)
+		}
+		if driverInfo.AdminToken == "" && driverInfo.AdminTlsClientCa == "" {
+			logrus.Fatalf("%v requires ADMIN_TOKEN or ADMIN_TLS_CLIENT_CA to authenticate clients", envVarName)
+		}
+	}
+
+	envVarName = "GC_INTERVAL"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		gcInterval, err := time.ParseDuration(envVarValue)
+		if err != nil || gcInterval < 0 {
+			err = errors.Errorf("Failed to parse environment variable's value. %v='%v'", envVarName, envVarValue)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.GcInterval = gcInterval
+	}
+
+	envVarName = "GC_GRACE_PERIOD"
+	envVarValue = os.Getenv(envVarName)
+	if envVarValue != "" {
+		gcGracePeriod, err := time.ParseDuration(envVarValue)
+		if err != nil || gcGracePeriod < 0 {
+			err = errors.Errorf("Failed to parse environment variable's value. %v='%v'", envVarName, envVarValue)
+			logrus.Fatal(err.Error())
+		}
+		driverInfo.GcGracePeriod = gcGracePeriod
+	}
+
 	envVarName = "DEBUG"
 	envVarValue = os.Getenv(envVarName)
 	enableDebug, err := strconv.ParseBool(envVarValue)
@@ -49,10 +247,30 @@ func initFromEnv() {
 	if enableDebug {
 		logrus.SetLevel(logrus.DebugLevel) // Set logging level
 	}
+
+	envVarName = "LOG_LEVEL" // Overrides DEBUG
+	logLevel := os.Getenv(envVarName)
+	envVarName = "LOG_FORMAT"
+	err = configureLogging(os.Getenv(envVarName), logLevel)
+	if err != nil {
+		logrus.Fatal(err.Error())
+	}
+
+	err = initDcNaming(driverInfo)
+	if err != nil {
+		logrus.Fatal(err.Error())
+	}
 }
 
 func main() {
+	if isCtlInvocation() {
+		os.Exit(runCtl(os.Args[1:]))
+	}
+
 	initFromEnv()
+	if err := initOwnerId(&driverInfo); err != nil {
+		logrus.Fatal(err.Error())
+	}
 
 	logrus.Infof("Initializing %v", pluginName)
 	driver, err := newElastifileDriver(driverInfo)
@@ -61,17 +279,62 @@ func main() {
 		logrus.Fatal(err.Error())
 	}
 
-	handler := volume.NewHandler(driver)
+	if driver.retentionPeriod > 0 {
+		go driver.runTrashPurger()
+	}
+
+	go driver.runOrphanCleaner()
+
+	if driverInfo.GcInterval > 0 {
+		go driver.runGc(driverInfo.GcInterval)
+	}
+
+	if driverInfo.HealthCheckInterval > 0 {
+		go newHealthMonitor(driver, driverInfo.HealthCheckInterval, driverInfo.AutoRemount).run()
+	}
+
+	admin := newAdminServer(driver, driverInfo.AdminToken)
+	adminSocketPath := filepath.Join(driverInfo.Root, "state", adminSocketName)
+	go func() {
+		err := admin.ServeUnix(adminSocketPath)
+		if err != nil {
+			err = errors.WrapPrefix(err, "Admin API failed", 0)
+			logrus.Error(err.Error())
+		}
+	}()
+
+	if driverInfo.AdminAddress != "" {
+		go func() {
+			err := admin.ServeTLS(driverInfo.AdminAddress, driverInfo.AdminTlsCert, driverInfo.AdminTlsKey,
+				driverInfo.AdminTlsClientCa)
+			if err != nil {
+				err = errors.WrapPrefix(err, "Admin API TLS listener failed", 0)
+				logrus.Error(err.Error())
+			}
+		}()
+	}
+
+	if driverInfo.MetricsAddress != "" {
+		go func() {
+			err := driver.serveMetrics(driverInfo.MetricsAddress)
+			if err != nil {
+				err = errors.WrapPrefix(err, "Metrics endpoint failed", 0)
+				logrus.Error(err.Error())
+			}
+		}()
+	}
+
+	handler := volume.NewHandler(&instrumentedDriver{driver})
 	if handler == nil {
 		err = errors.WrapPrefix(err, "Received nil volume handler", 0)
 		logrus.Fatal(err.Error())
 	}
 
-	logrus.Debugf("Getting ready to listen on %s", socketAddress)
-	err = handler.ServeUnix(socketAddress, 0)
+	logrus.Debugf("Getting ready to listen on %s", listenAddress)
+	err = handler.ServeUnix(listenAddress, 0)
 	if err != nil {
 		err = errors.WrapPrefix(err, "Failed to start listener", 0)
 		logrus.Fatal(err.Error())
 	}
-	logrus.Infof("%v initialized - listening on %v", pluginName, socketAddress)
+	logrus.Infof("%v initialized - listening on %v", pluginName, listenAddress)
 }
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// testPluginEnvVar makes the test binary run the plugin instead of the tests. The e2e harness builds the test binary,
+// which includes the fakes, with go test -c and runs it as the plugin.
+const testPluginEnvVar = "EDVP_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if isCtlInvocation() || os.Getenv(testPluginEnvVar) != "" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
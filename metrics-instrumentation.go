@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// Decorators recording the metrics of the Docker Volume API requests, storage backend calls and mounts
+
+// instrumentedDriver records the requests of the Docker Volume API
+type instrumentedDriver struct {
+	volume.Driver
+}
+
+func observeVolumeApi(method string, start time.Time, err error) {
+	volumeApiRequests.inc(method, metricResult(err))
+	observeDuration(volumeApiDuration, start, method)
+}
+
+func (d *instrumentedDriver) Create(r *volume.CreateRequest) (err error) {
+	defer func(start time.Time) { observeVolumeApi("Create", start, err) }(time.Now())
+	return d.Driver.Create(r)
+}
+
+func (d *instrumentedDriver) List() (res *volume.ListResponse, err error) {
+	defer func(start time.Time) { observeVolumeApi("List", start, err) }(time.Now())
+	return d.Driver.List()
+}
+
+func (d *instrumentedDriver) Get(r *volume.GetRequest) (res *volume.GetResponse, err error) {
+	defer func(start time.Time) { observeVolumeApi("Get", start, err) }(time.Now())
+	return d.Driver.Get(r)
+}
+
+func (d *instrumentedDriver) Remove(r *volume.RemoveRequest) (err error) {
+	defer func(start time.Time) { observeVolumeApi("Remove", start, err) }(time.Now())
+	return d.Driver.Remove(r)
+}
+
+func (d *instrumentedDriver) Path(r *volume.PathRequest) (res *volume.PathResponse, err error) {
+	defer func(start time.Time) { observeVolumeApi("Path", start, err) }(time.Now())
+	return d.Driver.Path(r)
+}
+
+func (d *instrumentedDriver) Mount(r *volume.MountRequest) (res *volume.MountResponse, err error) {
+	defer func(start time.Time) { observeVolumeApi("Mount", start, err) }(time.Now())
+	return d.Driver.Mount(r)
+}
+
+func (d *instrumentedDriver) Unmount(r *volume.UnmountRequest) (err error) {
+	defer func(start time.Time) { observeVolumeApi("Unmount", start, err) }(time.Now())
+	return d.Driver.Unmount(r)
+}
+
+func (d *instrumentedDriver) Capabilities() *volume.CapabilitiesResponse {
+	defer func(start time.Time) { observeVolumeApi("Capabilities", start, nil) }(time.Now())
+	return d.Driver.Capabilities()
+}
+
+// instrumentedBackend records and logs the calls of the storage backend, i.e. EMS
+type instrumentedBackend struct {
+	storageBackend
+}
+
+func observeEms(ctx context.Context, endpoint string, start time.Time, err error) {
+	emsRequests.inc(endpoint, metricResult(err))
+	observeDuration(emsDuration, start, endpoint)
+
+	logger := loggerFrom(ctx).WithFields(logrus.Fields{
+		"endpoint":       endpoint,
+		logFieldDuration: time.Since(start).String(),
+	})
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Debug("EMS call completed")
+}
+
+func (b *instrumentedBackend) CreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts,
+	exportOpts *emanage.ExportCreateOpts, policyName string) (export *emanage.Export, dc *emanage.DataContainer, err error) {
+	defer func(start time.Time) { observeEms(ctx, "create_dc_export", start, err) }(time.Now())
+	return b.storageBackend.CreateDcExport(ctx, dcOpts, exportOpts, policyName)
+}
+
+func (b *instrumentedBackend) MaybeCreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts,
+	exportOpts *emanage.ExportCreateOpts, policyName string) (export *emanage.Export, dc *emanage.DataContainer, err error) {
+	defer func(start time.Time) { observeEms(ctx, "create_dc_export", start, err) }(time.Now())
+	return b.storageBackend.MaybeCreateDcExport(ctx, dcOpts, exportOpts, policyName)
+}
+
+func (b *instrumentedBackend) DeleteDcExport(ctx context.Context, v *elastifileVolume) (err error) {
+	defer func(start time.Time) { observeEms(ctx, "delete_dc_export", start, err) }(time.Now())
+	return b.storageBackend.DeleteDcExport(ctx, v)
+}
+
+func (b *instrumentedBackend) MaybeDeleteDcExport(ctx context.Context, v *elastifileVolume) (err error) {
+	defer func(start time.Time) { observeEms(ctx, "delete_dc_export", start, err) }(time.Now())
+	return b.storageBackend.MaybeDeleteDcExport(ctx, v)
+}
+
+func (b *instrumentedBackend) TrashDcExport(ctx context.Context, name string, v *elastifileVolume) (err error) {
+	defer func(start time.Time) { observeEms(ctx, "trash_dc_export", start, err) }(time.Now())
+	return b.storageBackend.TrashDcExport(ctx, name, v)
+}
+
+func (b *instrumentedBackend) CreateExport(ctx context.Context, name string, opts *emanage.ExportCreateOpts) (
+	export emanage.Export, err error) {
+	defer func(start time.Time) { observeEms(ctx, "create_export", start, err) }(time.Now())
+	return b.storageBackend.CreateExport(ctx, name, opts)
+}
+
+func (b *instrumentedBackend) DeleteExport(ctx context.Context, export *emanage.Export) (err error) {
+	defer func(start time.Time) { observeEms(ctx, "delete_export", start, err) }(time.Now())
+	return b.storageBackend.DeleteExport(ctx, export)
+}
+
+func (b *instrumentedBackend) DeleteDc(ctx context.Context, dc *emanage.DataContainer) (err error) {
+	defer func(start time.Time) { observeEms(ctx, "delete_dc", start, err) }(time.Now())
+	return b.storageBackend.DeleteDc(ctx, dc)
+}
+
+func (b *instrumentedBackend) CreateSnapshot(ctx context.Context, dc *emanage.DataContainer, name string) (err error) {
+	defer func(start time.Time) { observeEms(ctx, "create_snapshot", start, err) }(time.Now())
+	return b.storageBackend.CreateSnapshot(ctx, dc, name)
+}
+
+func (b *instrumentedBackend) CloneSnapshot(ctx context.Context, dc *emanage.DataContainer, snapshot string,
+	dcOpts *emanage.DcCreateOpts, exportOpts *emanage.ExportCreateOpts) (
+	export *emanage.Export, clone *emanage.DataContainer, err error) {
+	defer func(start time.Time) { observeEms(ctx, "clone_snapshot", start, err) }(time.Now())
+	return b.storageBackend.CloneSnapshot(ctx, dc, snapshot, dcOpts, exportOpts)
+}
+
+func (b *instrumentedBackend) adoptLegacyDcName(ctx context.Context, dcName string, legacyName string) (
+	name string, err error) {
+	defer func(start time.Time) { observeEms(ctx, "adopt_legacy_dc_name", start, err) }(time.Now())
+	return b.storageBackend.adoptLegacyDcName(ctx, dcName, legacyName)
+}
+
+func (b *instrumentedBackend) allDcs(ctx context.Context) (dcs []emanage.DataContainer, err error) {
+	defer func(start time.Time) { observeEms(ctx, "list_dcs", start, err) }(time.Now())
+	return b.storageBackend.allDcs(ctx)
+}
+
+func (b *instrumentedBackend) allExports(ctx context.Context) (exports []emanage.Export, err error) {
+	defer func(start time.Time) { observeEms(ctx, "list_exports", start, err) }(time.Now())
+	return b.storageBackend.allExports(ctx)
+}
+
+func (b *instrumentedBackend) dcExists(ctx context.Context, dcName string) (
+	exists bool, dc *emanage.DataContainer, err error) {
+	defer func(start time.Time) { observeEms(ctx, "get_dc", start, err) }(time.Now())
+	return b.storageBackend.dcExists(ctx, dcName)
+}
+
+func (b *instrumentedBackend) dcExportPath(ctx context.Context, export *emanage.Export) (path string, err error) {
+	defer func(start time.Time) { observeEms(ctx, "get_export_path", start, err) }(time.Now())
+	return b.storageBackend.dcExportPath(ctx, export)
+}
+
+func (b *instrumentedBackend) policyByName(ctx context.Context, name string) (policy emanage.Policy, err error) {
+	defer func(start time.Time) { observeEms(ctx, "get_policy", start, err) }(time.Now())
+	return b.storageBackend.policyByName(ctx, name)
+}
+
+func (b *instrumentedBackend) policyById(ctx context.Context, id int) (policy emanage.Policy, err error) {
+	defer func(start time.Time) { observeEms(ctx, "get_policy", start, err) }(time.Now())
+	return b.storageBackend.policyById(ctx, id)
+}
+
+func (b *instrumentedBackend) updateDc(ctx context.Context, dcId int, modify func(dc *emanage.DataContainer)) (
+	dc *emanage.DataContainer, err error) {
+	defer func(start time.Time) { observeEms(ctx, "update_dc", start, err) }(time.Now())
+	return b.storageBackend.updateDc(ctx, dcId, modify)
+}
+
+func (b *instrumentedBackend) updateDcMetadata(ctx context.Context, dcId int, key string, value string) (
+	dc *emanage.DataContainer, err error) {
+	defer func(start time.Time) { observeEms(ctx, "update_dc_metadata", start, err) }(time.Now())
+	return b.storageBackend.updateDcMetadata(ctx, dcId, key, value)
+}
+
+// instrumentedMounter records and logs the mount and unmount operations, including their retries
+type instrumentedMounter struct {
+	mounter mounter
+}
+
+func observeMount(ctx context.Context, operation string, start time.Time, err error) {
+	mountOperations.inc(operation, metricResult(err))
+	observeDuration(mountDuration, start, operation)
+
+	logger := loggerFrom(ctx).WithFields(logrus.Fields{
+		"operation":      operation,
+		logFieldDuration: time.Since(start).String(),
+	})
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Debug("Mount operation completed")
+}
+
+func (m *instrumentedMounter) Mount(ctx context.Context, source string, target string, opts []string) (err error) {
+	defer func(start time.Time) { observeMount(ctx, "mount", start, err) }(time.Now())
+	return m.mounter.Mount(ctx, source, target, opts)
+}
+
+func (m *instrumentedMounter) Bind(ctx context.Context, source string, target string, opts []string) (err error) {
+	defer func(start time.Time) { observeMount(ctx, "bind", start, err) }(time.Now())
+	return m.mounter.Bind(ctx, source, target, opts)
+}
+
+func (m *instrumentedMounter) Unmount(ctx context.Context, target string) (err error) {
+	defer func(start time.Time) { observeMount(ctx, "unmount", start, err) }(time.Now())
+	return m.mounter.Unmount(ctx, target)
+}
+
+func (m *instrumentedMounter) ForceUnmount(ctx context.Context, target string) (err error) {
+	defer func(start time.Time) { observeMount(ctx, "force_unmount", start, err) }(time.Now())
+	return m.mounter.ForceUnmount(ctx, target)
+}
+
+func (m *instrumentedMounter) Detach(ctx context.Context, target string) (err error) {
+	defer func(start time.Time) { observeMount(ctx, "detach", start, err) }(time.Now())
+	return m.mounter.Detach(ctx, target)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The plugin exposes its metrics in the Prometheus text format on METRICS_ADDRESS - host:port, or unix://<path>.
+// Counters and histograms are recorded by the decorators in metrics-instrumentation.go, gauges are collected from
+// the driver's state on each scrape.
+
+const (
+	metricsPath       = "/metrics"
+	metricsUnixPrefix = "unix://"
+)
+
+// Result label values
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+// Buckets of the duration histograms, in seconds. Mounts may take up to MOUNT_TIMEOUT for each attempt.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	volumeApiRequests = newCounterVec("edvp_volume_api_requests_total",
+		"Docker Volume API requests, by method and result", "method", "result")
+	volumeApiDuration = newHistogramVec("edvp_volume_api_request_duration_seconds",
+		"Duration of Docker Volume API requests, by method", durationBuckets, "method")
+	emsRequests = newCounterVec("edvp_ems_requests_total",
+		"Storage backend (EMS) calls, by endpoint and result", "endpoint", "result")
+	emsDuration = newHistogramVec("edvp_ems_request_duration_seconds",
+		"Duration of storage backend (EMS) calls, by endpoint", durationBuckets, "endpoint")
+	mountOperations = newCounterVec("edvp_mount_operations_total",
+		"Mount and unmount operations, by operation and result", "operation", "result")
+	mountDuration = newHistogramVec("edvp_mount_operation_duration_seconds",
+		"Duration of mount and unmount operations including retries, by operation", durationBuckets, "operation")
+)
+
+// metricsCollectors are written on each scrape, in this order
+var metricsCollectors = []metricsCollector{
+	volumeApiRequests, volumeApiDuration,
+	emsRequests, emsDuration,
+	mountOperations, mountDuration,
+}
+
+type metricsCollector interface {
+	writeMetrics(w io.Writer)
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	values     map[string]float64 // By formatted labels
+}
+
+func newCounterVec(name string, help string, labelNames ...string) *counterVec {
+	return &counterVec{name: name, help: help, labelNames: labelNames, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := formatLabels(c.labelNames, labelValues)
+	c.Lock()
+	defer c.Unlock()
+	c.values[key]++
+}
+
+func (c *counterVec) writeMetrics(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a histogram partitioned by label values
+type histogramVec struct {
+	sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64 // Upper bounds, sorted
+	series     map[string]*histogram
+	labels     map[string][]string // Label values by formatted labels
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*histogram{},
+		labels:     map[string][]string{},
+	}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := formatLabels(h.labelNames, labelValues)
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+		h.labels[key] = labelValues
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *histogramVec) writeMetrics(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	writeMetricHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		names := append(append([]string{}, h.labelNames...), "le")
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name,
+				formatLabels(names, append(append([]string{}, h.labels[key]...), formatFloat(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name,
+			formatLabels(names, append(append([]string{}, h.labels[key]...), "+Inf")), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, key, s.count)
+	}
+}
+
+// gaugeSample is a single value of a gauge collected on scrape
+type gaugeSample struct {
+	labelValues []string
+	value       float64
+}
+
+func writeGauge(w io.Writer, name string, help string, labelNames []string, samples []gaugeSample) {
+	writeMetricHeader(w, name, help, "gauge")
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(labelNames, sample.labelValues), formatFloat(sample.value))
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the label pairs as {name="value",...}, or an empty string if there are no labels
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%v="%v"`, name, labelValueEscaper.Replace(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetrics writes the recorded metrics and the driver's gauges in the Prometheus text format
+func (d *elastifileDriver) writeMetrics(ctx context.Context, w io.Writer) {
+	for _, collector := range metricsCollectors {
+		collector.writeMetrics(w)
+	}
+
+	d.RLock()
+	volumeCount := len(d.volumes)
+	var activeMounts int
+	dcVolumes := map[int][]string{} // Names of the volumes backed by their own Data Container, by DC ID
+	for name, v := range d.volumes {
+		activeMounts += len(v.mountIds)
+		if v.Parent == "" && v.DataContainer != nil {
+			dcVolumes[v.DataContainer.Id] = append(dcVolumes[v.DataContainer.Id], name)
+		}
+	}
+	d.RUnlock()
+
+	writeGauge(w, "edvp_volumes", "Volumes managed by the plugin", nil,
+		[]gaugeSample{{value: float64(volumeCount)}})
+	writeGauge(w, "edvp_active_mounts", "Docker mounts of the plugin's volumes", nil,
+		[]gaugeSample{{value: float64(activeMounts)}})
+
+	// A single EMS call, rather than one per volume
+	var used, quota []gaugeSample
+	dcs, err := d.backend.allDcs(ctx)
+	if err != nil {
+		loggerFrom(ctx).WithError(err).Warn("Failed to collect volume usage metrics")
+	}
+	for _, dc := range dcs {
+		for _, name := range dcVolumes[dc.Id] {
+			labels := []string{name, dc.Name}
+			used = append(used, gaugeSample{labels, float64(dc.UsedCapacity)})
+			quota = append(quota, gaugeSample{labels, float64(dc.HardQuota)})
+		}
+	}
+	sortGaugeSamples(used)
+	sortGaugeSamples(quota)
+	volumeLabels := []string{"volume", "data_container"}
+	writeGauge(w, "edvp_volume_used_bytes", "Used capacity of the volume's Data Container, as reported by EMS",
+		volumeLabels, used)
+	writeGauge(w, "edvp_volume_quota_bytes", "Hard quota of the volume's Data Container", volumeLabels, quota)
+}
+
+func sortGaugeSamples(samples []gaugeSample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, ",") < strings.Join(samples[j].labelValues, ",")
+	})
+}
+
+func (d *elastifileDriver) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	d.writeMetrics(newLogContext("metrics", ""), &buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// serveMetrics serves the metrics on the address, either host:port or unix://<path>
+func (d *elastifileDriver) serveMetrics(address string) error {
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(address, metricsUnixPrefix) {
+		socketPath := strings.TrimPrefix(address, metricsUnixPrefix)
+		if err = os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return errors.WrapPrefix(err, "Failed to remove stale metrics socket", 0)
+		}
+		listener, err = net.Listen("unix", socketPath)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to listen on metrics address", 0)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, d.handleMetrics)
+	logrus.Infof("Metrics available on %v%v", address, metricsPath)
+	return http.Serve(listener, mux)
+}
+
+func observeDuration(h *histogramVec, start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func metricResult(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultSuccess
+}
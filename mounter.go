@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported values of MOUNTER
+const (
+	mounterNative = "native" // mount(2)/umount2(2) syscalls, falling back to the mount binary on non-actionable errors
+	mounterExec   = "exec"   // mount/umount binaries of the plugin's rootfs
+)
+
+// mounters create the mounters by their MOUNTER value. The tests add their fakes.
+var mounters = map[string]func() (mounter, error){
+	mounterNative: func() (mounter, error) {
+		return &fallbackMounter{
+			primary:  newNativeMounter(),
+			fallback: &execMounter{},
+		}, nil
+	},
+	mounterExec: func() (mounter, error) { return &execMounter{}, nil },
+}
+
+const (
+	mountRetryBackoff = time.Second     // Delay before the first retry of a failed mount, doubled on each retry
+	killGracePeriod   = 5 * time.Second // How long to wait for a killed mount process to exit before abandoning it
+)
+
+// mounter mounts NFS exports on the plugin's host. Implementations give up once ctx is done.
+type mounter interface {
+	Mount(ctx context.Context, source string, target string, opts []string) error
+	// Bind bind-mounts a local directory, e.g. a sub-directory of a shared mount. Supports the ro option only.
+	Bind(ctx context.Context, source string, target string, opts []string) error
+	Unmount(ctx context.Context, target string) error
+	// ForceUnmount aborts pending NFS requests of the target and unmounts it
+	ForceUnmount(ctx context.Context, target string) error
+	// Detach lazily unmounts the target, even if it is busy or the NFS server doesn't respond
+	Detach(ctx context.Context, target string) error
+}
+
+func newMounter(kind string) (mounter, error) {
+	if kind == "" {
+		kind = mounterNative
+	}
+	create, ok := mounters[kind]
+	if !ok {
+		return nil, errors.Errorf("Unsupported mounter: %v", kind)
+	}
+	return create()
+}
+
+// execMounter shells out to the mount/umount binaries
+type execMounter struct{}
+
+func (m *execMounter) Mount(ctx context.Context, source string, target string, opts []string) error {
+	var mountArgs []string
+	if len(opts) > 0 {
+		mountArgs = append(mountArgs, "-o", strings.Join(opts, ","))
+	}
+	mountArgs = append(mountArgs, source, target)
+
+	output, err := runCommand(ctx, "mount", mountArgs...)
+	if err != nil {
+		return errors.Errorf("mount command failed: %v (%s)", err, output)
+	}
+	loggerFrom(ctx).Debug("Mounted", output)
+	return nil
+}
+
+func (m *execMounter) Bind(ctx context.Context, source string, target string, opts []string) error {
+	output, err := runCommand(ctx, "mount", "--bind", source, target)
+	if err != nil {
+		return errors.Errorf("mount --bind command failed: %v (%s)", err, output)
+	}
+	if hasMountOption(opts, "ro") { // Read-only bind mounts take a remount
+		output, err = runCommand(ctx, "mount", "-o", "remount,bind,ro", target)
+		if err != nil {
+			runCommand(ctx, "umount", target)
+			return errors.Errorf("read-only remount command failed: %v (%s)", err, output)
+		}
+	}
+	return nil
+}
+
+func (m *execMounter) Unmount(ctx context.Context, target string) error {
+	output, err := runCommand(ctx, "umount", target)
+	if err != nil {
+		return errors.Errorf("umount command failed: %v (%s)", err, output)
+	}
+	return nil
+}
+
+func (m *execMounter) ForceUnmount(ctx context.Context, target string) error {
+	output, err := runCommand(ctx, "umount", "-f", target)
+	if err != nil {
+		return errors.Errorf("umount -f command failed: %v (%s)", err, output)
+	}
+	return nil
+}
+
+func (m *execMounter) Detach(ctx context.Context, target string) error {
+	output, err := runCommand(ctx, "umount", "-l", target)
+	if err != nil {
+		return errors.Errorf("umount -l command failed: %v (%s)", err, output)
+	}
+	return nil
+}
+
+// runCommand runs the command, killing it along with its children (e.g. mount.nfs) once ctx is done
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var output bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	setProcessGroup(cmd)
+
+	loggerFrom(ctx).Debugf("Executing: %s", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return output.Bytes(), err
+	case <-ctx.Done():
+	}
+
+	loggerFrom(ctx).WithField("pid", cmd.Process.Pid).Warnf("Killing %s: %v", cmd.Args, ctx.Err())
+	killProcessGroup(cmd)
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		// Processes stuck in the kernel can't be killed until they return - reaped in the background
+		loggerFrom(ctx).WithField("pid", cmd.Process.Pid).Errorf("%s didn't exit after being killed, abandoning it", cmd.Args)
+	}
+	return nil, errors.Errorf("%v was killed: %v", name, ctx.Err())
+}
+
+// fallbackMounter uses the fallback mounter when the primary one fails for reasons the user can't act upon,
+// e.g. mount options the native implementation doesn't handle
+type fallbackMounter struct {
+	primary  mounter
+	fallback mounter
+}
+
+func (m *fallbackMounter) Mount(ctx context.Context, source string, target string, opts []string) error {
+	err := m.primary.Mount(ctx, source, target, opts)
+	if err == nil || isActionableMountError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"source": source,
+		"target": target,
+	}).Warnf("Native mount failed, falling back to mount command: %v", err)
+	return m.fallback.Mount(ctx, source, target, opts)
+}
+
+func (m *fallbackMounter) Bind(ctx context.Context, source string, target string, opts []string) error {
+	err := m.primary.Bind(ctx, source, target, opts)
+	if err == nil || isActionableMountError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"source": source,
+		"target": target,
+	}).Warnf("Native bind mount failed, falling back to mount command: %v", err)
+	return m.fallback.Bind(ctx, source, target, opts)
+}
+
+func (m *fallbackMounter) Unmount(ctx context.Context, target string) error {
+	err := m.primary.Unmount(ctx, target)
+	if err == nil || isActionableMountError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	loggerFrom(ctx).WithField("target", target).Warnf("Native unmount failed, falling back to umount command: %v", err)
+	return m.fallback.Unmount(ctx, target)
+}
+
+func (m *fallbackMounter) ForceUnmount(ctx context.Context, target string) error {
+	err := m.primary.ForceUnmount(ctx, target)
+	if err == nil || isActionableMountError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	loggerFrom(ctx).WithField("target", target).Warnf("Native forced unmount failed, falling back to umount command: %v", err)
+	return m.fallback.ForceUnmount(ctx, target)
+}
+
+func (m *fallbackMounter) Detach(ctx context.Context, target string) error {
+	err := m.primary.Detach(ctx, target)
+	if err == nil || isActionableMountError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	loggerFrom(ctx).WithField("target", target).Warnf("Native detach failed, falling back to umount command: %v", err)
+	return m.fallback.Detach(ctx, target)
+}
+
+// retryMounter bounds each mount/unmount attempt by a timeout, so that an unreachable NFS server can't block
+// the driver indefinitely. Failed mounts are retried with exponential backoff, unless the error isn't transient.
+type retryMounter struct {
+	mounter
+
+	timeout time.Duration // Zero disables the timeout
+	retries int
+	backoff time.Duration
+}
+
+func newRetryMounter(m mounter, timeout time.Duration, retries int) *retryMounter {
+	return &retryMounter{
+		mounter: m,
+		timeout: timeout,
+		retries: retries,
+		backoff: mountRetryBackoff,
+	}
+}
+
+func (m *retryMounter) Mount(ctx context.Context, source string, target string, opts []string) error {
+	backoff := m.backoff
+	for attempt := 1; ; attempt++ {
+		err := m.withTimeout(ctx, func(ctx context.Context) error {
+			return m.mounter.Mount(ctx, source, target, opts)
+		})
+		if err == nil {
+			return nil
+		}
+
+		if attempt > m.retries || ctx.Err() != nil || !isRetryableMountError(err) {
+			if attempt > 1 {
+				return errors.WrapPrefix(err, fmt.Sprintf("Giving up after %v attempts", attempt), 0)
+			}
+			return err
+		}
+
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"source":  source,
+			"target":  target,
+			"attempt": attempt,
+			"backoff": backoff,
+		}).Warnf("Mount failed, retrying: %v", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (m *retryMounter) Bind(ctx context.Context, source string, target string, opts []string) error {
+	return m.withTimeout(ctx, func(ctx context.Context) error {
+		return m.mounter.Bind(ctx, source, target, opts)
+	})
+}
+
+func (m *retryMounter) Unmount(ctx context.Context, target string) error {
+	return m.withTimeout(ctx, func(ctx context.Context) error {
+		return m.mounter.Unmount(ctx, target)
+	})
+}
+
+func (m *retryMounter) ForceUnmount(ctx context.Context, target string) error {
+	return m.withTimeout(ctx, func(ctx context.Context) error {
+		return m.mounter.ForceUnmount(ctx, target)
+	})
+}
+
+func (m *retryMounter) Detach(ctx context.Context, target string) error {
+	return m.withTimeout(ctx, func(ctx context.Context) error {
+		return m.mounter.Detach(ctx, target)
+	})
+}
+
+// withTimeout runs a single attempt bounded by the timeout
+func (m *retryMounter) withTimeout(ctx context.Context, attempt func(ctx context.Context) error) error {
+	if m.timeout <= 0 {
+		return attempt(ctx)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	err := attempt(attemptCtx)
+	if err != nil && attemptCtx.Err() == context.DeadlineExceeded {
+		return &mountTimeoutError{timeout: m.timeout, err: err}
+	}
+	return err
+}
+
+// mountTimeoutError is returned when a mount/unmount attempt didn't complete in time
+type mountTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *mountTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v - check that the NFS server is reachable (%v)", e.timeout, e.err)
+}
+
+func splitNfsSource(source string) (host string, exportPath string, err error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("malformed NFS source %v - expected <host>:<path>", source)
+	}
+	host, exportPath = parts[0], parts[1]
+	if !strings.HasPrefix(exportPath, "/") {
+		exportPath = "/" + exportPath
+	}
+	return
+}
+
+func hasMountOption(opts []string, option string) bool {
+	for _, opt := range opts {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
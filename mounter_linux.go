@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultNfsVersion = "3"
+
+// mountFlags maps generic mount options to mount(2) flags. All other options are passed to the NFS client as is.
+var mountFlags = map[string]uintptr{
+	"ro":         syscall.MS_RDONLY,
+	"rw":         0,
+	"nosuid":     syscall.MS_NOSUID,
+	"suid":       0,
+	"nodev":      syscall.MS_NODEV,
+	"dev":        0,
+	"noexec":     syscall.MS_NOEXEC,
+	"exec":       0,
+	"sync":       syscall.MS_SYNCHRONOUS,
+	"async":      0,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+	"defaults":   0,
+}
+
+// mountError is returned by the native mounter, with errno mapped to an actionable message
+type mountError struct {
+	errno   syscall.Errno
+	message string
+}
+
+func (e *mountError) Error() string {
+	return fmt.Sprintf("%v (%v)", e.message, e.errno.Error())
+}
+
+// pendingOperationError is returned while an operation on the target may still complete in the background
+type pendingOperationError struct {
+	message string
+}
+
+func (e *pendingOperationError) Error() string {
+	return e.message
+}
+
+// isActionableMountError tells whether the error describes a problem the user should fix,
+// as opposed to a limitation of the native mounter. Pending operations count as the former, as the fallback
+// mounter would race them.
+func isActionableMountError(err error) bool {
+	if wrapped, ok := err.(*errors.Error); ok {
+		err = wrapped.Err
+	}
+	if _, ok := err.(*pendingOperationError); ok {
+		return true
+	}
+	mErr, ok := err.(*mountError)
+	if !ok {
+		return false
+	}
+
+	switch mErr.errno {
+	case syscall.EACCES, syscall.EPERM, syscall.ETIMEDOUT, syscall.ENOENT, syscall.ECONNREFUSED,
+		syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EBUSY:
+		return true
+	}
+	return false
+}
+
+// isRetryableMountError tells whether the failure may be transient, e.g. the NFS server being unreachable,
+// as opposed to a problem that retrying won't solve, e.g. access denied
+func isRetryableMountError(err error) bool {
+	if wrapped, ok := err.(*errors.Error); ok {
+		err = wrapped.Err
+	}
+	if pErr, ok := err.(*probeError); ok {
+		return pErr.transient
+	}
+	mErr, ok := err.(*mountError)
+	if !ok {
+		return true // Timeouts, mount command failures
+	}
+
+	switch mErr.errno {
+	case syscall.ETIMEDOUT, syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+		return true
+	}
+	return false
+}
+
+// statfs returns the usage of the file system mounted on path
+func statfs(path string) (fsUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fsUsage{}, err
+	}
+	blockSize := uint64(st.Bsize)
+	return fsUsage{
+		Size:      st.Blocks * blockSize,
+		Used:      (st.Blocks - st.Bfree) * blockSize,
+		Available: st.Bavail * blockSize,
+	}, nil
+}
+
+// isStaleMountError tells whether the NFS file handle of the mount is no longer valid
+func isStaleMountError(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ESTALE
+}
+
+// setProcessGroup makes the command a process group leader, so that its children can be killed along with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// nativeMounter mounts NFS exports via mount(2) / umount2(2), without relying on the mount binary.
+// The syscalls can't be interrupted - once ctx is done they are abandoned, and complete in the background.
+type nativeMounter struct {
+	sync.Mutex
+
+	pending map[string]bool // Targets with an abandoned syscall still in progress
+}
+
+func newNativeMounter() mounter {
+	return &nativeMounter{pending: map[string]bool{}}
+}
+
+func (m *nativeMounter) Mount(ctx context.Context, source string, target string, opts []string) error {
+	host, exportPath, err := splitNfsSource(source)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return errors.Errorf("failed to resolve NFS server address %v: %v", host, err)
+	}
+	addr := addrs[0].IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			addr = a.IP
+			break
+		}
+	}
+
+	flags, data := nfsMountData(opts, addr.String())
+	device := fmt.Sprintf("%v:%v", host, exportPath)
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"device": device,
+		"target": target,
+		"flags":  flags,
+		"data":   data,
+	}).Debug("Mounting via mount(2)")
+	err = m.run(ctx, target, func() error {
+		return syscall.Mount(device, target, "nfs", flags, data)
+	}, func() {
+		// Nobody is going to use or unmount it - a later attempt would mount on top of it
+		loggerFrom(ctx).WithField("target", target).Warn("Abandoned mount completed, detaching it")
+		syscall.Unmount(target, syscall.MNT_DETACH)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return newMountError(err, host, exportPath, target)
+	}
+	return nil
+}
+
+func (m *nativeMounter) Bind(ctx context.Context, source string, target string, opts []string) error {
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"source": source,
+		"target": target,
+		"opts":   opts,
+	}).Debug("Bind mounting via mount(2)")
+	err := m.run(ctx, target, func() error {
+		if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+		if !hasMountOption(opts, "ro") {
+			return nil
+		}
+		// Read-only bind mounts take a remount
+		err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		if err != nil {
+			syscall.Unmount(target, 0)
+		}
+		return err
+	}, func() {
+		loggerFrom(ctx).WithField("target", target).Warn("Abandoned bind mount completed, detaching it")
+		syscall.Unmount(target, syscall.MNT_DETACH)
+	})
+	if err != nil && ctx.Err() == nil {
+		return errors.Errorf("failed to bind mount %v on %v: %v", source, target, err)
+	}
+	return err
+}
+
+func (m *nativeMounter) Unmount(ctx context.Context, target string) error {
+	return m.unmount(ctx, target, 0)
+}
+
+func (m *nativeMounter) ForceUnmount(ctx context.Context, target string) error {
+	return m.unmount(ctx, target, syscall.MNT_FORCE)
+}
+
+func (m *nativeMounter) Detach(ctx context.Context, target string) error {
+	return m.unmount(ctx, target, syscall.MNT_DETACH)
+}
+
+func (m *nativeMounter) unmount(ctx context.Context, target string, flags int) error {
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"target": target,
+		"flags":  flags,
+	}).Debug("Unmounting via umount2(2)")
+	err := m.run(ctx, target, func() error {
+		return syscall.Unmount(target, flags)
+	}, func() {
+		loggerFrom(ctx).WithField("target", target).Info("Abandoned unmount completed")
+	})
+	if err != nil && ctx.Err() == nil {
+		errno, _ := err.(syscall.Errno)
+		switch errno {
+		case syscall.EBUSY:
+			return &mountError{errno: errno, message: fmt.Sprintf("%v is busy", target)}
+		case syscall.EINVAL:
+			return &mountError{errno: errno, message: fmt.Sprintf("%v is not mounted", target)}
+		case syscall.EPERM:
+			return &mountError{errno: errno, message: "permission denied - the plugin lacks CAP_SYS_ADMIN"}
+		}
+		return errors.Errorf("failed to unmount %v: %v", target, err)
+	}
+	return err
+}
+
+// run executes the syscall, abandoning it once ctx is done. Another syscall on the same target
+// isn't attempted until the abandoned one completes, after which lateSuccess is called if it succeeded.
+func (m *nativeMounter) run(ctx context.Context, target string, syscallFunc func() error, lateSuccess func()) error {
+	m.Lock()
+	if m.pending[target] {
+		m.Unlock()
+		return &pendingOperationError{message: fmt.Sprintf("a previous operation on %v is still in progress", target)}
+	}
+	m.pending[target] = true
+	m.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- syscallFunc()
+	}()
+
+	select {
+	case err := <-result:
+		m.done(target)
+		return err
+	case <-ctx.Done():
+	}
+
+	go func() {
+		defer m.done(target)
+		if err := <-result; err == nil {
+			lateSuccess()
+		}
+	}()
+	return &pendingOperationError{message: fmt.Sprintf("abandoned operation on %v: %v", target, ctx.Err())}
+}
+
+func (m *nativeMounter) done(target string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.pending, target)
+}
+
+// nfsMountData splits mount options into mount(2) flags and the NFS client's option string
+func nfsMountData(opts []string, addr string) (flags uintptr, data string) {
+	var nfsOpts []string
+	hasVersion := false
+	for _, opt := range opts {
+		if flag, ok := mountFlags[opt]; ok {
+			flags |= flag
+			continue
+		}
+		if strings.HasPrefix(opt, "vers=") || strings.HasPrefix(opt, "nfsvers=") {
+			hasVersion = true
+		}
+		if strings.HasPrefix(opt, "addr=") {
+			continue // Resolved by the mounter
+		}
+		nfsOpts = append(nfsOpts, opt)
+	}
+
+	if !hasVersion {
+		nfsOpts = append(nfsOpts, "vers="+defaultNfsVersion)
+	}
+	nfsOpts = append(nfsOpts, "addr="+addr)
+	return flags, strings.Join(nfsOpts, ",")
+}
+
+func newMountError(err error, host string, exportPath string, target string) error {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return errors.Errorf("mount of %v:%v on %v failed: %v", host, exportPath, target, err)
+	}
+
+	var message string
+	switch errno {
+	case syscall.EACCES:
+		message = fmt.Sprintf("access denied - NFS server %v refused to export %v to this client", host, exportPath)
+	case syscall.EPERM:
+		message = "permission denied - the plugin lacks CAP_SYS_ADMIN or the NFS server rejected the client"
+	case syscall.ETIMEDOUT:
+		message = fmt.Sprintf("timed out waiting for NFS server %v", host)
+	case syscall.ENOENT:
+		message = fmt.Sprintf("export %v not found on NFS server %v", exportPath, host)
+	case syscall.ECONNREFUSED:
+		message = fmt.Sprintf("NFS server %v refused the connection", host)
+	case syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+		message = fmt.Sprintf("NFS server %v is unreachable", host)
+	case syscall.EBUSY:
+		message = fmt.Sprintf("%v is busy or already mounted", target)
+	case syscall.ENODEV:
+		message = "NFS is not supported by the host's kernel"
+	case syscall.EINVAL:
+		message = "invalid mount options"
+	default:
+		message = fmt.Sprintf("mount of %v:%v on %v failed", host, exportPath, target)
+	}
+	return &mountError{errno: errno, message: message}
+}
@@ -0,0 +1,67 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/go-errors/errors"
+)
+
+// The native mounter is only available on Linux - elsewhere the mount binary is always used
+
+type nativeMounter struct{}
+
+func newNativeMounter() mounter {
+	return &nativeMounter{}
+}
+
+func (m *nativeMounter) Mount(ctx context.Context, source string, target string, opts []string) error {
+	return errors.New("native mount is not supported on this platform")
+}
+
+func (m *nativeMounter) Bind(ctx context.Context, source string, target string, opts []string) error {
+	return errors.New("native bind mount is not supported on this platform")
+}
+
+func (m *nativeMounter) Unmount(ctx context.Context, target string) error {
+	return errors.New("native unmount is not supported on this platform")
+}
+
+func isActionableMountError(err error) bool {
+	return false
+}
+
+func (m *nativeMounter) ForceUnmount(ctx context.Context, target string) error {
+	return errors.New("native forced unmount is not supported on this platform")
+}
+
+func (m *nativeMounter) Detach(ctx context.Context, target string) error {
+	return errors.New("native detach is not supported on this platform")
+}
+
+func isRetryableMountError(err error) bool {
+	if wrapped, ok := err.(*errors.Error); ok {
+		err = wrapped.Err
+	}
+	if pErr, ok := err.(*probeError); ok {
+		return pErr.transient
+	}
+	return true
+}
+
+func statfs(path string) (fsUsage, error) {
+	return fsUsage{}, errors.New("statfs is not supported on this platform")
+}
+
+func isStaleMountError(err error) bool {
+	return false
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Mount options of new volumes start with the admin's defaults (DEFAULT_MOUNT_OPTIONS), overridden by the options
+// specified when the volume is created. Options specified by users are validated and checked against the allow and
+// deny lists (ALLOWED_MOUNT_OPTIONS, DENIED_MOUNT_OPTIONS). List entries are either option names, e.g. nosharecache,
+// or complete options, e.g. sec=none, and match the aliases of the options as well, e.g. nfsvers=4 for vers=4.
+
+var mountOptionNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Aliases of NFS mount option names
+var mountOptionAliases = map[string]string{
+	"nfsvers": "vers",
+}
+
+// Mutually exclusive NFS mount options - specifying one of them overrides the other
+var exclusiveMountOptions = map[string]string{
+	"hard":         "soft",
+	"soft":         "hard",
+	"lock":         "nolock",
+	"nolock":       "lock",
+	"ro":           "rw",
+	"rw":           "ro",
+	"ac":           "noac",
+	"noac":         "ac",
+	"cto":          "nocto",
+	"nocto":        "cto",
+	"intr":         "nointr",
+	"nointr":       "intr",
+	"sync":         "async",
+	"async":        "sync",
+	"atime":        "noatime",
+	"noatime":      "atime",
+	"diratime":     "nodiratime",
+	"nodiratime":   "diratime",
+	"suid":         "nosuid",
+	"nosuid":       "suid",
+	"dev":          "nodev",
+	"nodev":        "dev",
+	"exec":         "noexec",
+	"noexec":       "exec",
+	"sharecache":   "nosharecache",
+	"nosharecache": "sharecache",
+	"resvport":     "noresvport",
+	"noresvport":   "resvport",
+	"acl":          "noacl",
+	"noacl":        "acl",
+	"rdirplus":     "nordirplus",
+	"nordirplus":   "rdirplus",
+}
+
+// Validation of the values of NFS mount options
+var mountOptionValidators = map[string]func(value string) error{
+	"vers":        oneOf("3", "4", "4.0", "4.1", "4.2"),
+	"proto":       oneOf("tcp", "udp", "rdma", "tcp6", "udp6", "rdma6"),
+	"mountproto":  oneOf("tcp", "udp", "tcp6", "udp6"),
+	"sec":         oneOf("sys", "none", "krb5", "krb5i", "krb5p"),
+	"lookupcache": oneOf("all", "positive", "pos", "none"),
+	"local_lock":  oneOf("all", "flock", "posix", "none"),
+	"timeo":       unsignedInt,
+	"retrans":     unsignedInt,
+	"retry":       unsignedInt,
+	"rsize":       unsignedInt,
+	"wsize":       unsignedInt,
+	"acregmin":    unsignedInt,
+	"acregmax":    unsignedInt,
+	"acdirmin":    unsignedInt,
+	"acdirmax":    unsignedInt,
+	"actimeo":     unsignedInt,
+	"port":        unsignedInt,
+	"mountport":   unsignedInt,
+	"namlen":      unsignedInt,
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return errors.Errorf("expected one of %v", strings.Join(values, ", "))
+	}
+}
+
+func unsignedInt(value string) error {
+	if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+		return errors.New("expected a non-negative integer")
+	}
+	return nil
+}
+
+// mountOptionPolicy controls the mount options of the volumes
+type mountOptionPolicy struct {
+	defaults []string
+	allowed  []string // Any option may be specified if empty
+	denied   []string
+}
+
+func newMountOptionPolicy(defaults []string, allowed []string, denied []string) (*mountOptionPolicy, error) {
+	for _, opt := range defaults {
+		if err := validateMountOption(opt); err != nil {
+			return nil, errors.WrapPrefix(err, "Invalid default mount option", 0)
+		}
+	}
+	return &mountOptionPolicy{
+		defaults: mergeMountOptions(nil, defaults),
+		allowed:  allowed,
+		denied:   denied,
+	}, nil
+}
+
+// parseMountOptions splits a comma separated list of mount options
+func parseMountOptions(value string) (opts []string) {
+	for _, opt := range strings.Split(value, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// mountOption composes the mount option from a volume creation argument
+func mountOption(key string, value string) string {
+	if value == "" {
+		return key
+	}
+	return key + "=" + value
+}
+
+func splitMountOption(opt string) (name string, value string, hasValue bool) {
+	parts := strings.SplitN(opt, "=", 2)
+	name = parts[0]
+	if alias, ok := mountOptionAliases[name]; ok {
+		name = alias
+	}
+	if len(parts) == 2 {
+		return name, parts[1], true
+	}
+	return name, "", false
+}
+
+// validateMountOption verifies the option is well-formed, and its value is valid for the known NFS options
+func validateMountOption(opt string) error {
+	name, value, hasValue := splitMountOption(opt)
+	if !mountOptionNameRegexp.MatchString(name) {
+		return errors.Errorf("Invalid mount option: '%v'", opt)
+	}
+	if strings.ContainsAny(value, ", \t\n") {
+		return errors.Errorf("Invalid value of mount option %v: '%v'", name, value)
+	}
+
+	if _, ok := exclusiveMountOptions[name]; ok && hasValue {
+		return errors.Errorf("Mount option %v doesn't take a value", name)
+	}
+	if validate, ok := mountOptionValidators[name]; ok {
+		if !hasValue {
+			return errors.Errorf("Mount option %v requires a value", name)
+		}
+		if err := validate(value); err != nil {
+			return errors.Errorf("Invalid value of mount option %v: '%v' - %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// matchesMountOption tells whether the option is one of the list entries, which are either names or complete options.
+// Names are compared after resolving aliases, e.g. nfsvers=4 matches vers=4.
+func matchesMountOption(opt string, list []string) bool {
+	name, value, _ := splitMountOption(opt)
+	for _, entry := range list {
+		entryName, entryValue, entryHasValue := splitMountOption(entry)
+		if entryName == name && (!entryHasValue || entryValue == value) {
+			return true
+		}
+	}
+	return false
+}
+
+// check verifies the options specified by a user are valid and allowed
+func (p *mountOptionPolicy) check(opts []string) error {
+	for _, opt := range opts {
+		if err := validateMountOption(opt); err != nil {
+			return err
+		}
+		if matchesMountOption(opt, p.denied) {
+			return errors.Errorf("Mount option %v is denied by the plugin's configuration", opt)
+		}
+		if len(p.allowed) > 0 && !matchesMountOption(opt, p.allowed) {
+			return errors.Errorf("Mount option %v is not allowed by the plugin's configuration", opt)
+		}
+	}
+	return nil
+}
+
+// apply checks the options specified by a user, and returns them merged with the default options
+func (p *mountOptionPolicy) apply(opts []string) ([]string, error) {
+	if err := p.check(opts); err != nil {
+		return nil, err
+	}
+	return mergeMountOptions(p.defaults, opts), nil
+}
+
+// mergeMountOptions returns the base options overridden by the options with the same name, or mutually exclusive ones
+func mergeMountOptions(base []string, overrides []string) []string {
+	merged := append([]string{}, base...)
+	for _, opt := range overrides {
+		name, _, _ := splitMountOption(opt)
+		var kept []string
+		for _, existing := range merged {
+			existingName, _, _ := splitMountOption(existing)
+			if existingName != name && exclusiveMountOptions[existingName] != name {
+				kept = append(kept, existing)
+			}
+		}
+		merged = append(kept, opt)
+	}
+	return merged
+}
+
+// setMountOptions replaces the options specified by the user for the volume, taking effect on its next mount
+func (d *elastifileDriver) setMountOptions(ctx context.Context, name string, opts []string) (
+	mountOpts []string, err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	audit := d.newAuditEntry(ctx, auditSetMountOptions, name)
+	audit.Options = map[string]string{"mount-options": strings.Join(opts, ",")}
+	defer d.recordAudit(ctx, audit, &err)
+
+	v, ok := d.lookupVolume(name)
+	if !ok {
+		return nil, newCodedError(errorCodeNotFound, "volume %s not found", name)
+	}
+	if v.Parent != "" {
+		return nil, newCodedError(errorCodeInvalidRequest, "volume %s shares the mount of volume %s - "+
+			"its mount options can't be changed", name, v.Parent)
+	}
+
+	mountOpts, err = d.mountOptions.apply(opts)
+	if err != nil {
+		return nil, withErrorCode(errorCodeInvalidRequest, err)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"mountOpts": mountOpts,
+		"mounted":   v.connections > 0,
+	}).Info("Updated mount options, effective on the next mount")
+
+	d.Lock()
+	defer d.Unlock()
+	v.MountOpts = mountOpts
+	if err = d.saveState(); err != nil {
+		return nil, withErrorCode(errorCodeInternal, err)
+	}
+	return mountOpts, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// legacyDcNameTemplate is the naming scheme used before DC name templates were introduced,
+// i.e. the Data Container is named after the Docker volume
+const legacyDcNameTemplate = "{{.Name}}"
+
+// dcNameFields are the values available to DC_NAME_TEMPLATE. They must be the same on all hosts, as volumes have
+// global scope, i.e. a volume must map to the same Data Container on every node of a swarm.
+type dcNameFields struct {
+	Prefix  string
+	SwarmID string
+	Name    string
+}
+
+var dcNameTemplate = template.Must(template.New("dcName").Parse(legacyDcNameTemplate))
+
+// initDcNaming parses the configured Data Container name template
+func initDcNaming(details driverDetails) (err error) {
+	if details.DcNameTemplate == "" {
+		return nil
+	}
+
+	tmpl, err := template.New("dcName").Option("missingkey=error").Parse(details.DcNameTemplate)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to parse DC name template", 0)
+	}
+
+	// Make sure the template can be rendered before any volume operation relies on it
+	if _, err = renderDcName(tmpl, details, "volume"); err != nil {
+		return errors.WrapPrefix(err, "Failed to validate DC name template", 0)
+	}
+
+	dcNameTemplate = tmpl
+	logrus.WithField("template", details.DcNameTemplate).Info("Using custom DC name template")
+	return nil
+}
+
+func renderDcName(tmpl *template.Template, details driverDetails, volumeName string) (name string, err error) {
+	fields := dcNameFields{
+		Prefix:  details.DcNamePrefix,
+		SwarmID: details.SwarmID,
+		Name:    volumeName,
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, fields); err != nil {
+		return "", errors.WrapPrefix(err, "Failed to render DC name", 0)
+	}
+
+	name = legalVolumeName(buf.String())
+	if name == "" {
+		return "", errors.Errorf("DC name for volume '%v' is empty after removing illegal characters", volumeName)
+	}
+	return name, nil
+}
+
+// dcNameForVolume returns the Data Container name the volume maps to
+func dcNameForVolume(volumeName string) (string, error) {
+	return renderDcName(dcNameTemplate, driverInfo, volumeName)
+}
+
+// legacyDcNameForVolume returns the Data Container name the volume would have had before
+// DC name templates were introduced. Used to adopt pre-existing volumes.
+func legacyDcNameForVolume(volumeName string) string {
+	return legalVolumeName(volumeName)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+const instanceIdFileName = "elastifile-instance-id"
+
+// initOwnerId sets the ID used to tag Data Containers created by this plugin instance.
+// Unless OWNER_ID is specified, the ID consists of the host name and a random instance ID persisted in the state directory.
+// The latter is also kept as the creator of Data Containers, which tells the plugin instances sharing an OWNER_ID apart.
+func initOwnerId(details *driverDetails) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to get host name", 0)
+	}
+
+	instanceId, err := loadOrCreateInstanceId(filepath.Join(details.Root, "state", instanceIdFileName))
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to get plugin instance ID", 0)
+	}
+	details.InstanceId = host + "/" + instanceId
+	if details.OwnerId == "" {
+		details.OwnerId = details.InstanceId
+	}
+
+	// The IDs are kept in DC metadata, so they can't contain the metadata separators
+	replacer := strings.NewReplacer(dcMetaSeparator, "", "=", "")
+	details.OwnerId = replacer.Replace(details.OwnerId)
+	details.InstanceId = replacer.Replace(details.InstanceId)
+	logrus.WithFields(logrus.Fields{
+		"ownerId":    details.OwnerId,
+		"instanceId": details.InstanceId,
+	}).Info("Using owner ID")
+	return nil
+}
+
+func loadOrCreateInstanceId(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.WrapPrefix(err, "Failed to read instance ID", 0)
+	}
+
+	buf := make([]byte, 8)
+	if _, err = rand.Read(buf); err != nil {
+		return "", errors.WrapPrefix(err, "Failed to generate instance ID", 0)
+	}
+	instanceId := hex.EncodeToString(buf)
+
+	if err = ioutil.WriteFile(path, []byte(instanceId), 0644); err != nil {
+		return "", errors.WrapPrefix(err, "Failed to persist instance ID", 0)
+	}
+	logrus.WithField("instanceId", instanceId).Info("Generated new plugin instance ID")
+	return instanceId, nil
+}
+
+// checkDeleteAllowed refuses deletion of Data Containers that were not created by this plugin instance,
+// unless the volume was created with the force option or foreign deletes are allowed by the admin.
+// dc is the Data Container's current representation in EMS, nil if it doesn't exist.
+func (d *elastifileDriver) checkDeleteAllowed(name string, v *elastifileVolume, dc *emanage.DataContainer) error {
+	if v.ForceDelete || d.allowForeignDelete {
+		return nil
+	}
+
+	if dc == nil {
+		return nil // Nothing to protect
+	}
+
+	owner := parseDcMetadata(dc.Description).Owner()
+	switch {
+	case owner == d.ownerId:
+		return nil
+	case owner != "":
+		return errors.Errorf("refusing to delete volume %v - Data Container %v is owned by %v "+
+			"(recreate the volume with -o force=true or set ALLOW_FOREIGN_DELETE=true to override)",
+			name, dc.Name, owner)
+	case v.Adopted:
+		return errors.Errorf("refusing to delete volume %v - Data Container %v was not created by this plugin "+
+			"(recreate the volume with -o force=true or set ALLOW_FOREIGN_DELETE=true to override)",
+			name, dc.Name)
+	default:
+		// Volume was created by this plugin before ownership markers were introduced
+		return nil
+	}
+}
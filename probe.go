@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/nfs/sunrpc/basic"
+	"github.com/elastifile/emanage-go/src/nfs/sunrpc/client"
+	"github.com/elastifile/emanage-go/src/nfs/sunrpc/nfsx"
+	"github.com/elastifile/emanage-go/src/nfs/sunrpc/rpc2"
+)
+
+// Before mounting, the NFS server is probed with SunRPC calls over TCP - portmapper, mountd (MNT of the export path)
+// and an NFS NULL call - so that failures are reported with a specific diagnosis instead of the mount command's output.
+// NFSv4 mounts don't use the portmapper and mountd, only the NFS NULL call is made.
+// The calls are made with the SunRPC client of emanage-go.
+
+const (
+	probeTimeout = 10 * time.Second // Overall limit, in addition to MOUNT_TIMEOUT
+
+	// Source ports for mountd calls - exports are usually only served to privileged ports ("secure" export option)
+	rpcReservedPortMin      = 600
+	rpcReservedPortMax      = 1023
+	rpcReservedPortAttempts = 16
+)
+
+// probeError is the outcome of a failed probe, e.g. "export not found"
+type probeError struct {
+	diagnosis string
+	err       error
+	transient bool // Retrying may help, e.g. the server is unreachable
+}
+
+func (e *probeError) Error() string {
+	if e.err == nil {
+		return e.diagnosis
+	}
+	return fmt.Sprintf("%v: %v", e.diagnosis, e.err)
+}
+
+// probingMounter probes the NFS server before mounting
+type probingMounter struct {
+	mounter
+}
+
+func (m *probingMounter) Mount(ctx context.Context, source string, target string, opts []string) error {
+	if err := probeExport(ctx, source, opts); err != nil {
+		return err
+	}
+	return m.mounter.Mount(ctx, source, target, opts)
+}
+
+// probeExport probes the NFS server of the source, i.e. <address>:<export path>, as it would be mounted with opts
+func probeExport(ctx context.Context, source string, opts []string) error {
+	host, exportPath, err := splitNfsSource(source)
+	if err != nil {
+		return err
+	}
+
+	var vers, proto, nfsPort, mountPort string
+	for _, opt := range opts {
+		name, value, _ := splitMountOption(opt)
+		switch name {
+		case "vers":
+			vers = value
+		case "proto":
+			proto = value
+		case "port":
+			nfsPort = value
+		case "mountport":
+			mountPort = value
+		}
+	}
+	if proto != "" && !strings.HasPrefix(proto, "tcp") {
+		loggerFrom(ctx).WithField("proto", proto).Debug("Not probing - only TCP is probed")
+		return nil
+	}
+
+	logger := loggerFrom(ctx).WithFields(logrus.Fields{
+		"source": source,
+		"vers":   vers,
+	})
+	logger.Debug("Probing NFS server")
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(vers, "4") {
+		port := nfsx.NfsPort
+		if nfsPort != "" {
+			if port, err = strconv.Atoi(nfsPort); err != nil {
+				return errors.Errorf("Invalid NFS port: %v", nfsPort)
+			}
+		}
+		return probeNfsNull(ctx, host, port, 4)
+	}
+
+	var nfsPortNum, mountPortNum int
+	if nfsPort != "" && nfsPort != "0" {
+		if nfsPortNum, err = strconv.Atoi(nfsPort); err != nil {
+			return errors.Errorf("Invalid NFS port: %v", nfsPort)
+		}
+	}
+	if mountPort != "" && mountPort != "0" {
+		if mountPortNum, err = strconv.Atoi(mountPort); err != nil {
+			return errors.Errorf("Invalid mountd port: %v", mountPort)
+		}
+	}
+	if nfsPortNum == 0 || mountPortNum == 0 {
+		if nfsPortNum, mountPortNum, err = probePortmapper(ctx, host, nfsPortNum, mountPortNum); err != nil {
+			return err
+		}
+	}
+
+	if err = probeMountd(ctx, host, mountPortNum, exportPath); err != nil {
+		return err
+	}
+	if err = probeNfsNull(ctx, host, nfsPortNum, 3); err != nil {
+		return err
+	}
+	logger.Debug("NFS server probed successfully")
+	return nil
+}
+
+// probePortmapper looks up the ports of NFS v3 and mountd v3, unless already known
+func probePortmapper(ctx context.Context, host string, nfsPort int, mountPort int) (int, int, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(basic.PmapPort))
+	c, err := dialRpc(ctx, address, false)
+	if err != nil {
+		return 0, 0, &probeError{diagnosis: "Portmapper unreachable at " + address, err: err, transient: true}
+	}
+	defer c.Close()
+
+	getport := func(prog uint32, vers uint32, name string) (int, error) {
+		port, err := basic.Getport(c, prog, vers, basic.IPProtoTCP)
+		if err != nil {
+			return 0, &probeError{diagnosis: "Portmapper call failed", err: err, transient: true}
+		}
+		if port == 0 {
+			return 0, &probeError{diagnosis: fmt.Sprintf("%v is not registered with the portmapper at %v", name, host),
+				transient: true}
+		}
+		return int(port), nil
+	}
+
+	if nfsPort == 0 {
+		if nfsPort, err = getport(nfsx.NfsProg, 3, "NFS v3 over TCP"); err != nil {
+			return 0, 0, err
+		}
+	}
+	if mountPort == 0 {
+		if mountPort, err = getport(nfsx.MountProg, nfsx.MountVers3, "Mountd v3 over TCP"); err != nil {
+			return 0, 0, err
+		}
+	}
+	return nfsPort, mountPort, nil
+}
+
+// probeMountd resolves the export path with the MNT call, then releases it with UMNT
+func probeMountd(ctx context.Context, host string, port int, exportPath string) error {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	c, err := dialRpc(ctx, address, true)
+	if err != nil {
+		return &probeError{diagnosis: "Mountd port unreachable at " + address, err: err, transient: true}
+	}
+	defer c.Close()
+
+	status, err := nfsx.Mnt3(c, exportPath)
+	if err != nil {
+		if rErr, ok := err.(*rpc2.RejectedError); ok && !rErr.RpcMismatch {
+			return &probeError{diagnosis: "Access denied for this client by mountd", err: err}
+		}
+		return &probeError{diagnosis: "Mountd call failed", err: err, transient: true}
+	}
+
+	switch status {
+	case nfsx.Mnt3Ok:
+		if err = nfsx.Umnt3(c, exportPath); err != nil {
+			loggerFrom(ctx).WithField("exportPath", exportPath).Debugf("Mountd UMNT failed: %v", err)
+		}
+		return nil
+	case nfsx.Mnt3ErrPerm, nfsx.Mnt3ErrAcces:
+		return &probeError{diagnosis: fmt.Sprintf("Access denied for this client to export %v", exportPath)}
+	case nfsx.Mnt3ErrNoent:
+		return &probeError{diagnosis: fmt.Sprintf("Export %v not found", exportPath)}
+	case nfsx.Mnt3ErrNotdir:
+		return &probeError{diagnosis: fmt.Sprintf("Export path %v is not a directory", exportPath)}
+	case nfsx.Mnt3ErrNameTooLong:
+		return &probeError{diagnosis: fmt.Sprintf("Export path %v is too long", exportPath)}
+	default:
+		return &probeError{diagnosis: fmt.Sprintf("Mountd refused export %v with status %v", exportPath, status)}
+	}
+}
+
+// probeNfsNull makes the NFS NULL call, which verifies the NFS service is up and serves the version
+func probeNfsNull(ctx context.Context, host string, port int, vers uint32) error {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	c, err := dialRpc(ctx, address, false)
+	if err != nil {
+		return &probeError{diagnosis: "NFS port unreachable at " + address, err: err, transient: true}
+	}
+	defer c.Close()
+
+	if err = nfsx.Null(c, nfsx.NfsProg, vers); err != nil {
+		if isRpcMismatch(err) {
+			return &probeError{diagnosis: fmt.Sprintf("NFS v%v is not supported by the server at %v", vers, address),
+				err: err}
+		}
+		return &probeError{diagnosis: "NFS NULL call failed", err: err, transient: true}
+	}
+	return nil
+}
+
+// isRpcMismatch tells whether the server doesn't support the program, its version or the RPC version
+func isRpcMismatch(err error) bool {
+	switch rErr := err.(type) {
+	case *rpc2.RejectedError:
+		return rErr.RpcMismatch
+	case *rpc2.AcceptedError:
+		return rErr.Stat == rpc2.ProgUnavail || rErr.Stat == rpc2.ProgMismatch
+	}
+	return false
+}
+
+// dialRpc connects to the RPC service, from a privileged source port if requested and possible. The calls are made
+// with AUTH_SYS credentials, and are limited by the context's deadline.
+func dialRpc(ctx context.Context, address string, reservedPort bool) (*client.Client, error) {
+	var dialer net.Dialer
+	if reservedPort && os.Geteuid() == 0 {
+		ports := rpcReservedPortMax - rpcReservedPortMin
+		start := rand.Intn(ports)
+		for i := 0; i < rpcReservedPortAttempts; i++ {
+			dialer.LocalAddr = &net.TCPAddr{Port: rpcReservedPortMin + (start+i)%ports}
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			if err == nil {
+				return newRpcClient(ctx, conn), nil
+			}
+			if !isAddrInUseError(err) {
+				return nil, err
+			}
+		}
+		loggerFrom(ctx).WithField("address", address).Debug("No privileged port available, connecting from any port")
+		dialer.LocalAddr = nil
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newRpcClient(ctx, conn), nil
+}
+
+func newRpcClient(ctx context.Context, conn net.Conn) *client.Client {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	hostname, _ := os.Hostname()
+	return client.New(conn, rpc2.NewAuthUnix(hostname, 0, 0))
+}
+
+func isAddrInUseError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.EADDRINUSE || err == syscall.EADDRNOTAVAIL
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// Processes holding a mount are found by the device (major:minor) of the mount rather than by path,
+// since containers see the volume at a different path and in a different mount namespace.
+// Only /proc is read, so that a hung NFS server can't block the scan.
+// Requires the host's PID namespace, i.e. "pidhost" in config.json - otherwise the holders are unknown.
+
+const procRoot = "/proc"
+
+var errHostPidsHidden = errors.New("the plugin doesn't see the host's processes (pidhost is off)")
+
+// mountHolder is a process using a mounted volume
+type mountHolder struct {
+	Pid     int
+	Command string
+	Reason  string // open file or memory map
+}
+
+// mountHolders returns the processes with open files or memory maps on the mount
+func mountHolders(target string) ([]mountHolder, error) {
+	device, err := mountDevice(filepath.Join(procRoot, "self", "mountinfo"), target)
+	if err != nil {
+		return nil, err
+	}
+	if !seesHostProcesses() { // No holders found wouldn't mean there are none
+		return nil, errHostPidsHidden
+	}
+
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to list processes", 0)
+	}
+
+	var holders []mountHolder
+	mountsByNs := map[string]map[string]string{} // Mount namespace -> mount ID -> device
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		// Processes may exit at any time - errors are ignored
+		reason := processHoldsDevice(pid, device, mountsByNs)
+		if reason == "" {
+			continue
+		}
+		comm, _ := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "comm"))
+		holders = append(holders, mountHolder{
+			Pid:     pid,
+			Command: strings.TrimSpace(string(comm)),
+			Reason:  reason,
+		})
+	}
+	return holders, nil
+}
+
+// seesHostProcesses tells whether the plugin runs in the host's PID namespace, the only one kernel threads are in
+func seesHostProcesses() bool {
+	comm, err := ioutil.ReadFile(filepath.Join(procRoot, "2", "comm")) // PID 2 is kthreadd
+	return err == nil && strings.TrimSpace(string(comm)) == "kthreadd"
+}
+
+// mountDevice returns the major:minor of the filesystem mounted on target, according to the mountinfo file
+func mountDevice(mountinfoPath string, target string) (string, error) {
+	mounts, err := parseMountinfo(mountinfoPath)
+	if err != nil {
+		return "", err
+	}
+	device := ""
+	for _, m := range mounts {
+		if m.mountPoint == target {
+			device = m.device // The last one is on top
+		}
+	}
+	if device == "" {
+		return "", errors.Errorf("%v is not mounted", target)
+	}
+	return device, nil
+}
+
+type mountinfoEntry struct {
+	id         string
+	device     string
+	mountPoint string
+}
+
+func parseMountinfo(path string) ([]mountinfoEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, fmt.Sprintf("Failed to open %v", path), 0)
+	}
+	defer f.Close()
+
+	var mounts []mountinfoEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, mountinfoEntry{
+			id:         fields[0],
+			device:     fields[2],
+			mountPoint: unescapeMountinfo(fields[4]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes of whitespace and backslashes in mountinfo paths
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// processHoldsDevice tells why the process uses the device, or returns an empty string if it doesn't
+func processHoldsDevice(pid int, device string, mountsByNs map[string]map[string]string) string {
+	procDir := filepath.Join(procRoot, strconv.Itoa(pid))
+
+	// Open files - fdinfo reports the ID of the mount the file was opened through
+	ns, err := os.Readlink(filepath.Join(procDir, "ns", "mnt"))
+	if err == nil {
+		mounts, ok := mountsByNs[ns]
+		if !ok {
+			mounts = map[string]string{}
+			entries, _ := parseMountinfo(filepath.Join(procDir, "mountinfo"))
+			for _, m := range entries {
+				mounts[m.id] = m.device
+			}
+			mountsByNs[ns] = mounts
+		}
+
+		fds, _ := ioutil.ReadDir(filepath.Join(procDir, "fdinfo"))
+		for _, fd := range fds {
+			data, err := ioutil.ReadFile(filepath.Join(procDir, "fdinfo", fd.Name()))
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, "mnt_id:") &&
+					mounts[strings.TrimSpace(strings.TrimPrefix(line, "mnt_id:"))] == device {
+					return "open file"
+				}
+			}
+		}
+	}
+
+	// Memory maps report the device in hex, e.g. 00:2f
+	if data, err := ioutil.ReadFile(filepath.Join(procDir, "maps")); err == nil {
+		hexDevice := hexMajorMinor(device)
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 6 && fields[3] == hexDevice && fields[4] != "0" {
+				return "memory map"
+			}
+		}
+	}
+	return ""
+}
+
+// hexMajorMinor converts 0:47 to 00:2f, as used by /proc/<pid>/maps
+func hexMajorMinor(device string) string {
+	parts := strings.SplitN(device, ":", 2)
+	if len(parts) != 2 {
+		return device
+	}
+	major, err1 := strconv.ParseUint(parts[0], 10, 32)
+	minor, err2 := strconv.ParseUint(parts[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return device
+	}
+	return fmt.Sprintf("%02x:%02x", major, minor)
+}
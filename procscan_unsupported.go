@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/go-errors/errors"
+)
+
+type mountHolder struct {
+	Pid     int
+	Command string
+	Reason  string
+}
+
+func mountHolders(target string) ([]mountHolder, error) {
+	return nil, errors.New("looking up processes holding a mount is not supported on this platform")
+}
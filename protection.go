@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// checkNotProtected refuses deletion of volumes protected either in the plugin state or on the Data Container.
+// The latter survives loss of the plugin state.
+func checkNotProtected(name string, v *elastifileVolume, dc *emanage.DataContainer) error {
+	if v.Protected || (dc != nil && parseDcMetadata(dc.Description).Protected()) {
+		return errors.Errorf("volume %v is protected from deletion - unprotect it via the admin API first", name)
+	}
+	return nil
+}
+
+// setProtected toggles deletion protection of the volume, both in the plugin state and on the Data Container.
+// Sub-directory and snapshot volumes share their parent's Data Container, so their protection is kept in the plugin
+// state only.
+func (d *elastifileDriver) setProtected(ctx context.Context, name string, protected bool) (err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	audit := d.newAuditEntry(ctx, auditSetProtection, name)
+	audit.Options = map[string]string{optionsProtect: strconv.FormatBool(protected)}
+	defer d.recordAudit(ctx, audit, &err)
+
+	v, ok := d.lookupVolume(name)
+	if !ok {
+		return newCodedError(errorCodeNotFound, "volume %s not found", name)
+	}
+
+	dc := v.DataContainer
+	if v.Parent == "" {
+		value := ""
+		if protected {
+			value = strconv.FormatBool(protected)
+		}
+		dc, err = d.backend.updateDcMetadata(ctx, v.DataContainer.Id, dcMetaProtected, value)
+		if err != nil {
+			return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to update Data Container protection", 0))
+		}
+	}
+
+	d.Lock()
+	v.DataContainer = dc
+	v.Protected = protected
+	err = d.saveState()
+	d.Unlock()
+	if err != nil {
+		return withErrorCode(errorCodeInternal, err)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"protected": protected,
+	}).Info("Updated volume protection")
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// Reconciliation compares the Data Containers in the plugin state with EMS, e.g. after they were changed in the EMS
+// UI or the state was restored from a backup. Differences the plugin can follow - renames, quota, policy and
+// protection changes - are fixed in the state. Missing, replaced and trashed Data Containers are only reported.
+
+// Issues found by reconciliation
+const (
+	reconcileDcMissing         = "dc_missing"
+	reconcileDcReplaced        = "dc_replaced" // Another Data Container took over the name
+	reconcileDcTrashed         = "dc_trashed"
+	reconcileDcRenamed         = "dc_renamed"
+	reconcileDcChanged         = "dc_changed"
+	reconcileProtectionChanged = "protection_changed"
+)
+
+type reconcileFinding struct {
+	Volume        string
+	DataContainer string
+	Issue         string
+	Details       string
+	Fixed         bool
+}
+
+// reconcile reports the differences between the state and EMS, and fixes them unless dryRun is set
+func (d *elastifileDriver) reconcile(ctx context.Context, dryRun bool) ([]reconcileFinding, error) {
+	dcs, err := d.backend.allDcs(ctx)
+	if err != nil {
+		return nil, withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to get Data Containers", 0))
+	}
+	byName := map[string]*emanage.DataContainer{}
+	byId := map[int]*emanage.DataContainer{}
+	for i := range dcs {
+		byName[dcs[i].Name] = &dcs[i]
+		byId[dcs[i].Id] = &dcs[i]
+	}
+
+	d.RLock()
+	var names []string
+	for name, v := range d.volumes {
+		if v.Parent == "" {
+			names = append(names, name)
+		}
+	}
+	d.RUnlock()
+	sort.Strings(names)
+
+	findings := []reconcileFinding{}
+	for _, name := range names {
+		volumeFindings, err := d.reconcileVolume(ctx, name, byName, byId, dryRun)
+		findings = append(findings, volumeFindings...)
+		if err != nil {
+			return nil, withErrorCode(errorCodeInternal, err)
+		}
+	}
+	return findings, nil
+}
+
+func (d *elastifileDriver) reconcileVolume(ctx context.Context, name string, byName map[string]*emanage.DataContainer,
+	byId map[int]*emanage.DataContainer, dryRun bool) (findings []reconcileFinding, err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	v, ok := d.lookupVolume(name)
+	if !ok || v.DataContainer == nil { // Removed meanwhile
+		return nil, nil
+	}
+	d.RLock()
+	known := *v.DataContainer
+	protected := v.Protected
+	d.RUnlock()
+
+	finding := func(issue string, details string, fixable bool) {
+		findings = append(findings, reconcileFinding{
+			Volume:        name,
+			DataContainer: known.Name,
+			Issue:         issue,
+			Details:       details,
+			Fixed:         fixable && !dryRun,
+		})
+	}
+
+	current, ok := byId[known.Id]
+	if !ok {
+		if other, ok := byName[known.Name]; ok {
+			finding(reconcileDcReplaced, fmt.Sprintf("Data Container %v has ID %v instead of %v - "+
+				"the volume can only be removed, or the Data Container imported as another volume", other.Name, other.Id,
+				known.Id), false)
+		} else {
+			finding(reconcileDcMissing, "the volume can only be removed", false)
+		}
+		return findings, nil
+	}
+
+	meta := parseDcMetadata(current.Description)
+	if meta.Get(dcMetaTrashedAt) != "" {
+		finding(reconcileDcTrashed, fmt.Sprintf("moved to trash as %v", current.Name), false)
+		return findings, nil
+	}
+	if current.Name != known.Name {
+		finding(reconcileDcRenamed, fmt.Sprintf("renamed to %v", current.Name), true)
+	}
+	if current.HardQuota != known.HardQuota || current.SoftQuota != known.SoftQuota ||
+		current.PolicyId != known.PolicyId {
+		finding(reconcileDcChanged, fmt.Sprintf("quota %v -> %v, policy ID %v -> %v", known.HardQuota,
+			current.HardQuota, known.PolicyId, current.PolicyId), true)
+	}
+	if meta.Protected() != protected {
+		finding(reconcileProtectionChanged, fmt.Sprintf("protected %v -> %v", protected, meta.Protected()), true)
+	}
+
+	if len(findings) == 0 || dryRun {
+		return findings, nil
+	}
+
+	d.Lock()
+	for _, other := range d.volumes { // Sub-directory and snapshot volumes keep a copy of the Data Container
+		if other == v || other.Parent == name {
+			dc := *current
+			other.DataContainer = &dc
+		}
+	}
+	v.Protected = meta.Protected()
+	err = d.saveState()
+	d.Unlock()
+	if err != nil {
+		return findings, err
+	}
+
+	for _, f := range findings {
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			logFieldVolume: name,
+			logFieldDcName: current.Name,
+			"issue":        f.Issue,
+		}).Info("Reconciled volume with EMS")
+		audit := d.newAuditEntry(ctx, auditReconcile, name)
+		audit.Options = map[string]string{"issue": f.Issue, "details": f.Details}
+		d.recordAudit(ctx, audit, nil)
+	}
+	return findings, nil
+}
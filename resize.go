@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+	"github.com/elastifile/emanage-go/src/size"
+)
+
+// resizeVolume sets the hard and soft quota of the volume's Data Container. Shrinking the quota below the used
+// capacity is refused.
+func (d *elastifileDriver) resizeVolume(ctx context.Context, name string, sizeVal string) (_ int, err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	audit := d.newAuditEntry(ctx, auditResize, name)
+	audit.Options = map[string]string{optionsSize: sizeVal}
+	defer d.recordAudit(ctx, audit, &err)
+
+	parsed, err := size.Parse(sizeVal)
+	if err != nil || parsed == 0 {
+		return 0, newCodedError(errorCodeInvalidRequest, "Failed to parse volume size '%v'", sizeVal)
+	}
+	quota := int(parsed)
+
+	v, ok := d.lookupVolume(name)
+	if !ok {
+		return 0, newCodedError(errorCodeNotFound, "volume %s not found", name)
+	}
+	if v.Parent != "" {
+		return 0, newCodedError(errorCodeInvalidRequest, "volume %s shares the Data Container of volume %s - "+
+			"resize volume %s instead", name, v.Parent, v.Parent)
+	}
+
+	exists, current, err := d.backend.dcExists(ctx, v.DataContainer.Name)
+	if err != nil {
+		return 0, withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to get Data Container", 0))
+	}
+	if !exists {
+		return 0, newCodedError(errorCodeNotFound, "Data Container %v of volume %v not found", v.DataContainer.Name,
+			name)
+	}
+	if quota < current.UsedCapacity {
+		return 0, newCodedError(errorCodeConflict, "volume %s uses %v bytes, more than the requested size of %v bytes",
+			name, current.UsedCapacity, quota)
+	}
+
+	dc, err := d.backend.updateDc(ctx, current.Id, func(dc *emanage.DataContainer) {
+		dc.HardQuota = quota
+		dc.SoftQuota = quota // As on create
+	})
+	if err != nil {
+		return 0, withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to update Data Container quota", 0))
+	}
+
+	d.Lock()
+	v.DataContainer = dc
+	err = d.saveState()
+	d.Unlock()
+	if err != nil {
+		return 0, withErrorCode(errorCodeInternal, err)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: dc.Name,
+		"from":         current.HardQuota,
+		"to":           quota,
+	}).Info("Resized volume")
+	return quota, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// Snapshot volumes expose a snapshot of an existing (source) volume's Data Container read-only, without restoring it.
+// Snapshots can also be cloned into writable volumes, or restored, via the admin API (see cloneVolume and
+// restoreSnapshot).
+// ECFS exposes the snapshots of a Data Container under its .snapshot directory, so snapshot volumes are bind-mounted
+// read-only from the shared mount of the source's Data Container, just like sub-directory volumes (see subdir.go).
+// The source is kept in the volume's Parent field.
+// Where the Data Container has no snapshot directory, the snapshot is cloned into a Data Container of the snapshot
+// volume's own, exported and mounted read-only. The source is kept in the volume's SnapshotOf field then, as the
+// volume no longer depends on the source's Data Container.
+
+const snapshotDirName = ".snapshot"
+
+func cleanSnapshotName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", errors.Errorf("Invalid %v: '%v'", optionsSnapshot, name)
+	}
+	return name, nil
+}
+
+// createSnapshotVolume creates a read-only volume of a snapshot. Must be called with the volume lock held.
+func (d *elastifileDriver) createSnapshotVolume(ctx context.Context, r *volume.CreateRequest) error {
+	sourceName := r.Options[optionsSnapshotOf]
+	v := &elastifileVolume{Parent: sourceName}
+
+	for key, val := range r.Options {
+		switch key {
+		case optionsSnapshotOf:
+		case optionsSnapshot:
+			v.Snapshot = val
+		default:
+			return logErrorAndReturn(ctx, "Option %v is not supported for snapshot volumes", key)
+		}
+	}
+
+	var err error
+	if v.Snapshot, err = cleanSnapshotName(v.Snapshot); err != nil {
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+	if sourceName == "" || sourceName == r.Name {
+		return logErrorAndReturn(ctx, "Invalid %v: '%v'", optionsSnapshotOf, sourceName)
+	}
+
+	d.volumeLocks.Lock(sourceName)
+	defer d.volumeLocks.Unlock(sourceName)
+
+	source, ok := d.lookupVolume(sourceName)
+	if !ok {
+		return logErrorAndReturn(ctx, "source volume %s not found", sourceName)
+	}
+	if source.Parent != "" {
+		return logErrorAndReturn(ctx, "volume %s is not backed by its own Data Container - use %v as the source", sourceName,
+			source.Parent)
+	}
+
+	if existing, ok := d.lookupVolume(r.Name); ok {
+		if existing.snapshotSource() == sourceName && existing.Snapshot == v.Snapshot {
+			loggerFrom(ctx).Info("Snapshot volume already exists")
+			return nil
+		}
+		return logErrorAndReturn(ctx, "volume %s already exists", r.Name)
+	}
+
+	v.Mountpoint = filepath.Join(d.root, r.Name)
+	v.MountOpts = append([]string{}, source.MountOpts...)
+	v.Export = source.Export
+	v.DataContainer = source.DataContainer
+	v.Owner = source.Owner
+	v.Adopted = source.Adopted
+
+	sharedPath, err := d.acquireSharedMount(ctx, v)
+	if err != nil {
+		return logErrorAndReturn(ctx, "Failed to mount Data Container %v: %v", v.DataContainer.Name, err)
+	}
+	hasSnapshotDir, err := checkSnapshotDir(ctx, sharedPath, v)
+	d.releaseSharedMount(ctx, v)
+	if err != nil {
+		return err
+	}
+	if !hasSnapshotDir {
+		if err = d.cloneSnapshot(ctx, r.Name, source, v); err != nil {
+			return err
+		}
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"source":   sourceName,
+		"snapshot": v.Snapshot,
+		"clone":    !hasSnapshotDir,
+	}).Info("Created snapshot volume")
+
+	d.Lock()
+	defer d.Unlock()
+	v.CreatedAt = time.Now().UTC()
+	d.volumes[r.Name] = v
+	if err = d.saveState(); err != nil {
+		delete(d.volumes, r.Name)
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+	return nil
+}
+
+// cloneVolume creates a writable volume backed by a clone of a snapshot of the source volume's Data Container.
+// Unlike snapshot volumes, the clone is a volume of its own - it doesn't depend on the source.
+func (d *elastifileDriver) cloneVolume(ctx context.Context, name string, sourceName string, snapshot string) (
+	err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	audit := d.newAuditEntry(ctx, auditClone, name)
+	audit.Parent = sourceName
+	audit.Snapshot = snapshot
+	defer d.recordAudit(ctx, audit, &err)
+
+	if _, err = cleanSnapshotName(snapshot); err != nil {
+		return withErrorCode(errorCodeInvalidRequest, err)
+	}
+	if sourceName == "" || sourceName == name {
+		return newCodedError(errorCodeInvalidRequest, "Invalid source volume: '%v'", sourceName)
+	}
+	if _, ok := d.lookupVolume(name); ok {
+		return newCodedError(errorCodeConflict, "volume %s already exists", name)
+	}
+
+	d.volumeLocks.Lock(sourceName)
+	defer d.volumeLocks.Unlock(sourceName)
+
+	source, ok := d.lookupVolume(sourceName)
+	if !ok {
+		return newCodedError(errorCodeNotFound, "source volume %s not found", sourceName)
+	}
+	if source.Parent != "" {
+		return newCodedError(errorCodeInvalidRequest, "volume %s is not backed by its own Data Container - "+
+			"use %v as the source", sourceName, source.Parent)
+	}
+
+	dcName, err := dcNameForVolume(name)
+	if err != nil {
+		return withErrorCode(errorCodeInvalidRequest,
+			errors.WrapPrefix(err, fmt.Sprintf("Failed to compose DC name for volume %v", name), 0))
+	}
+	dcOpts, exportOpts := Ems.defaultDcExportCreateOpts(dcName)
+	copyUserMapping(exportOpts, source.Export)
+	export, dc, err := d.backend.CloneSnapshot(ctx, source.DataContainer, snapshot, dcOpts, exportOpts)
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err,
+			fmt.Sprintf("Failed to clone snapshot %v of volume %v", snapshot, sourceName), 0))
+	}
+	audit.DataContainer = &auditObject{Id: dc.Id, Name: dc.Name}
+	audit.Export = &auditObject{Id: export.Id, Name: export.Name}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"source":       sourceName,
+		"snapshot":     snapshot,
+		logFieldDcName: dc.Name,
+	}).Info("Cloned snapshot into a new volume")
+
+	d.Lock()
+	defer d.Unlock()
+	d.volumes[name] = &elastifileVolume{
+		Mountpoint:    filepath.Join(d.root, name),
+		MountOpts:     append([]string{}, source.MountOpts...),
+		Export:        export,
+		DataContainer: dc,
+		Owner:         d.ownerId,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err = d.saveState(); err != nil {
+		delete(d.volumes, name)
+		return withErrorCode(errorCodeInternal, err)
+	}
+	return nil
+}
+
+// restoreSnapshot replaces the volume's Data Container with a clone of one of its snapshots. The replaced Data
+// Container is moved to the trash in retention mode, and deleted otherwise. The clone takes over its name, quotas
+// and metadata, so the volume is mounted from the same export path.
+func (d *elastifileDriver) restoreSnapshot(ctx context.Context, name string, snapshot string) (err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	audit := d.newAuditEntry(ctx, auditRestoreSnapshot, name)
+	audit.Snapshot = snapshot
+	defer d.recordAudit(ctx, audit, &err)
+
+	if _, err = cleanSnapshotName(snapshot); err != nil {
+		return withErrorCode(errorCodeInvalidRequest, err)
+	}
+	v, ok := d.lookupVolume(name)
+	if !ok {
+		return newCodedError(errorCodeNotFound, "volume %s not found", name)
+	}
+	if v.Parent != "" || v.SnapshotOf != "" {
+		return newCodedError(errorCodeInvalidRequest, "volume %s is a sub-directory or snapshot volume - "+
+			"only volumes backed by their own Data Container can be restored", name)
+	}
+	if v.connections != 0 || v.Orphaned != nil {
+		return newCodedError(errorCodeConflict, "volume %s is currently mounted", name)
+	}
+	if err = d.checkNoChildren(name); err != nil {
+		return withErrorCode(errorCodeConflict, err)
+	}
+
+	exists, dc, err := d.backend.dcExists(ctx, v.DataContainer.Name)
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to get Data Container", 0))
+	}
+	if !exists {
+		return newCodedError(errorCodeNotFound, "Data Container %v of volume %v not found", v.DataContainer.Name, name)
+	}
+	if err = checkNotProtected(name, v, dc); err != nil {
+		return withErrorCode(errorCodeConflict, err)
+	}
+	if err = d.checkDeleteAllowed(name, v, dc); err != nil {
+		return withErrorCode(errorCodeConflict, err)
+	}
+
+	cloneName := fmt.Sprintf("%v-restore-%v", dc.Name, time.Now().UTC().Format("20060102T150405"))
+	dcOpts, exportOpts := Ems.defaultDcExportCreateOpts(cloneName)
+	copyUserMapping(exportOpts, v.Export) // The volume keeps its mount options
+	export, clone, err := d.backend.CloneSnapshot(ctx, dc, snapshot, dcOpts, exportOpts)
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err,
+			fmt.Sprintf("Failed to clone snapshot %v of volume %v", snapshot, name), 0))
+	}
+
+	if d.retentionPeriod > 0 {
+		err = d.backend.TrashDcExport(ctx, name, v)
+	} else {
+		err = d.backend.DeleteDcExport(ctx, v)
+	}
+	if err != nil {
+		unused := &elastifileVolume{Export: export, DataContainer: clone}
+		if deleteErr := d.backend.DeleteDcExport(ctx, unused); deleteErr != nil {
+			loggerFrom(ctx).WithField(logFieldDcName, clone.Name).Warnf(
+				"Failed to delete the clone of the snapshot: %v", deleteErr)
+		}
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to replace Data Container", 0))
+	}
+
+	renamed, err := d.backend.updateDc(ctx, clone.Id, func(clone *emanage.DataContainer) {
+		clone.Name = dc.Name
+		clone.Description = dc.Description
+		clone.HardQuota = dc.HardQuota
+		clone.SoftQuota = dc.SoftQuota
+	})
+	if err != nil { // The volume is usable with the clone's name
+		loggerFrom(ctx).WithField(logFieldDcName, clone.Name).Warnf(
+			"Failed to rename the clone of the snapshot to %v: %v", dc.Name, err)
+	} else {
+		clone = renamed
+	}
+	audit.DataContainer = &auditObject{Id: clone.Id, Name: clone.Name}
+	audit.Export = &auditObject{Id: export.Id, Name: export.Name}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"snapshot":     snapshot,
+		logFieldDcName: clone.Name,
+	}).Info("Restored volume from snapshot")
+
+	d.Lock()
+	defer d.Unlock()
+	v.Export = export
+	v.DataContainer = clone
+	if err = d.saveState(); err != nil {
+		return withErrorCode(errorCodeInternal, err)
+	}
+	return nil
+}
+
+// checkSnapshotDir verifies the snapshot is reachable through the snapshot directory of the Data Container. Returns
+// false if the Data Container has no snapshot directory.
+func checkSnapshotDir(ctx context.Context, sharedPath string, v *elastifileVolume) (bool, error) {
+	if _, err := os.Stat(filepath.Join(sharedPath, snapshotDirName)); err != nil {
+		if os.IsNotExist(err) {
+			loggerFrom(ctx).WithField(logFieldDcName, v.DataContainer.Name).Info(
+				"Data Container has no snapshot directory, cloning the snapshot")
+			return false, nil
+		}
+		return false, logErrorAndReturn(ctx, "Failed to access the snapshots of Data Container %v: %v",
+			v.DataContainer.Name, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(sharedPath, snapshotDirName, v.Snapshot)); err != nil {
+		if os.IsNotExist(err) {
+			return false, logErrorAndReturn(ctx, "snapshot %v of volume %v not found", v.Snapshot, v.Parent)
+		}
+		return false, logErrorAndReturn(ctx, "Failed to access snapshot %v of volume %v: %v", v.Snapshot, v.Parent, err)
+	}
+	return true, nil
+}
+
+// cloneSnapshot backs the snapshot volume with a clone of the snapshot, exported and mounted read-only
+func (d *elastifileDriver) cloneSnapshot(ctx context.Context, name string, source *elastifileVolume,
+	v *elastifileVolume) error {
+	dcName, err := dcNameForVolume(name)
+	if err != nil {
+		return errors.WrapPrefix(err, fmt.Sprintf("Failed to compose DC name for volume %v", name), 0)
+	}
+	dcOpts, exportOpts := Ems.defaultDcExportCreateOpts(dcName)
+	copyUserMapping(exportOpts, source.Export)
+	exportOpts.Access = emanage.ExportAccessRO
+
+	export, dc, err := d.backend.CloneSnapshot(ctx, source.DataContainer, v.Snapshot, dcOpts, exportOpts)
+	if err != nil {
+		return logErrorAndReturn(ctx, "Failed to clone snapshot %v of volume %v: %v", v.Snapshot, v.Parent, err)
+	}
+
+	v.SnapshotOf = v.Parent
+	v.Parent = ""
+	v.Export = export
+	v.DataContainer = dc
+	v.Owner = d.ownerId
+	v.Adopted = false
+	if !hasMountOption(v.MountOpts, "ro") {
+		v.MountOpts = append(v.MountOpts, "ro")
+	}
+	return nil
+}
+
+// createSnapshot takes a snapshot of the volume's Data Container on ECFS, named after the current time unless
+// specified. The snapshot can then be exposed by a snapshot volume.
+func (d *elastifileDriver) createSnapshot(ctx context.Context, name string, snapshot string) (_ string, err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	if snapshot == "" {
+		snapshot = "edvp-" + time.Now().UTC().Format("20060102-150405")
+	}
+	audit := d.newAuditEntry(ctx, auditSnapshot, name)
+	audit.Options = map[string]string{optionsSnapshot: snapshot}
+	defer d.recordAudit(ctx, audit, &err)
+
+	if _, err = cleanSnapshotName(snapshot); err != nil {
+		return "", withErrorCode(errorCodeInvalidRequest, err)
+	}
+	v, ok := d.lookupVolume(name)
+	if !ok {
+		return "", newCodedError(errorCodeNotFound, "volume %s not found", name)
+	}
+	if v.Parent != "" {
+		return "", newCodedError(errorCodeInvalidRequest, "volume %s is not backed by its own Data Container - "+
+			"snapshot volume %v instead", name, v.Parent)
+	}
+
+	if err = d.backend.CreateSnapshot(ctx, v.DataContainer, snapshot); err != nil {
+		return "", withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to create snapshot", 0))
+	}
+	loggerFrom(ctx).WithField("snapshot", snapshot).Info("Created snapshot")
+	return snapshot, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The state file is replaced atomically - written to <state file>.tmp, synced and renamed over the previous one,
+// which is kept as <state file>.bak. A state file that can't be read, e.g. one damaged by a crash of the host, is
+// moved aside as <state file>.corrupt-<unix time> and the backup is loaded instead.
+// The file holds a schema version, and files written in older formats are migrated when loaded.
+
+const (
+	// stateFileName is the file in the state directory that persists the volumes
+	stateFileName = "elastifile-state.json"
+
+	stateVersion      = 2
+	stateTempSuffix   = ".tmp"
+	stateBackupSuffix = ".bak"
+)
+
+// stateFile is the format of the state file
+type stateFile struct {
+	Version int
+	Volumes map[string]*elastifileVolume
+}
+
+// stateMigrations convert the state file from the version to the next one
+var stateMigrations = map[int]func(data []byte) ([]byte, error){
+	1: migrateStateV1,
+}
+
+// migrateStateV1 wraps the volume map, which made up version 1 of the state file, with the version
+func migrateStateV1(data []byte) ([]byte, error) {
+	var state struct {
+		Version int
+		Volumes map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(data, &state.Volumes); err != nil {
+		return nil, err
+	}
+	state.Version = 2
+	return json.Marshal(state)
+}
+
+// stateFileVersion returns the version of the state file's contents. Version 1 had no version field.
+func stateFileVersion(data []byte) (int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return 0, err
+	}
+	var version int
+	if raw, ok := fields["Version"]; ok && json.Unmarshal(raw, &version) == nil { // Unlike a volume named Version
+		return version, nil
+	}
+	return 1, nil
+}
+
+// decodeState parses the state file's contents, migrating older versions. It also returns the original version.
+func decodeState(data []byte) (map[string]*elastifileVolume, int, error) {
+	version, err := stateFileVersion(data)
+	if err != nil {
+		return nil, 0, errors.WrapPrefix(err, "Failed to unmarshal state", 0)
+	}
+	if version > stateVersion {
+		return nil, version, errors.Errorf("State version %v is newer than the supported version %v", version,
+			stateVersion)
+	}
+
+	for v := version; v < stateVersion; v++ {
+		migrate, ok := stateMigrations[v]
+		if !ok {
+			return nil, version, errors.Errorf("Unsupported state version %v", v)
+		}
+		if data, err = migrate(data); err != nil {
+			return nil, version, errors.WrapPrefix(err, fmt.Sprintf("Failed to migrate state from version %v", v), 0)
+		}
+	}
+
+	var state stateFile
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, version, errors.WrapPrefix(err, "Failed to unmarshal state", 0)
+	}
+	if state.Volumes == nil {
+		state.Volumes = map[string]*elastifileVolume{}
+	}
+	return state.Volumes, version, nil
+}
+
+// encodeState returns the state file's contents
+func encodeState(volumes map[string]*elastifileVolume) ([]byte, error) {
+	if volumes == nil {
+		volumes = map[string]*elastifileVolume{}
+	}
+	data, err := json.Marshal(stateFile{Version: stateVersion, Volumes: volumes})
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to marshal state", 0)
+	}
+	return data, nil
+}
+
+// loadStateFile reads the volumes persisted in the state file, or returns nil if there's no state file
+func loadStateFile(path string) (map[string]*elastifileVolume, error) {
+	volumes, _, err := readStateFile(path)
+	return volumes, err
+}
+
+// readStateFile is loadStateFile, that also returns the version the state file was written in
+func readStateFile(path string) (map[string]*elastifileVolume, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logrus.WithField("statePath", path).Debug("State not found")
+			return nil, 0, nil
+		}
+		return nil, 0, errors.WrapPrefix(err, "Failed to load state", 0)
+	}
+
+	logrus.WithField("data", string(data)).Debug("Loaded state")
+	return decodeState(data)
+}
+
+// writeStateFile atomically replaces the state file, keeping the previous one as a backup
+func writeStateFile(path string, volumes map[string]*elastifileVolume) error {
+	data, err := encodeState(volumes)
+	if err != nil {
+		return err
+	}
+
+	previous, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WrapPrefix(err, "Failed to read state", 0)
+	}
+	if err == nil && json.Valid(previous) {
+		if err = writeFileAtomic(path+stateBackupSuffix, previous); err != nil {
+			return errors.WrapPrefix(err, "Failed to back up state", 0)
+		}
+	}
+
+	if err = writeFileAtomic(path, data); err != nil {
+		return errors.WrapPrefix(err, "Failed to write state", 0)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file with the data, such that a crash leaves either the previous or the new contents
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + stateTempSuffix
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err = os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir persists the directory's entries, e.g. a file renamed into it
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// loadState loads the driver's volumes from the state file, falling back to its backup if the state file can't be
+// read. The state is saved right away if it was migrated or recovered from the backup.
+func (d *elastifileDriver) loadState() error {
+	logger := logrus.WithField("statePath", d.statePath)
+	volumes, version, err := readStateFile(d.statePath)
+	if err != nil && version > stateVersion {
+		return err // Written by a newer plugin version, which its backup probably was too
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to load state, trying the backup")
+		backupPath := d.statePath + stateBackupSuffix
+		var backupErr error
+		volumes, version, backupErr = readStateFile(backupPath)
+		if backupErr == nil && volumes == nil {
+			backupErr = errors.New("not found")
+		}
+		if backupErr != nil {
+			return errors.Errorf("%v, and no usable backup in %v: %v", err, backupPath, backupErr)
+		}
+
+		corruptPath := fmt.Sprintf("%v.corrupt-%v", d.statePath, time.Now().Unix())
+		if renameErr := os.Rename(d.statePath, corruptPath); renameErr != nil {
+			return errors.WrapPrefix(renameErr, "Failed to move aside the unreadable state", 0)
+		}
+		logger.WithField("corruptPath", corruptPath).Warn("Recovered state from the backup")
+	}
+	if volumes == nil {
+		return nil
+	}
+
+	d.volumes = volumes
+	if err == nil && version == stateVersion {
+		return nil
+	}
+	if version != stateVersion {
+		logger.WithFields(logrus.Fields{
+			"from": version,
+			"to":   stateVersion,
+		}).Info("Migrating state")
+	}
+	return writeStateFile(d.statePath, d.volumes)
+}
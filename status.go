@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// The status of a volume, reported by docker volume inspect, combines the plugin's state, the Data Container as
+// reported by EMS, and the file system usage of the mount (statfs) while the volume is mounted.
+// Sub-directory and snapshot volumes report the figures of the Data Container they share.
+
+// Mount states
+const (
+	mountStateMounted   = "mounted"
+	mountStateUnmounted = "unmounted"
+	mountStateDetached  = "detached" // By the health monitor, pending remount
+	mountStateOrphaned  = "orphaned"
+)
+
+const statfsTimeout = 2 * time.Second
+
+// fsUsage is the usage of a mounted file system, in bytes
+type fsUsage struct {
+	Size      uint64
+	Used      uint64
+	Available uint64
+}
+
+// localStatus returns the status that is known without querying EMS or the mount.
+// Must be called with the driver's read lock held.
+func (d *elastifileDriver) localStatus(v *elastifileVolume) map[string]interface{} {
+	status := v.status()
+	if status == nil {
+		status = map[string]interface{}{}
+	}
+
+	if v.DataContainer != nil {
+		status["DataContainerId"] = v.DataContainer.Id
+		status["DataContainer"] = v.DataContainer.Name
+	}
+	status["NfsServer"] = d.storageAddr
+	status["MountOptions"] = v.MountOpts
+	status["Owner"] = v.Owner
+	status["Protected"] = v.Protected
+	if !v.CreatedAt.IsZero() {
+		status["CreatedAt"] = v.CreatedAt.Format(time.RFC3339)
+	}
+
+	var ids []string
+	for id := range v.mountIds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	status["ActiveMounts"] = ids
+
+	switch {
+	case v.Orphaned != nil:
+		status["MountState"] = mountStateOrphaned
+	case v.detached:
+		status["MountState"] = mountStateDetached
+	case len(v.mountIds) > 0:
+		status["MountState"] = mountStateMounted
+	default:
+		status["MountState"] = mountStateUnmounted
+	}
+	return status
+}
+
+// fullStatus adds the Data Container's quota and usage to the local status. EMS and the mount are queried without
+// holding any lock.
+func (d *elastifileDriver) fullStatus(ctx context.Context, v *elastifileVolume) map[string]interface{} {
+	d.RLock()
+	status := d.localStatus(v)
+	if v.DataContainer == nil {
+		d.RUnlock()
+		status["StatusError"] = "volume has no Data Container"
+		return status
+	}
+	dc := *v.DataContainer
+	export := v.Export
+	mountpoint := v.Mountpoint
+	mounted := len(v.mountIds) > 0 && !v.detached && (v.health == nil || v.health.State == mountHealthy)
+	d.RUnlock()
+
+	logger := loggerFrom(ctx)
+
+	if exportPath, err := d.backend.dcExportPath(ctx, export); err == nil {
+		status["ExportPath"] = exportPath
+	} else {
+		logger.Debugf("Failed to get export path: %v", err)
+	}
+
+	exists, current, err := d.backend.dcExists(ctx, dc.Name)
+	if err != nil {
+		status["StatusError"] = err.Error()
+	} else if !exists {
+		status["StatusError"] = "Data Container not found"
+	} else {
+		dc = *current
+	}
+	status["HardQuota"] = dc.HardQuota
+	status["SoftQuota"] = dc.SoftQuota
+	status["UsedCapacity"] = dc.UsedCapacity
+	status["UsageSource"] = "ems"
+	if dc.HardQuota > 0 {
+		status["UsedPercent"] = percent(uint64(dc.UsedCapacity), uint64(dc.HardQuota))
+	}
+	if policy, err := d.backend.policyById(ctx, dc.PolicyId); err == nil {
+		status["Policy"] = policy.Name
+	} else {
+		logger.Debugf("Failed to get policy: %v", err)
+	}
+
+	if mounted { // The mount is more up to date than EMS
+		usage, err := statfsWithTimeout(mountpoint)
+		if err != nil {
+			logger.Warnf("Failed to get file system usage: %v", err)
+		} else {
+			status["UsedCapacity"] = usage.Used
+			status["AvailableCapacity"] = usage.Available
+			status["UsageSource"] = "statfs"
+			if usage.Size > 0 {
+				status["UsedPercent"] = percent(usage.Used, usage.Size)
+			}
+		}
+	}
+	return status
+}
+
+func percent(used uint64, total uint64) float64 {
+	return math.Round(float64(used)/float64(total)*10000) / 100
+}
+
+// statfsWithTimeout gives up on statfs after statfsTimeout, e.g. if the NFS server stopped responding
+func statfsWithTimeout(path string) (fsUsage, error) {
+	type result struct {
+		usage fsUsage
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		usage, err := statfs(path)
+		done <- result{usage, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.usage, res.err
+	case <-time.After(statfsTimeout):
+		return fsUsage{}, errors.Errorf("no response within %v", statfsTimeout)
+	}
+}
+
+// inspectVolume returns the volume as persisted in the state, and its full status
+func (d *elastifileDriver) inspectVolume(ctx context.Context, name string) (json.RawMessage, map[string]interface{},
+	error) {
+	v, ok := d.lookupVolume(name)
+	if !ok {
+		return nil, nil, newCodedError(errorCodeNotFound, "volume %s not found", name)
+	}
+
+	d.RLock()
+	data, err := json.Marshal(v)
+	d.RUnlock()
+	if err != nil {
+		return nil, nil, errors.WrapPrefix(err, "Failed to marshal volume", 0)
+	}
+	return data, d.fullStatus(ctx, v), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/go-errors/errors"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// The stress tests run volume operations concurrently. Run them with -race to detect data races.
+
+const (
+	stressWorkers    = 8
+	stressIterations = 5
+	stressLatency    = 100 * time.Millisecond // Backend latency, for the parallelism test
+	sharedVolume     = "shared"
+)
+
+// slowBackend delays the creation of Data Containers, like a loaded management server
+type slowBackend struct {
+	storageBackend
+	latency time.Duration
+}
+
+func (b *slowBackend) CreateDcExport(ctx context.Context, dcOpts *emanage.DcCreateOpts,
+	exportOpts *emanage.ExportCreateOpts, policyName string) (*emanage.Export, *emanage.DataContainer, error) {
+
+	time.Sleep(b.latency)
+	return b.storageBackend.CreateDcExport(ctx, dcOpts, exportOpts, policyName)
+}
+
+// newStressDriver creates a driver with the specified backend and a fake mounter, whose audit log is rotated
+// during the tests
+func newStressDriver(t *testing.T, backend storageBackend) (*elastifileDriver, string) {
+	root, err := ioutil.TempDir("", "edvp-stress-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(root, "state"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	details := driverDetails{
+		Root:             root,
+		AuditLog:         true,
+		AuditLogMaxSize:  16 << 10,
+		AuditLogMaxFiles: 2,
+	}
+	d, err := newElastifileDriverWith(details, backend, newFakeMounter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, root
+}
+
+func TestConcurrentVolumes(t *testing.T) {
+	backend := newFakeBackend()
+	d, root := newStressDriver(t, backend)
+	defer os.RemoveAll(root)
+
+	if err := d.Create(&volume.CreateRequest{Name: sharedVolume}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	pollErrs := make(chan error, 1)
+	go func() { // Read-only requests shouldn't fail or block while other volumes change
+		defer close(pollErrs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := d.List(); err != nil {
+				pollErrs <- err
+				return
+			}
+			if _, err := d.Get(&volume.GetRequest{Name: sharedVolume}); err != nil {
+				pollErrs <- err
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, stressWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if err := stressWorker(d, w); err != nil {
+				errs <- errors.Errorf("worker %v: %v", w, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if err := <-pollErrs; err != nil {
+		t.Errorf("Concurrent read-only request failed: %v", err)
+	}
+
+	// All the shared volume's mounts are gone, so it can be removed
+	if err := d.Remove(&volume.RemoveRequest{Name: sharedVolume}); err != nil {
+		t.Fatal(err)
+	}
+	expectNoVolumes(t, d, root, backend)
+}
+
+func TestSlowBackendDoesNotSerializeCreates(t *testing.T) {
+	backend := newFakeBackend()
+	d, root := newStressDriver(t, &slowBackend{storageBackend: backend, latency: stressLatency})
+	defer os.RemoveAll(root)
+
+	start := time.Now()
+	if err := d.Create(&volume.CreateRequest{Name: "serial"}); err != nil {
+		t.Fatal(err)
+	}
+	serial := time.Since(start)
+
+	start = time.Now()
+	errs := make(chan error, stressWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- d.Create(&volume.CreateRequest{Name: fmt.Sprintf("parallel-%v", w)})
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	concurrent := time.Since(start)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Serialized creates would take stressWorkers times longer than a single one
+	if concurrent > serial*stressWorkers/2 {
+		t.Errorf("%v concurrent creates took %v, a single create took %v - creates are serialized",
+			stressWorkers, concurrent, serial)
+	}
+
+	res, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range res.Volumes {
+		if err = d.Remove(&volume.RemoveRequest{Name: v.Name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectNoVolumes(t, d, root, backend)
+}
+
+// stressWorker repeatedly creates, mounts, unmounts and removes a volume of its own, and mounts the shared volume
+func stressWorker(d *elastifileDriver, w int) error {
+	for i := 0; i < stressIterations; i++ {
+		name := fmt.Sprintf("stress-%v-%v", w, i)
+		sharedId := fmt.Sprintf("shared-%v-%v", w, i)
+
+		if _, err := d.Mount(&volume.MountRequest{Name: sharedVolume, ID: sharedId}); err != nil {
+			return err
+		}
+		if err := d.Create(&volume.CreateRequest{Name: name}); err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		mountErrs := make(chan error, 2)
+		for _, id := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				_, err := d.Mount(&volume.MountRequest{Name: name, ID: id})
+				mountErrs <- err
+			}(id)
+		}
+		wg.Wait()
+		close(mountErrs)
+		for err := range mountErrs {
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, id := range []string{"a", "b"} {
+			if err := d.Unmount(&volume.UnmountRequest{Name: name, ID: id}); err != nil {
+				return err
+			}
+		}
+		if err := d.Remove(&volume.RemoveRequest{Name: name}); err != nil {
+			return err
+		}
+		if err := d.Unmount(&volume.UnmountRequest{Name: sharedVolume, ID: sharedId}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectNoVolumes verifies that neither the driver, its persisted state nor the backend have any volumes left
+func expectNoVolumes(t *testing.T, d *elastifileDriver, root string, backend *fakeBackend) {
+	res, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Volumes) > 0 {
+		t.Errorf("unexpected volumes: %v", len(res.Volumes))
+	}
+
+	restarted, err := newElastifileDriverWith(driverDetails{Root: root}, backend, newFakeMounter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.volumes) > 0 {
+		t.Errorf("unexpected volumes in state: %v", len(restarted.volumes))
+	}
+
+	backend.Lock()
+	defer backend.Unlock()
+	if len(backend.dcs) > 0 {
+		t.Errorf("unexpected Data Containers: %v", len(backend.dcs))
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Sub-directory volumes are directories inside the Data Container of an existing (parent) volume.
+// They have no Data Container / Export of their own: the parent's export is mounted once per host under
+// <root>/shared/<DC name>, shared by all the sub-directory volumes, and each of them bind-mounts its directory.
+// The shared mount is reference counted across the mounted sub-directory volumes of the Data Container.
+// Lock order: the sub-directory volume's lock is taken before the parent's.
+
+const subdirTrashPrefix = ".edvp-trash-" // Removed sub-directories in retention mode, deleted along with the parent
+
+// sharedMount is the NFS mount of a Data Container, used by its sub-directory volumes
+type sharedMount struct {
+	refs    int
+	mounted bool
+}
+
+// sharedMounts tracks the shared mounts by Data Container name
+type sharedMounts struct {
+	sync.Mutex
+
+	locks  *keyedMutex // Held while mounting / unmounting
+	mounts map[string]*sharedMount
+}
+
+func newSharedMounts() *sharedMounts {
+	return &sharedMounts{
+		locks:  newKeyedMutex(),
+		mounts: map[string]*sharedMount{},
+	}
+}
+
+func (s *sharedMounts) get(dcName string) *sharedMount {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.mounts[dcName]
+	if !ok {
+		m = &sharedMount{}
+		s.mounts[dcName] = m
+	}
+	return m
+}
+
+// cleanSubdir validates the sub-directory path, which must stay inside the Data Container
+func cleanSubdir(subdir string) (string, error) {
+	cleaned := path.Clean("/" + subdir)[1:]
+	if cleaned == "" || cleaned != strings.Trim(subdir, "/") || strings.HasPrefix(path.Base(cleaned), subdirTrashPrefix) {
+		return "", errors.Errorf("Invalid %v: '%v' - expected a relative path without '..'", optionsSubdir, subdir)
+	}
+	return cleaned, nil
+}
+
+// createSubdirVolume creates a sub-directory volume. Must be called with the volume lock held.
+func (d *elastifileDriver) createSubdirVolume(ctx context.Context, r *volume.CreateRequest) error {
+	parentName := r.Options[optionsParent]
+	subdir := r.Name
+	v := &elastifileVolume{Parent: parentName}
+
+	for key, val := range r.Options {
+		switch key {
+		case optionsParent:
+		case optionsSubdir:
+			subdir = val
+		case optionsProtect:
+			protect, err := strconv.ParseBool(val)
+			if err != nil {
+				return logErrorAndReturn(ctx, "Unsupported %v value: %v", optionsProtect, val)
+			}
+			v.Protected = protect
+		default:
+			return logErrorAndReturn(ctx, "Option %v is not supported for sub-directory volumes - it's inherited from volume %v",
+				key, parentName)
+		}
+	}
+
+	var err error
+	if v.Subdir, err = cleanSubdir(subdir); err != nil {
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+	if parentName == "" || parentName == r.Name {
+		return logErrorAndReturn(ctx, "Invalid %v: '%v'", optionsParent, parentName)
+	}
+
+	d.volumeLocks.Lock(parentName)
+	defer d.volumeLocks.Unlock(parentName)
+
+	parent, ok := d.lookupVolume(parentName)
+	if !ok {
+		return logErrorAndReturn(ctx, "parent volume %s not found", parentName)
+	}
+	if parent.Parent != "" {
+		return logErrorAndReturn(ctx, "volume %s is a sub-directory volume itself - use %v as the parent", parentName, parent.Parent)
+	}
+
+	if existing, ok := d.lookupVolume(r.Name); ok {
+		if existing.Parent == parentName && existing.Subdir == v.Subdir {
+			loggerFrom(ctx).Info("Sub-directory volume already exists")
+			return nil
+		}
+		return logErrorAndReturn(ctx, "volume %s already exists", r.Name)
+	}
+	for name, child := range d.childVolumes(parentName) {
+		if child.Snapshot == "" && child.Subdir == v.Subdir {
+			return logErrorAndReturn(ctx, "%v %v of volume %v is already used by volume %v", optionsSubdir, v.Subdir, parentName, name)
+		}
+	}
+
+	v.Mountpoint = filepath.Join(d.root, r.Name)
+	v.MountOpts = append([]string{}, parent.MountOpts...)
+	v.Export = parent.Export
+	v.DataContainer = parent.DataContainer
+	v.Owner = parent.Owner
+	v.Adopted = parent.Adopted
+
+	sharedPath, err := d.acquireSharedMount(ctx, v)
+	if err != nil {
+		return logErrorAndReturn(ctx, "Failed to mount Data Container %v: %v", v.DataContainer.Name, err)
+	}
+	err = os.MkdirAll(filepath.Join(sharedPath, v.Subdir), 0755)
+	d.releaseSharedMount(ctx, v)
+	if err != nil {
+		return logErrorAndReturn(ctx, "Failed to create %v %v: %v", optionsSubdir, v.Subdir, err)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"parent": parentName,
+		"subdir": v.Subdir,
+	}).Info("Created sub-directory volume")
+
+	d.Lock()
+	defer d.Unlock()
+	v.CreatedAt = time.Now().UTC()
+	d.volumes[r.Name] = v
+	if err = d.saveState(); err != nil {
+		delete(d.volumes, r.Name)
+		return logErrorAndReturn(ctx, "%v", err)
+	}
+	return nil
+}
+
+// removeSubdirVolume removes the volume's directory, or moves it aside in retention mode.
+// Must be called with the volume lock held.
+func (d *elastifileDriver) removeSubdirVolume(ctx context.Context, name string, v *elastifileVolume) error {
+	sharedPath, err := d.acquireSharedMount(ctx, v)
+	if err != nil {
+		return errors.WrapPrefix(err, fmt.Sprintf("Failed to mount Data Container %v", v.DataContainer.Name), 0)
+	}
+	defer d.releaseSharedMount(ctx, v)
+
+	dir := filepath.Join(sharedPath, v.Subdir)
+	if d.retentionPeriod > 0 {
+		trashed := filepath.Join(filepath.Dir(dir), subdirTrashPrefix+time.Now().UTC().Format("20060102T150405")+"-"+filepath.Base(dir))
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"trashed": trashed,
+		}).Info("Moving sub-directory to trash")
+		err = os.Rename(dir, trashed)
+	} else {
+		err = os.RemoveAll(dir)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WrapPrefix(err, fmt.Sprintf("Failed to remove %v %v", optionsSubdir, v.Subdir), 0)
+	}
+	return nil
+}
+
+// childVolumes returns the sub-directory and snapshot volumes of the volume by name
+func (d *elastifileDriver) childVolumes(parentName string) map[string]*elastifileVolume {
+	d.RLock()
+	defer d.RUnlock()
+
+	children := map[string]*elastifileVolume{}
+	for name, v := range d.volumes {
+		if v.Parent == parentName {
+			children[name] = v
+		}
+	}
+	return children
+}
+
+// checkNoChildren refuses removing a volume whose Data Container is used by sub-directory or snapshot volumes
+func (d *elastifileDriver) checkNoChildren(name string) error {
+	children := d.childVolumes(name)
+	if len(children) == 0 {
+		return nil
+	}
+	var names []string
+	for child := range children {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+	return errors.Errorf("volume %v has sub-directory / snapshot volumes: %v - remove them first", name, strings.Join(names, ", "))
+}
+
+// mountSubdirVolume bind-mounts the volume's directory from the shared mount of the Data Container,
+// or the snapshot's directory for snapshot volumes
+func (d *elastifileDriver) mountSubdirVolume(ctx context.Context, v *elastifileVolume) error {
+	sharedPath, err := d.acquireSharedMount(ctx, v)
+	if err != nil {
+		return errors.WrapPrefix(err, fmt.Sprintf("Failed to mount Data Container %v", v.DataContainer.Name), 0)
+	}
+
+	source := filepath.Join(sharedPath, v.Subdir)
+	var opts []string
+	if v.Snapshot != "" {
+		source = filepath.Join(sharedPath, snapshotDirName, v.Snapshot)
+		opts = []string{"ro"}
+	}
+	loggerFrom(ctx).Infof("Bind mounting %s on %s", source, v.Mountpoint)
+	if err = d.mounter.Bind(ctx, source, v.Mountpoint, opts); err != nil {
+		d.releaseSharedMount(ctx, v)
+		return errors.WrapPrefix(err, fmt.Sprintf("Failed to bind mount %v on %v", source, v.Mountpoint), 0)
+	}
+	return nil
+}
+
+// acquireSharedMount mounts the Data Container of the sub-directory volume, unless already mounted,
+// and returns the shared mount point
+func (d *elastifileDriver) acquireSharedMount(ctx context.Context, v *elastifileVolume) (string, error) {
+	dcName := v.DataContainer.Name
+	sharedPath := filepath.Join(d.sharedRoot, dcName)
+
+	d.sharedMounts.locks.Lock(dcName)
+	defer d.sharedMounts.locks.Unlock(dcName)
+
+	m := d.sharedMounts.get(dcName)
+	if !m.mounted {
+		if err := os.MkdirAll(sharedPath, 0755); err != nil {
+			return "", err
+		}
+		source, err := d.exportSource(ctx, v)
+		if err != nil {
+			return "", err
+		}
+		loggerFrom(ctx).Infof("Mounting shared %s on %s", source, sharedPath)
+		if err = d.mounter.Mount(ctx, source, sharedPath, v.MountOpts); err != nil {
+			return "", err
+		}
+		m.mounted = true
+	}
+	m.refs++
+	return sharedPath, nil
+}
+
+// releaseSharedMount unmounts the shared mount of the Data Container once no sub-directory volume uses it
+func (d *elastifileDriver) releaseSharedMount(ctx context.Context, v *elastifileVolume) {
+	dcName := v.DataContainer.Name
+	sharedPath := filepath.Join(d.sharedRoot, dcName)
+
+	d.sharedMounts.locks.Lock(dcName)
+	defer d.sharedMounts.locks.Unlock(dcName)
+
+	m := d.sharedMounts.get(dcName)
+	if m.refs > 0 {
+		m.refs--
+	}
+	if m.refs > 0 || !m.mounted {
+		return
+	}
+
+	if err := d.unmountVolume(ctx, sharedPath, d.unmountStrategy); err != nil && !isNotMountedError(err) {
+		// Kept mounted - reused by the next sub-directory volume
+		loggerFrom(ctx).WithField("mountpoint", sharedPath).Errorf("Failed to unmount shared mount: %v", err)
+		return
+	}
+	m.mounted = false
+}
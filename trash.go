@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastifile/emanage-go/src/emanage-client"
+)
+
+// In retention mode, removed volumes are moved to the trash instead of being deleted:
+// the export is deleted and the Data Container is renamed and tagged with the removal time.
+// Trashed Data Containers are purged once the retention period expires, unless restored earlier.
+const (
+	trashDcPrefix      = "trash"
+	trashPurgeInterval = 10 * time.Minute
+)
+
+type trashEntry struct {
+	DcName    string
+	DcId      int
+	Volume    string
+	TrashedAt time.Time
+}
+
+func trashDcName(dcName string, trashedAt time.Time) string {
+	return legalVolumeName(fmt.Sprintf("%v-%v-%v", trashDcPrefix, trashedAt.UTC().Format("20060102T150405"), dcName))
+}
+
+// TrashDcExport deletes the volume's Export and moves its Data Container to the trash
+func (ems *EmsWrapper) TrashDcExport(ctx context.Context, name string, v *elastifileVolume) (err error) {
+	exportExists, _, err := ems.exportExists(ctx, v.Export.Name, v.DataContainer.Id)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to check if Export exists", 0)
+	}
+	if exportExists {
+		err = ems.DeleteExport(ctx, v.Export)
+		if err != nil {
+			return errors.WrapPrefix(err, "Failed to delete Export", 0)
+		}
+	}
+
+	trashedAt := time.Now()
+	dc, err := ems.updateDc(ctx, v.DataContainer.Id, func(dc *emanage.DataContainer) {
+		setTrashMetadata(dc, name, v, trashedAt)
+	})
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to move Data Container to trash", 0)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldVolume: name,
+		logFieldDcName: dc.Name,
+	}).Info("Moved Data Container to trash")
+	return nil
+}
+
+// setTrashMetadata renames the Data Container and tags it as trashed, along with what it takes to restore the volume
+func setTrashMetadata(dc *emanage.DataContainer, name string, v *elastifileVolume, trashedAt time.Time) {
+	meta := parseDcMetadata(dc.Description)
+	meta.Set(dcMetaTrashedAt, strconv.FormatInt(trashedAt.Unix(), 10))
+	meta.Set(dcMetaVolume, name)
+	meta.Set(dcMetaTrashedBy, driverInfo.OwnerId)
+	meta.Set(dcMetaUserMapping, string(v.Export.UserMapping))
+	meta.Set(dcMetaUserMappingUid, strconv.Itoa(v.Export.Uid))
+	meta.Set(dcMetaUserMappingGid, strconv.Itoa(v.Export.Gid))
+	meta.Set(dcMetaMountOpts, strings.Join(v.MountOpts, ","))
+	dc.Name = trashDcName(dc.Name, trashedAt)
+	dc.Description = meta.String()
+}
+
+// clearTrashMetadata removes the trash tags from the Data Container's metadata, and returns the export options and
+// mount options of the removed volume. Data Containers trashed before these were kept get the defaults.
+func (d *elastifileDriver) clearTrashMetadata(dc *emanage.DataContainer) (*emanage.ExportCreateOpts, []string) {
+	meta := parseDcMetadata(dc.Description)
+	exportOpts := Ems.defaultExportCreateOpts()
+	if userMapping := meta.Get(dcMetaUserMapping); userMapping != "" {
+		exportOpts.UserMapping = emanage.UserMappingType(userMapping)
+	}
+	if uid, err := strconv.Atoi(meta.Get(dcMetaUserMappingUid)); err == nil {
+		exportOpts.Uid = &uid
+	}
+	if gid, err := strconv.Atoi(meta.Get(dcMetaUserMappingGid)); err == nil {
+		exportOpts.Gid = &gid
+	}
+	mountOpts := append([]string{}, d.mountOptions.defaults...)
+	if opts := meta.Get(dcMetaMountOpts); opts != "" {
+		mountOpts = strings.Split(opts, ",")
+	}
+
+	for _, key := range []string{dcMetaTrashedAt, dcMetaVolume, dcMetaTrashedBy, dcMetaUserMapping, dcMetaUserMappingUid,
+		dcMetaUserMappingGid, dcMetaMountOpts} {
+		meta.Set(key, "")
+	}
+	dc.Description = meta.String()
+	return exportOpts, mountOpts
+}
+
+// listTrash returns the Data Containers trashed by this plugin instance, including adopted ones
+func (d *elastifileDriver) listTrash(ctx context.Context) (entries []trashEntry, err error) {
+	dcs, err := d.backend.allDcs(ctx)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to get Data Containers", 0)
+	}
+
+	for _, dc := range dcs {
+		meta := parseDcMetadata(dc.Description)
+		trashedBy := meta.Get(dcMetaTrashedBy)
+		if trashedBy == "" { // Trashed before the plugin kept track
+			trashedBy = meta.Owner()
+		}
+		if meta.Get(dcMetaTrashedAt) == "" || trashedBy != d.ownerId {
+			continue
+		}
+
+		trashedAt, err := strconv.ParseInt(meta.Get(dcMetaTrashedAt), 10, 64)
+		if err != nil {
+			loggerFrom(ctx).WithFields(logrus.Fields{
+				logFieldDcName: dc.Name,
+				"trashedAt":    meta.Get(dcMetaTrashedAt),
+			}).Warn("Skipping trashed Data Container with malformed removal time")
+			continue
+		}
+
+		entries = append(entries, trashEntry{
+			DcName:    dc.Name,
+			DcId:      dc.Id,
+			Volume:    meta.Get(dcMetaVolume),
+			TrashedAt: time.Unix(trashedAt, 0),
+		})
+	}
+	return entries, nil
+}
+
+// purgeTrash deletes trashed Data Containers whose retention period has expired
+func (d *elastifileDriver) purgeTrash(ctx context.Context) error {
+	entries, err := d.expiredTrash(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		d.purgeTrashEntry(ctx, entry) // Logged
+	}
+	return nil
+}
+
+// expiredTrash returns the trashed Data Containers whose retention period has expired
+func (d *elastifileDriver) expiredTrash(ctx context.Context) ([]trashEntry, error) {
+	entries, err := d.listTrash(ctx)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to list trash", 0)
+	}
+
+	var expired []trashEntry
+	for _, entry := range entries {
+		if time.Since(entry.TrashedAt) >= d.retentionPeriod {
+			expired = append(expired, entry)
+		}
+	}
+	return expired, nil
+}
+
+// purgeTrashEntry deletes the trashed Data Container, unless it was restored or changed since it was listed
+func (d *elastifileDriver) purgeTrashEntry(ctx context.Context, entry trashEntry) error {
+	d.trashLock.Lock() // Against restores between listing the trash and deleting the Data Container
+	defer d.trashLock.Unlock()
+
+	err := d.deleteTrashedDc(ctx, entry)
+	d.recordAudit(ctx, &auditEntry{
+		Operation:     auditPurge,
+		Volume:        entry.Volume,
+		RequestId:     requestIdFrom(ctx),
+		DataContainer: &auditObject{Id: entry.DcId, Name: entry.DcName},
+	}, &err)
+	if err != nil {
+		loggerFrom(ctx).WithField(logFieldDcName, entry.DcName).WithError(err).Error(
+			"Failed to purge trashed Data Container")
+		return err
+	}
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldDcName: entry.DcName,
+		logFieldVolume: entry.Volume,
+		"trashedAt":    entry.TrashedAt,
+	}).Info("Purged trashed Data Container")
+	return nil
+}
+
+// deleteTrashedDc deletes the Data Container, after checking that it's still the trashed one
+func (d *elastifileDriver) deleteTrashedDc(ctx context.Context, entry trashEntry) error {
+	exists, dc, err := d.backend.dcExists(ctx, entry.DcName)
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to get Data Container "+entry.DcName, 0)
+	}
+	if !exists {
+		return errors.Errorf("Trashed Data Container %v no longer exists - skipped", entry.DcName)
+	}
+	trashedAt := parseDcMetadata(dc.Description).Get(dcMetaTrashedAt)
+	if dc.Id != entry.DcId || trashedAt != strconv.FormatInt(entry.TrashedAt.Unix(), 10) {
+		return errors.Errorf("Data Container %v changed since it was found in the trash - skipped", entry.DcName)
+	}
+	return d.backend.DeleteDc(ctx, dc)
+}
+
+func (d *elastifileDriver) runTrashPurger() {
+	logrus.WithField("retentionPeriod", d.retentionPeriod).Info("Starting trash purger")
+	for {
+		ctx := newLogContext("purge-trash", "")
+		if err := d.purgeTrash(ctx); err != nil {
+			loggerFrom(ctx).Error(err.Error())
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+// restoreFromTrash turns a trashed Data Container back into a Docker volume.
+// The volume keeps its original name unless volumeName is specified.
+func (d *elastifileDriver) restoreFromTrash(ctx context.Context, dcName string, volumeName string) (err error) {
+	d.trashLock.Lock() // Restores are rare - serialize them, rather than lock each trashed Data Container
+	defer d.trashLock.Unlock()
+
+	audit := &auditEntry{
+		Operation:     auditRestore,
+		Volume:        volumeName,
+		RequestId:     requestIdFrom(ctx),
+		DataContainer: &auditObject{Name: dcName},
+	}
+	defer d.recordAudit(ctx, audit, &err)
+
+	entries, err := d.listTrash(ctx)
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to list trash", 0))
+	}
+
+	var entry *trashEntry
+	for i := range entries {
+		if entries[i].DcName == dcName {
+			entry = &entries[i]
+			break
+		}
+	}
+	if entry == nil {
+		return newCodedError(errorCodeNotFound, "trashed Data Container %v not found", dcName)
+	}
+
+	if volumeName == "" {
+		volumeName = entry.Volume
+	}
+	audit.Volume = volumeName
+	audit.DataContainer.Id = entry.DcId
+	d.volumeLocks.Lock(volumeName)
+	defer d.volumeLocks.Unlock(volumeName)
+	if _, ok := d.lookupVolume(volumeName); ok {
+		return newCodedError(errorCodeConflict, "volume %v already exists", volumeName)
+	}
+
+	restoredDcName, err := dcNameForVolume(volumeName)
+	if err != nil {
+		return errors.WrapPrefix(err, fmt.Sprintf("Failed to compose DC name for volume %v", volumeName), 0)
+	}
+	exists, _, err := d.backend.dcExists(ctx, restoredDcName)
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to check if Data Container exists", 0))
+	}
+	if exists {
+		return newCodedError(errorCodeConflict, "Data Container %v already exists", restoredDcName)
+	}
+
+	var exportOpts *emanage.ExportCreateOpts
+	var mountOpts []string
+	dc, err := d.backend.updateDc(ctx, entry.DcId, func(dc *emanage.DataContainer) {
+		exportOpts, mountOpts = d.clearTrashMetadata(dc)
+		dc.Name = restoredDcName
+	})
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to restore Data Container from trash", 0))
+	}
+	audit.DataContainer.Name = dc.Name
+
+	exportOpts.DcId = dc.Id
+	export, err := d.backend.CreateExport(ctx, defaultExportName, exportOpts)
+	if err != nil {
+		return withErrorCode(errorCodeBackend, errors.WrapPrefix(err, "Failed to create Export", 0))
+	}
+	audit.Export = &auditObject{Id: export.Id, Name: export.Name}
+
+	dcMeta := parseDcMetadata(dc.Description)
+	d.Lock()
+	defer d.Unlock()
+	d.volumes[volumeName] = &elastifileVolume{
+		Mountpoint:    filepath.Join(d.root, volumeName),
+		MountOpts:     mountOpts,
+		Export:        &export,
+		DataContainer: dc,
+		Owner:         dcMeta.Owner(),
+		Adopted:       dcMeta.Owner() != d.ownerId,
+		Protected:     dcMeta.Protected(),
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err = d.saveState(); err != nil {
+		return withErrorCode(errorCodeInternal, err)
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		logFieldVolume: volumeName,
+		logFieldDcName: dc.Name,
+	}).Info("Restored volume from trash")
+	return nil
+}
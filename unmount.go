@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Unmount strategy steps, tried in the order given by UNMOUNT_STRATEGY once a plain unmount fails
+const (
+	unmountStepRetry  = "retry"  // Retry the plain unmount, e.g. until processes release the mount
+	unmountStepForce  = "force"  // MNT_FORCE - abort pending NFS requests, e.g. when the server is unreachable
+	unmountStepDetach = "detach" // MNT_DETACH - detach the mount now, the kernel cleans it up once it's no longer busy
+)
+
+const (
+	unmountRetries        = 3
+	unmountRetryBackoff   = time.Second
+	orphanCleanupInterval = 5 * time.Minute
+)
+
+// orphanedMount is a mount left behind when unmounting the volume failed after its last container was done with it
+type orphanedMount struct {
+	Since   time.Time
+	Error   string
+	Holders []mountHolder `json:",omitempty"`
+}
+
+// unmountError reports the processes holding the mount, if they could be found
+type unmountError struct {
+	target     string
+	err        error
+	holders    []mountHolder
+	holdersErr error // Why the holders are unknown
+}
+
+func (e *unmountError) Error() string {
+	msg := fmt.Sprintf("Failed to unmount %v: %v", e.target, e.err)
+	if e.holdersErr != nil {
+		return fmt.Sprintf("%v - holders unknown: %v", msg, e.holdersErr)
+	}
+	if len(e.holders) == 0 {
+		return msg
+	}
+	var holders []string
+	for _, h := range e.holders {
+		holders = append(holders, fmt.Sprintf("pid %v (%v, %v)", h.Pid, h.Command, h.Reason))
+	}
+	return fmt.Sprintf("%v - held by %v", msg, strings.Join(holders, ", "))
+}
+
+func parseUnmountStrategy(value string) (strategy []string, err error) {
+	for _, step := range strings.Split(value, ",") {
+		step = strings.TrimSpace(step)
+		switch step {
+		case "":
+		case unmountStepRetry, unmountStepForce, unmountStepDetach:
+			strategy = append(strategy, step)
+		default:
+			return nil, errors.Errorf("Unsupported unmount strategy step: %v", step)
+		}
+	}
+	return strategy, nil
+}
+
+// isNotMountedError tells whether unmount failed because the target isn't mounted, i.e. there's nothing to clean up.
+// All the mounters, as well as the umount binary, report it as "not mounted".
+func isNotMountedError(err error) bool {
+	return strings.Contains(err.Error(), "not mounted")
+}
+
+// unmountVolume tries a plain unmount, followed by the steps of the strategy until one of them succeeds
+func (d *elastifileDriver) unmountVolume(ctx context.Context, target string, strategy []string) error {
+	loggerFrom(ctx).Infof("Unmounting %s", target)
+
+	err := d.mounter.Unmount(ctx, target)
+	for _, step := range strategy {
+		if err == nil || isNotMountedError(err) {
+			break
+		}
+		logger := loggerFrom(ctx).WithFields(logrus.Fields{
+			"target": target,
+			"step":   step,
+		})
+		logger.Warnf("Unmount failed: %v", err)
+
+		switch step {
+		case unmountStepRetry:
+			backoff := unmountRetryBackoff
+			for i := 0; i < unmountRetries && err != nil; i++ {
+				time.Sleep(backoff)
+				backoff *= 2
+				err = d.mounter.Unmount(ctx, target)
+			}
+		case unmountStepForce:
+			err = d.mounter.ForceUnmount(ctx, target)
+		case unmountStepDetach:
+			err = d.mounter.Detach(ctx, target)
+		}
+		if err == nil {
+			logger.Info("Unmounted")
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	uErr := &unmountError{target: target, err: err}
+	if !isNotMountedError(err) {
+		if uErr.holders, uErr.holdersErr = mountHolders(target); uErr.holdersErr != nil {
+			loggerFrom(ctx).WithField("target", target).Debugf("Failed to look up processes holding the mount: %v",
+				uErr.holdersErr)
+		}
+	}
+	return uErr
+}
+
+// trackOrphanedMount records the mount left behind by a failed unmount. Must be called with the volume lock held.
+func (d *elastifileDriver) trackOrphanedMount(ctx context.Context, name string, v *elastifileVolume, err error) {
+	orphan := &orphanedMount{
+		Since: time.Now(),
+		Error: err.Error(),
+	}
+	if uErr, ok := err.(*unmountError); ok {
+		orphan.Holders = uErr.holders
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"mountpoint": v.Mountpoint,
+	}).Warn("Tracking orphaned mount for later cleanup")
+
+	d.Lock()
+	defer d.Unlock()
+	v.Orphaned = orphan
+	if err := d.saveState(); err != nil { // The caller reports the failed unmount
+		loggerFrom(ctx).Error(err.Error())
+	}
+}
+
+// releaseOrphanedMount unmounts the orphaned mount of the volume. Must be called with the volume lock held.
+func (d *elastifileDriver) releaseOrphanedMount(ctx context.Context, name string, v *elastifileVolume, strategy []string) error {
+	err := d.unmountVolume(ctx, v.Mountpoint, strategy)
+	if err != nil && !isNotMountedError(err) {
+		orphan := *v.Orphaned
+		orphan.Error = err.Error()
+		if uErr, ok := err.(*unmountError); ok {
+			orphan.Holders = uErr.holders
+		}
+		d.Lock()
+		v.Orphaned = &orphan
+		if saveErr := d.saveState(); saveErr != nil {
+			loggerFrom(ctx).Error(saveErr.Error())
+		}
+		d.Unlock()
+		return err
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"mountpoint": v.Mountpoint,
+	}).Info("Released orphaned mount")
+	if v.Parent != "" { // The orphaned bind mount kept the shared mount in use
+		d.releaseSharedMount(ctx, v)
+	}
+	d.Lock()
+	v.Orphaned = nil
+	if err = d.saveState(); err != nil { // The mount is released all the same
+		loggerFrom(ctx).Error(err.Error())
+	}
+	d.Unlock()
+	return nil
+}
+
+// reuseOrphanedMount tells whether the volume's orphaned mount, which couldn't be released, can serve a new mount
+// request instead of mounting the volume again. Must be called with the volume lock held.
+func (d *elastifileDriver) reuseOrphanedMount(ctx context.Context, name string, v *elastifileVolume) bool {
+	if v.Orphaned == nil {
+		return false
+	}
+	if err := d.releaseOrphanedMount(ctx, name, v, nil); err == nil {
+		return false
+	}
+
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"mountpoint": v.Mountpoint,
+	}).Info("Reusing orphaned mount")
+	d.Lock()
+	v.Orphaned = nil
+	if err := d.saveState(); err != nil { // The mount is reused all the same
+		loggerFrom(ctx).Error(err.Error())
+	}
+	d.Unlock()
+	return true
+}
+
+// cleanupOrphanedMount releases the orphaned mount of the volume using the strategy, or the plugin's strategy if nil
+func (d *elastifileDriver) cleanupOrphanedMount(ctx context.Context, name string, strategy []string) (err error) {
+	d.volumeLocks.Lock(name)
+	defer d.volumeLocks.Unlock(name)
+
+	audit := d.newAuditEntry(ctx, auditCleanupOrphan, name)
+	if strategy != nil {
+		audit.Options = map[string]string{"strategy": strings.Join(strategy, ",")}
+	}
+	defer d.recordAudit(ctx, audit, &err)
+
+	v, ok := d.lookupVolume(name)
+	if !ok {
+		return newCodedError(errorCodeNotFound, "volume %s not found", name)
+	}
+	if v.Orphaned == nil {
+		return newCodedError(errorCodeConflict, "volume %s has no orphaned mount", name)
+	}
+	if strategy == nil {
+		strategy = d.unmountStrategy
+	}
+	return d.releaseOrphanedMount(ctx, name, v, strategy)
+}
+
+// orphanedMounts returns the orphaned mounts by volume name
+func (d *elastifileDriver) orphanedMounts() map[string]orphanedMount {
+	d.RLock()
+	defer d.RUnlock()
+
+	orphans := map[string]orphanedMount{}
+	for name, v := range d.volumes {
+		if v.Orphaned != nil {
+			orphans[name] = *v.Orphaned
+		}
+	}
+	return orphans
+}
+
+func (d *elastifileDriver) runOrphanCleaner() {
+	for {
+		time.Sleep(orphanCleanupInterval)
+		for name := range d.orphanedMounts() {
+			ctx := newLogContext("cleanup-orphan", name)
+			if err := d.cleanupOrphanedMount(ctx, name, nil); err != nil {
+				loggerFrom(ctx).Warnf("Orphaned mount cleanup failed: %v", err)
+			}
+		}
+	}
+}
@@ -1,23 +1,83 @@
 package main
 
 import (
-	"github.com/go-errors/errors"
+	"time"
 
 	"github.com/elastifile/emanage-go/src/emanage-client"
 )
 
 type elastifileVolume struct {
 	connections   int
+	health        *mountHealth   // Outcome of the last health check, nil until the mount is checked
+	detached      bool           // The mount was detached by the health monitor, and not mounted again yet
+	mountIds      map[string]int // Docker mount IDs using the volume, guarded by the driver's RWMutex
 	Mountpoint    string
 	MountOpts     []string
 	Export        *emanage.Export
 	DataContainer *emanage.DataContainer
+	Owner         string // Owner ID found on the Data Container when the volume was created
+	Adopted       bool   // The Data Container was not created by this plugin instance
+	ForceDelete   bool   // Allow deleting the Data Container regardless of its owner
+	Protected     bool   // Refuse deleting the volume
+	CreatedAt     time.Time
+
+	RemoveIfExists *bool          `json:",omitempty"` // Overrides the plugin-wide idempotence setting for remove
+	Orphaned       *orphanedMount `json:",omitempty"` // Mount left behind by a failed unmount
+	Parent         string         `json:",omitempty"` // Volume whose Data Container holds this sub-directory / snapshot volume
+	Subdir         string         `json:",omitempty"` // Path of the sub-directory volume in the Data Container
+	Snapshot       string         `json:",omitempty"` // Snapshot of the parent's Data Container, mounted read-only
+	SnapshotOf     string         `json:",omitempty"` // Source of a snapshot volume backed by a clone of the snapshot
+}
+
+// snapshotSource returns the source volume of a snapshot volume
+func (v *elastifileVolume) snapshotSource() string {
+	if v.SnapshotOf != "" {
+		return v.SnapshotOf
+	}
+	return v.Parent
+}
+
+// addMountId records a mount of the volume by Docker. Must be called with the driver's write lock held.
+func (v *elastifileVolume) addMountId(id string) {
+	if v.mountIds == nil {
+		v.mountIds = map[string]int{}
+	}
+	v.mountIds[id]++
 }
 
-func (v *elastifileVolume) ExportPath() (exportPath string, err error) {
-	exportPath, err = Ems.dcExportPath(v.Export)
-	if err != nil {
-		err = errors.WrapPrefix(err, "Failed to get export path from EMS", 0)
+// removeMountId records an unmount of the volume by Docker. Must be called with the driver's write lock held.
+func (v *elastifileVolume) removeMountId(id string) {
+	if v.mountIds[id]--; v.mountIds[id] <= 0 {
+		delete(v.mountIds, id)
+	}
+}
+
+// status is reported to Docker, e.g. by docker volume inspect. Must be called with the driver's read lock held.
+func (v *elastifileVolume) status() map[string]interface{} {
+	if v.health == nil && v.Orphaned == nil && v.Parent == "" && v.Snapshot == "" {
+		return nil
+	}
+
+	status := map[string]interface{}{}
+	if v.Snapshot != "" {
+		status["SnapshotOf"] = v.snapshotSource()
+		status["Snapshot"] = v.Snapshot
+		status["ReadOnly"] = true
+	} else if v.Parent != "" {
+		status["Parent"] = v.Parent
+		status["Subdir"] = v.Subdir
+	}
+	if v.health != nil {
+		status["MountHealth"] = v.health.State
+		status["MountHealthCheckedAt"] = v.health.CheckedAt.Format(time.RFC3339)
+		status["Remounts"] = v.health.Remounts
+		if v.health.Error != "" {
+			status["MountHealthError"] = v.health.Error
+		}
+	}
+	if v.Orphaned != nil {
+		status["OrphanedMountSince"] = v.Orphaned.Since.Format(time.RFC3339)
+		status["OrphanedMountError"] = v.Orphaned.Error
 	}
-	return
+	return status
 }